@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Go-routine-4995/routermgt/auth"
 	"github.com/Go-routine-4995/routermgt/domain"
 	"github.com/nats-io/nats.go"
-	"os"
-	"os/signal"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nuid"
+	"strconv"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -17,20 +20,90 @@ const (
 	messageGetPaged
 	messageCreate
 	messageDelete
-
-	queue = "worker_group_router"
+	messageDescribe
+	messageQuota
+	messageAudit
+	messageHistory
+	messageDiff
+	messageRestore
+	messageDeleted
+	messageUpdate
+	messageLabel
+	messageGroups
+	messageGroupSave
+	messageGroupDelete
+	messageAssign
+	messageTransition
+
+	// events are published on <subject>.<tenant>.events so that the broker permissions and the
+	// subscribers see the events of their tenants only
+	eventSuffix = ".events"
+	// quota events are published on <subject>.<tenant>.events.quota, one token more than the
+	// <subject>.<tenant>.<operation> endpoints so that the service does not receive them
+	quotaEventSuffix = ".events.quota"
+	// instance status (broker state, repository pool...) is served on <subject>.status, it has
+	// no tenant data and needs the admin role on every tenant when authentication is enabled
+	statusSuffix = ".status"
+
+	defaultTimeout = 10 * time.Second
+
+	// request headers
+	headerAuthorization = "Authorization"
+	headerTenant        = "Tenant"
+	// headerRequestID is recorded in the audit trail, a random one is used when it is missing
+	headerRequestID = "Request-Id"
+
+	// tenant of the requests without Tenant header when authentication is disabled
+	defaultTenant = "test"
 )
 
+// operations maps each message type to the permission it needs
+var operations = map[int]auth.Operation{
+	messageGet:      auth.OpRead,
+	messageGetPaged: auth.OpRead,
+	messageCreate:   auth.OpWrite,
+	messageDelete:   auth.OpDelete,
+	messageQuota:    auth.OpRead,
+	messageAudit:    auth.OpAdmin,
+	messageHistory:  auth.OpRead,
+	messageDiff:     auth.OpRead,
+	messageRestore:  auth.OpWrite,
+	messageDeleted:  auth.OpRead,
+	messageUpdate:   auth.OpWrite,
+	messageLabel:    auth.OpWrite,
+	messageGroups:   auth.OpRead,
+	// the site hierarchy is shared by every router of the tenant
+	messageGroupSave:   auth.OpAdmin,
+	messageGroupDelete: auth.OpAdmin,
+	messageAssign:      auth.OpWrite,
+	messageTransition:  auth.OpWrite,
+}
+
 type message struct {
 	Mtype int    `json:"mtype"`
 	Data  []byte `json:"Data"`
+	// Version of the protocol, the Api-Version header is used when it is not set
+	Version int `json:"version,omitempty"`
 }
 
 type IService interface {
-	AddRouters(ctx context.Context, routers []domain.Router, tenant string) *[]domain.Router
-	GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int)
-	GetRouter(ctx context.Context, router domain.Router, tenant string) *domain.Router
-	DeleteRouters(ctx context.Context, routers []domain.Router, tenant string)
+	AddRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error)
+	GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error)
+	GetRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) error
+	UpdateRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error)
+	TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (*domain.Router, error)
+	GetGroups(ctx context.Context, root string, tenant string) ([]domain.GroupCount, error)
+	SaveGroup(ctx context.Context, g domain.Group, tenant string) error
+	DeleteGroup(ctx context.Context, id string, tenant string) error
+	AssignRouters(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error)
+	GetQuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error)
+	GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error)
+	GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) ([]domain.RouterVersion, error)
+	DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (*domain.RouterDiff, error)
+	RestoreRouters(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error)
+	GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error)
 }
 
 type ApiServer struct {
@@ -38,103 +111,357 @@ type ApiServer struct {
 	urlBroker string
 	subject   string
 	con       *nats.Conn
-	wg        *sync.WaitGroup
-	next      IService
+	svc       micro.Service
+	errs      errorStats
+	// aux are the subscriptions outside of the micro service (status)
+	aux      []*nats.Subscription
+	inflight sync.WaitGroup
+	statusMu sync.RWMutex
+	status   map[string]func() interface{}
+	next     IService
+	timeout  atomic.Int64
+	state    atomic.Value
+	verifier *auth.Verifier
+	routing  string
+	// keys stores the replies of the requests sent with an Idempotency-Key
+	keys       IdempotencyStore
+	keysWindow time.Duration
+	name       string
+	version    string
 }
 
-func NewApiService(svc interface{}, u string, s string, wg *sync.WaitGroup) *ApiServer {
+// NewApiService connects to the broker, with o.RetryOnFailedConnect the connection is
+// established in the background when the broker is not reachable yet.
+func NewApiService(svc interface{}, u string, s string, o NatsOptions) (*ApiServer, error) {
+	var err error
 
-	c, err := connect(u)
-	if err != nil {
-		fmt.Println("Broker connection error: ", err)
-	}
-	return &ApiServer{
+	a := &ApiServer{
 		ctx:       context.Background(),
 		urlBroker: u,
-		con:       c,
 		subject:   s,
-		wg:        wg,
 		next:      svc.(IService),
 	}
+	a.SetTimeout(defaultTimeout)
+	a.con, err = a.connect(u, o)
+	if err != nil {
+		return nil, fmt.Errorf("broker connection error: %w", err)
+	}
+	return a, nil
 }
 
-func connect(u string) (*nats.Conn, error) {
-	nc, err := nats.Connect(u)
-	return nc, err
+// SetTimeout changes the deadline given to each request, it is safe to call while serving
+func (a *ApiServer) SetTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultTimeout
+	}
+	a.timeout.Store(int64(d))
 }
 
-func (a *ApiServer) AddRouters(routers []domain.Router, tenant string) *[]domain.Router {
-	return a.next.AddRouters(a.ctx, routers, tenant)
+// AddStatus adds a section to the status reply, fn is called on each status request
+func (a *ApiServer) AddStatus(name string, fn func() interface{}) {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	if a.status == nil {
+		a.status = make(map[string]func() interface{})
+	}
+	a.status[name] = fn
 }
 
-func (a *ApiServer) GetRouters(routers domain.Router, tenant string) *domain.Router {
-	return a.next.GetRouter(a.ctx, routers, tenant)
+// Status returns every status section, the broker state is always present
+func (a *ApiServer) Status() map[string]interface{} {
+	a.statusMu.RLock()
+	defer a.statusMu.RUnlock()
+	res := map[string]interface{}{
+		"broker": a.State(),
+	}
+	for k, fn := range a.status {
+		res[k] = fn()
+	}
+	return res
 }
 
-func (a *ApiServer) GetPagedRouters(page domain.Pagination, tenant string) (*[]domain.Router, int) {
-	return a.next.GetPagedRouters(a.ctx, page, tenant)
+func (a *ApiServer) statusCB(msg *nats.Msg) {
+	if a.verifier != nil {
+		id, err := a.verifier.Verify(msg.Header.Get(headerAuthorization))
+		if err == nil {
+			err = id.Authorize(auth.AnyTenant, auth.OpAdmin)
+		}
+		if err != nil {
+			a.respondError(msg, err)
+			return
+		}
+	}
+	b, err := json.Marshal(a.Status())
+	if err != nil {
+		a.respondError(msg, err)
+		return
+	}
+	err = msg.Respond(b)
+	if err != nil {
+		fmt.Println("error replying: ", err)
+	}
 }
 
-func (a *ApiServer) DeleteRouters(routers []domain.Router, tenant string) {
-	a.next.DeleteRouters(a.ctx, routers, tenant)
+// SetVerifier enables the authentication of the callers, nil disables it
+func (a *ApiServer) SetVerifier(v *auth.Verifier) {
+	a.verifier = v
 }
 
-func (a *ApiServer) Start() {
-	fmt.Println(" subscribing to: ", a.subject)
+// authorize returns the tenant of the request and a context carrying the caller identity,
+// without tenant the Tenant header or the only tenant of the token is used
+func (a *ApiServer) authorize(ctx context.Context, h nats.Header, tenant string, mtype int) (context.Context, string, error) {
+	var (
+		id  auth.Identity
+		err error
+	)
 
-	_, err := a.con.QueueSubscribe(a.subject, queue, func(msg *nats.Msg) {
-		var (
-			err error
-			b   []byte
-			m   message
-		)
+	op, ok := operations[mtype]
+	if !ok {
+		return ctx, "", badRequest("unknown message type %d", mtype)
+	}
+	if tenant == "" && h != nil {
+		tenant = h.Get(headerTenant)
+	}
 
-		err = json.Unmarshal(msg.Data, &m)
-		if err != nil {
-			fmt.Println("error unmarshalling: ", err)
-			//return
+	if a.verifier == nil {
+		if tenant == "" {
+			tenant = defaultTenant
 		}
-		// fmt.Printf("Receive message type: %d message lenght: %d \n", m.Mtype, len(m.Data))
-		// Call the right action here
+		return auth.WithIdentity(ctx, auth.Anonymous), tenant, nil
+	}
 
-		switch m.Mtype {
-		case messageCreate:
-			b, err = a.createCB(m.Data, "test")
-		case messageGet:
-			b, err = a.getCB(m.Data, "test")
-		case messageGetPaged:
-			b, err = a.getPagedCB(m.Data, "test")
-		case messageDelete:
-			b, err = a.deleteCB(m.Data, "test")
+	if h == nil {
+		return ctx, "", fmt.Errorf("%w: missing %s header", auth.ErrUnauthenticated, headerAuthorization)
+	}
+	id, err = a.verifier.Verify(h.Get(headerAuthorization))
+	if err != nil {
+		return ctx, "", err
+	}
+	if tenant == "" {
+		tenant, ok = id.Tenant()
+		if !ok {
+			return ctx, "", badRequest("%s header is required", headerTenant)
 		}
+	}
+	err = id.Authorize(tenant, op)
+	if err != nil {
+		return ctx, "", err
+	}
+	return auth.WithIdentity(ctx, id), tenant, nil
+}
 
-		err = msg.Respond(b)
-		a.con.Flush()
+func (a *ApiServer) AddRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error) {
+	return a.next.AddRouters(ctx, routers, tenant)
+}
+
+func (a *ApiServer) GetRouters(ctx context.Context, routers domain.Router, tenant string) (*domain.Router, error) {
+	return a.next.GetRouter(ctx, routers, tenant)
+}
+
+func (a *ApiServer) GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error) {
+	return a.next.GetPagedRouters(ctx, page, tenant)
+}
+
+func (a *ApiServer) DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) error {
+	return a.next.DeleteRouters(ctx, routers, tenant)
+}
+
+// Start registers the service endpoints, requests are served until Shutdown is called
+func (a *ApiServer) Start() error {
+	fmt.Println(" subscribing to: ", a.subject)
+
+	// the subscriptions are sent again by the client after a reconnection
+	err := a.register()
+	if err != nil {
+		return err
+	}
+
+	sub, err := a.con.Subscribe(a.subject+statusSuffix, a.statusCB)
+	if err != nil {
+		return fmt.Errorf("error while subscribing to subject %s: %w", a.subject+statusSuffix, err)
+	}
+	a.aux = append(a.aux, sub)
+	return nil
+}
+
+// legacyCB serves the envelope subject, the operation is given by the message type
+func (a *ApiServer) legacyCB(req micro.Request) {
+	var m message
+
+	err := json.Unmarshal(req.Data(), &m)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		a.respondRequestError(req, legacyEndpoint, badRequest("invalid message: %v", err))
+		return
+	}
+	a.serve(req, legacyEndpoint, m.Mtype, "", m.Version, m.Data)
+}
+
+// serve authorizes and runs one operation, endpoint is only used for the stats. tenant is
+// given by the subject, the legacy subject passes an empty tenant to use the Tenant header.
+// version is the envelope version, 0 reads the Api-Version header.
+func (a *ApiServer) serve(req micro.Request, endpoint string, mtype int, tenant string, version int, data []byte) {
+	var (
+		err error
+		b   []byte
+	)
+	a.inflight.Add(1)
+	defer a.inflight.Done()
+
+	h := nats.Header(req.Headers())
+	version, err = protocolVersion(h, version)
+	if err != nil {
+		a.respondRequestError(req, endpoint, err)
+		return
+	}
+
+	if mtype == messageDescribe {
+		b, err = json.Marshal(a.describe())
+		if err != nil {
+			a.respondRequestError(req, endpoint, err)
+			return
+		}
+		a.respond(req, b, version, false)
+		return
+	}
 
-	})
+	ctx, cancel := context.WithTimeout(a.ctx, time.Duration(a.timeout.Load()))
+	defer cancel()
 
-	//TODO manage reconnection strategy
+	ctx, tenant, err = a.authorize(ctx, h, tenant, mtype)
+	if err == nil && !validTenant(tenant) {
+		err = badRequest("invalid tenant %q", tenant)
+	}
+	if err != nil {
+		a.respondRequestError(req, endpoint, err)
+		return
+	}
+	ctx = domain.WithActor(ctx, actor(ctx, h))
+	err = validateRequest(mtype, data)
 	if err != nil {
-		fmt.Println("error while subscribing to subject", err)
+		a.respondRequestError(req, endpoint, err)
 		return
 	}
 
-	for {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT)
-		signal.Notify(c, syscall.SIGTERM)
+	var (
+		rec     domain.IdempotencyRecord
+		claimed bool
+	)
+	if key := h.Get(headerIdempotencyKey); key != "" && a.keys != nil && idempotent[mtype] {
+		rec, claimed, err = a.claim(ctx, tenant, key, mtype, version, data)
+		if err != nil {
+			a.respondRequestError(req, endpoint, err)
+			return
+		}
+		if !claimed {
+			a.respond(req, rec.Response, rec.Version, true)
+			return
+		}
+	}
+
+	switch mtype {
+	case messageCreate:
+		b, err = a.createCB(ctx, data, tenant, version)
+	case messageGet:
+		b, err = a.getCB(ctx, data, tenant, version)
+	case messageGetPaged:
+		b, err = a.getPagedCB(ctx, data, tenant, version)
+	case messageDelete:
+		b, err = a.deleteCB(ctx, data, tenant, version)
+	case messageUpdate:
+		b, err = a.updateCB(ctx, data, tenant, version)
+	case messageLabel:
+		b, err = a.labelCB(ctx, data, tenant)
+	case messageTransition:
+		b, err = a.transitionCB(ctx, data, tenant)
+	case messageGroups:
+		b, err = a.groupsCB(ctx, data, tenant)
+	case messageGroupSave:
+		b, err = a.groupSaveCB(ctx, data, tenant)
+	case messageGroupDelete:
+		b, err = a.groupDeleteCB(ctx, data, tenant)
+	case messageAssign:
+		b, err = a.assignCB(ctx, data, tenant)
+	case messageQuota:
+		b, err = a.quotaCB(ctx, tenant)
+	case messageAudit:
+		b, err = a.auditCB(ctx, data, tenant)
+	case messageHistory:
+		b, err = a.historyCB(ctx, data, tenant)
+	case messageDiff:
+		b, err = a.diffCB(ctx, data, tenant)
+	case messageRestore:
+		b, err = a.restoreCB(ctx, data, tenant)
+	case messageDeleted:
+		b, err = a.deletedCB(ctx, data, tenant)
+	}
+	if claimed {
+		a.complete(rec, b, err != nil)
+	}
+	if err != nil {
+		a.respondRequestError(req, endpoint, err)
+		return
+	}
+	a.respond(req, b, version, false)
+}
 
-		<-c
-		fmt.Println("Shutting down connection...")
+// respond sends the reply, the Api-Version header tells the caller how to decode it
+func (a *ApiServer) respond(req micro.Request, b []byte, version int, replayed bool) {
+	h := micro.Headers{headerVersion: []string{strconv.Itoa(version)}}
+	if replayed {
+		h[headerReplayed] = []string{"true"}
+	}
+	err := req.Respond(b, micro.WithHeaders(h))
+	if err != nil {
+		// disconnected with reconnection buffering disabled or buffer full
+		fmt.Println("error replying: ", err)
+		return
+	}
+	if a.con.IsConnected() {
 		a.con.Flush()
+	}
+}
+
+// Shutdown stops accepting requests, waits for the pending and in-flight ones then closes the connection
+func (a *ApiServer) Shutdown(ctx context.Context) error {
+	for _, sub := range a.aux {
+		_ = sub.Unsubscribe()
+	}
+	if a.svc != nil {
+		// drains the endpoint subscriptions
+		err := a.svc.Stop()
+		if err != nil {
+			a.con.Close()
+			return err
+		}
+	}
+	// the connection is closed once every pending message has been delivered and the
+	// replies flushed
+	err := a.con.Drain()
+	if err != nil {
 		a.con.Close()
-		a.wg.Wait()
-		fmt.Println("DB closed, Connection tear-off -> exiting now!")
-		return
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for !a.con.IsClosed() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		a.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		a.con.Close()
+		return fmt.Errorf("requests still in flight: %w", ctx.Err())
 	}
 }
 
-func (a *ApiServer) createCB(in []byte, tenant string) ([]byte, error) {
+func (a *ApiServer) createCB(ctx context.Context, in []byte, tenant string, version int) ([]byte, error) {
 	var (
 		routers []domain.Router
 		ret     *[]domain.Router
@@ -144,9 +471,22 @@ func (a *ApiServer) createCB(in []byte, tenant string) ([]byte, error) {
 	err = json.Unmarshal(in, &routers)
 	if err != nil {
 		fmt.Println("error unmarshalling: ", err)
+		return out, badRequest("%v", err)
+	}
+	ret, err = a.AddRouters(ctx, routers, tenant)
+	if err != nil {
 		return out, err
 	}
-	ret = a.AddRouters(routers, tenant)
+	a.publishEvent(domain.EventCreated, created(routers, ret), tenant)
+	if version >= ProtocolV2 {
+		var response CreateResponse
+		response.Created = nonNil(created(routers, ret))
+		if ret != nil {
+			response.Duplicates = *ret
+		}
+		response.Duplicates = nonNil(response.Duplicates)
+		return json.Marshal(response)
+	}
 	if ret != nil {
 		out, err = json.Marshal(ret)
 		if err != nil {
@@ -157,7 +497,7 @@ func (a *ApiServer) createCB(in []byte, tenant string) ([]byte, error) {
 	return []byte("sucess!"), nil
 }
 
-func (a *ApiServer) getCB(in []byte, tenant string) ([]byte, error) {
+func (a *ApiServer) getCB(ctx context.Context, in []byte, tenant string, version int) ([]byte, error) {
 	var (
 		router domain.Router
 		ret    *domain.Router
@@ -167,10 +507,16 @@ func (a *ApiServer) getCB(in []byte, tenant string) ([]byte, error) {
 	err = json.Unmarshal(in, &router)
 	if err != nil {
 		fmt.Println("error unmarshalling: ", err)
-		return out, err
+		return out, badRequest("%v", err)
 	}
 
-	ret = a.GetRouters(router, tenant)
+	ret, err = a.GetRouters(ctx, router, tenant)
+	if err != nil {
+		return out, err
+	}
+	if ret == nil && version >= ProtocolV2 {
+		return nil, notFound("router %s not found", router.RouterSerial)
+	}
 
 	if ret != nil {
 		out, err = json.Marshal(ret)
@@ -183,23 +529,30 @@ func (a *ApiServer) getCB(in []byte, tenant string) ([]byte, error) {
 	return []byte(""), nil
 }
 
-func (a *ApiServer) getPagedCB(in []byte, tenant string) ([]byte, error) {
+func (a *ApiServer) getPagedCB(ctx context.Context, in []byte, tenant string, version int) ([]byte, error) {
 	var (
 		page     domain.Pagination
 		out      []byte
 		err      error
-		response struct {
-			Last    int              `json:"last"`
-			Routers *[]domain.Router `json:"routers"`
-		}
+		response ListResponseV1
 	)
 	err = json.Unmarshal(in, &page)
 	if err != nil {
 		fmt.Println("error unmarshalling: ", err)
-		return out, err
+		return out, badRequest("%v", err)
 	}
 
-	response.Routers, response.Last = a.GetPagedRouters(page, tenant)
+	response.Routers, response.Last, err = a.GetPagedRouters(ctx, page, tenant)
+	if err != nil {
+		return out, err
+	}
+	if version >= ProtocolV2 {
+		var routers []domain.Router
+		if response.Routers != nil {
+			routers = *response.Routers
+		}
+		return json.Marshal(ListResponse{Routers: nonNil(routers), Page: page.Page, Last: response.Last})
+	}
 
 	out, err = json.Marshal(response)
 	if err != nil {
@@ -211,7 +564,7 @@ func (a *ApiServer) getPagedCB(in []byte, tenant string) ([]byte, error) {
 
 }
 
-func (a *ApiServer) deleteCB(in []byte, tenant string) ([]byte, error) {
+func (a *ApiServer) deleteCB(ctx context.Context, in []byte, tenant string, version int) ([]byte, error) {
 	var (
 		routers []domain.Router
 		out     []byte
@@ -220,9 +573,354 @@ func (a *ApiServer) deleteCB(in []byte, tenant string) ([]byte, error) {
 	err = json.Unmarshal(in, &routers)
 	if err != nil {
 		fmt.Println("error unmarshalling: ", err)
+		return out, badRequest("%v", err)
+	}
+	if version >= ProtocolV2 {
+		for _, r := range routers {
+			if r.Revision == 0 {
+				return out, badRequest("revision of router %s is required", r.RouterSerial)
+			}
+		}
+	}
+	err = a.DeleteRouters(ctx, routers, tenant)
+	if err != nil {
 		return out, err
 	}
-	a.DeleteRouters(routers, tenant)
+	a.publishEvent(domain.EventDeleted, routers, tenant)
+	if version >= ProtocolV2 {
+		return json.Marshal(StatusResponse{Status: "ok"})
+	}
 
 	return []byte("sucess!"), nil
 }
+
+// updateCB replaces a router and returns it with its new revision
+func (a *ApiServer) updateCB(ctx context.Context, in []byte, tenant string, version int) ([]byte, error) {
+	var router domain.Router
+
+	err := json.Unmarshal(in, &router)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	if version >= ProtocolV2 && router.Revision == 0 {
+		return nil, badRequest("revision of router %s is required", router.RouterSerial)
+	}
+	updated, err := a.next.UpdateRouter(ctx, router, tenant)
+	if err != nil {
+		return nil, err
+	}
+	a.publishEvent(domain.EventUpdated, []domain.Router{*updated}, tenant)
+	return json.Marshal(updated)
+}
+
+// labelCB sets and removes labels of routers, the unknown serials are reported as missing
+func (a *ApiServer) labelCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var req LabelRequest
+
+	err := json.Unmarshal(in, &req)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	routers, err := a.next.LabelRouters(ctx, req.RouterSerials, req.LabelChange, tenant)
+	if err != nil {
+		return nil, err
+	}
+	a.publishEvent(domain.EventUpdated, routers, tenant)
+	return json.Marshal(LabelResponse{Routers: nonNil(routers), Missing: missingSerials(req.RouterSerials, routers)})
+}
+
+// transitionCB moves a router to another lifecycle state and returns it with its new revision
+func (a *ApiServer) transitionCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var t domain.Transition
+
+	err := json.Unmarshal(in, &t)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	updated, err := a.next.TransitionRouter(ctx, t, tenant)
+	if err != nil {
+		return nil, err
+	}
+	a.publishEvent(domain.EventUpdated, []domain.Router{*updated}, tenant)
+	return json.Marshal(updated)
+}
+
+// groupsCB returns the site hierarchy, or the sub-tree of the requested root, with the router counts
+func (a *ApiServer) groupsCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var req GroupsRequest
+
+	err := json.Unmarshal(in, &req)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	groups, err := a.next.GetGroups(ctx, req.Root, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if groups == nil {
+		groups = []domain.GroupCount{}
+	}
+	return json.Marshal(GroupsResponse{Groups: groups})
+}
+
+// groupSaveCB creates or replaces a group, changing its parent moves the whole sub-tree
+func (a *ApiServer) groupSaveCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var g domain.Group
+
+	err := json.Unmarshal(in, &g)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	err = a.next.SaveGroup(ctx, g, tenant)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(g)
+}
+
+// groupDeleteCB removes an empty group
+func (a *ApiServer) groupDeleteCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var g domain.Group
+
+	err := json.Unmarshal(in, &g)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	err = a.next.DeleteGroup(ctx, g.ID, tenant)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(StatusResponse{Status: "ok"})
+}
+
+// assignCB moves routers to a group, the unknown serials are reported as missing
+func (a *ApiServer) assignCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var req AssignRequest
+
+	err := json.Unmarshal(in, &req)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	routers, err := a.next.AssignRouters(ctx, req.RouterSerials, req.Group, tenant)
+	if err != nil {
+		return nil, err
+	}
+	a.publishEvent(domain.EventUpdated, routers, tenant)
+	return json.Marshal(AssignResponse{Routers: nonNil(routers), Missing: missingSerials(req.RouterSerials, routers)})
+}
+
+// quotaCB returns the usage of the quotas of the tenant, the request has no payload
+func (a *ApiServer) quotaCB(ctx context.Context, tenant string) ([]byte, error) {
+	usage, err := a.next.GetQuotaUsage(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if usage == nil {
+		usage = []domain.QuotaUsage{}
+	}
+	return json.Marshal(QuotaResponse{Quotas: usage})
+}
+
+// auditCB returns a page of the audit trail of the tenant
+func (a *ApiServer) auditCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var q domain.AuditQuery
+
+	err := json.Unmarshal(in, &q)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	entries, last, err := a.next.GetAuditTrail(ctx, q, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []domain.AuditEntry{}
+	}
+	return json.Marshal(AuditResponse{Entries: entries, Page: q.Page, Last: last})
+}
+
+// historyCB returns the versions of a router, or the one valid at the requested time
+func (a *ApiServer) historyCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var q domain.HistoryQuery
+
+	err := json.Unmarshal(in, &q)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	versions, err := a.next.GetRouterHistory(ctx, q, tenant)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(HistoryResponse{RouterSerial: q.RouterSerial, Versions: versions})
+}
+
+// diffCB compares two versions of a router
+func (a *ApiServer) diffCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var q domain.DiffQuery
+
+	err := json.Unmarshal(in, &q)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	d, err := a.next.DiffRouter(ctx, q, tenant)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
+
+// restoreCB brings back deleted routers, the routers without tombstone are reported as missing
+func (a *ApiServer) restoreCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var routers []domain.Router
+
+	err := json.Unmarshal(in, &routers)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	restored, err := a.next.RestoreRouters(ctx, routers, tenant)
+	if err != nil {
+		return nil, err
+	}
+	a.publishEvent(domain.EventRestored, restored, tenant)
+	return json.Marshal(RestoreResponse{Restored: nonNil(restored), Missing: nonNil(missing(routers, restored))})
+}
+
+// deletedCB returns a page of the deleted routers of the tenant
+func (a *ApiServer) deletedCB(ctx context.Context, in []byte, tenant string) ([]byte, error) {
+	var page domain.Pagination
+
+	err := json.Unmarshal(in, &page)
+	if err != nil {
+		fmt.Println("error unmarshalling: ", err)
+		return nil, badRequest("%v", err)
+	}
+	routers, last, err := a.next.GetDeletedRouters(ctx, page, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if routers == nil {
+		routers = []domain.DeletedRouter{}
+	}
+	return json.Marshal(DeletedResponse{Routers: routers, Page: page.Page, Last: last})
+}
+
+// actor returns who sends the request, for the audit trail
+func actor(ctx context.Context, h nats.Header) domain.Actor {
+	id := h.Get(headerRequestID)
+	if id == "" {
+		id = nuid.Next()
+	}
+	return domain.Actor{Name: auth.FromContext(ctx).Subject, RequestID: id}
+}
+
+// PublishQuotaEvent notify watchers that a tenant or account quota crossed a threshold
+func (a *ApiServer) PublishQuotaEvent(ev domain.QuotaEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Println("err marshalling event: ", err)
+		return
+	}
+	err = a.con.Publish(a.subject+"."+ev.Tenant+quotaEventSuffix, b)
+	if err != nil {
+		fmt.Println("error publishing event: ", err)
+	}
+}
+
+// publishEvent notify watchers (e.g. routerctl watch) about a change in the inventory
+func (a *ApiServer) publishEvent(t string, routers []domain.Router, tenant string) {
+	var (
+		ev  domain.RouterEvent
+		b   []byte
+		err error
+	)
+	if len(routers) == 0 {
+		return
+	}
+	ev = domain.RouterEvent{
+		Type:    t,
+		Tenant:  tenant,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Routers: routers,
+	}
+	b, err = json.Marshal(ev)
+	if err != nil {
+		fmt.Println("err marshalling event: ", err)
+		return
+	}
+	err = a.con.Publish(a.subject+"."+tenant+eventSuffix, b)
+	if err != nil {
+		fmt.Println("error publishing event: ", err)
+	}
+}
+
+// nonNil makes empty lists encode as [] instead of null
+func nonNil(r []domain.Router) []domain.Router {
+	if r == nil {
+		return []domain.Router{}
+	}
+	return r
+}
+
+// missingSerials returns the serials of the request that are not in done, never nil
+func missingSerials(req []string, done []domain.Router) []string {
+	res := []string{}
+
+	seen := make(map[string]bool, len(done))
+	for _, v := range done {
+		seen[v.RouterSerial] = true
+	}
+	for _, s := range req {
+		if !seen[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// missing returns the routers of the request that are not in done
+func missing(req []domain.Router, done []domain.Router) []domain.Router {
+	var res []domain.Router
+
+	seen := make(map[string]bool, len(done))
+	for _, v := range done {
+		seen[v.RouterSerial] = true
+	}
+	for _, v := range req {
+		if !seen[v.RouterSerial] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// created return the routers of the request that were not reported as duplicates
+func created(req []domain.Router, dup *[]domain.Router) []domain.Router {
+	var (
+		res  []domain.Router
+		seen map[string]bool
+	)
+	if dup == nil {
+		return req
+	}
+	seen = make(map[string]bool, len(*dup))
+	for _, v := range *dup {
+		seen[v.RouterSerial] = true
+	}
+	for _, v := range req {
+		if !seen[v.RouterSerial] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
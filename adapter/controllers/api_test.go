@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/simdb"
+	"github.com/Go-routine-4995/routermgt/auth"
+	"github.com/Go-routine-4995/routermgt/service"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"net"
+	"testing"
+	"time"
+)
+
+const testSubject = "ns.oss.router"
+
+// broker starts an embedded NATS server, port 0 picks a free port
+func broker(t *testing.T, port int) *server.Server {
+	t.Helper()
+	if port == 0 {
+		port = server.RANDOM_PORT
+	}
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: port, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("broker not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// port returns the port of a broker, to start it again on the same address
+func port(s *server.Server) int {
+	return s.Addr().(*net.TCPAddr).Port
+}
+
+// startAPI serves a simdb repository on testSubject, setup is called before Start
+func startAPI(t *testing.T, s *server.Server, setup func(a *ApiServer, db *simdb.Simdb)) (*ApiServer, *simdb.Simdb) {
+	t.Helper()
+	db := simdb.NewSimDB()
+	a, err := NewApiService(service.NewService(db), s.ClientURL(), testSubject, NatsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(a, db)
+	}
+	if err = a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the subscriptions are known to the broker once flushed
+	if err = a.con.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = a.Shutdown(ctx)
+	})
+	return a, db
+}
+
+// client connects a caller to the broker
+func client(t *testing.T, s *server.Server) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// request sends data with the headers given as name/value pairs
+func request(t *testing.T, nc *nats.Conn, subject string, data string, headers ...string) *nats.Msg {
+	t.Helper()
+	m := nats.NewMsg(subject)
+	m.Data = []byte(data)
+	for i := 0; i+1 < len(headers); i += 2 {
+		m.Header.Set(headers[i], headers[i+1])
+	}
+	rep, err := nc.RequestMsg(m, 5*time.Second)
+	if err != nil {
+		t.Fatalf("%s: %v", subject, err)
+	}
+	return rep
+}
+
+// waitFor polls cond until it is true or a few seconds elapsed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// token returns a HS256 token of subject with the roles given per tenant
+func token(t *testing.T, secret string, subject string, roles map[string]string) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		enc(map[string]interface{}{"sub": subject, "exp": time.Now().Add(time.Hour).Unix(), "roles": roles})
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return "Bearer " + signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthorize(t *testing.T) {
+	const secret = "secret"
+	v, err := auth.NewVerifier(secret, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := token(t, secret, "alice", map[string]string{"acme": "operator"})
+	viewer := token(t, secret, "bob", map[string]string{"acme": "viewer", "other": "viewer"})
+
+	tests := []struct {
+		name     string
+		verifier *auth.Verifier
+		header   nats.Header
+		tenant   string
+		mtype    int
+		want     string
+		subject  string
+		err      error
+	}{
+		{"anonymous default tenant", nil, nil, "", messageGet, defaultTenant, auth.Anonymous.Subject, nil},
+		{"anonymous tenant header", nil, nats.Header{headerTenant: {"acme"}}, "", messageCreate, "acme", auth.Anonymous.Subject, nil},
+		{"subject tenant before header", nil, nats.Header{headerTenant: {"acme"}}, "other", messageGet, "other", auth.Anonymous.Subject, nil},
+		{"unknown message type", nil, nil, "acme", 99, "", "", nil},
+		{"missing headers", v, nil, "acme", messageGet, "", "", auth.ErrUnauthenticated},
+		{"missing token", v, nats.Header{}, "acme", messageGet, "", "", auth.ErrUnauthenticated},
+		{"invalid token", v, nats.Header{headerAuthorization: {token(t, "other", "eve", map[string]string{"acme": "admin"})}}, "acme", messageGet, "", "", auth.ErrUnauthenticated},
+		{"only tenant of the token", v, nats.Header{headerAuthorization: {operator}}, "", messageCreate, "acme", "alice", nil},
+		{"several tenants need a header", v, nats.Header{headerAuthorization: {viewer}}, "", messageGet, "", "", nil},
+		{"tenant header", v, nats.Header{headerAuthorization: {viewer}, headerTenant: {"other"}}, "", messageGet, "other", "bob", nil},
+		{"role too low", v, nats.Header{headerAuthorization: {operator}}, "acme", messageDelete, "", "", auth.ErrForbidden},
+		{"other tenant", v, nats.Header{headerAuthorization: {operator}}, "other", messageGet, "", "", auth.ErrForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &ApiServer{verifier: tt.verifier}
+			ctx, tenant, err := a.authorize(context.Background(), tt.header, tt.tenant, tt.mtype)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("request accepted for tenant %q", tenant)
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Errorf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tenant != tt.want {
+				t.Errorf("tenant %q, want %q", tenant, tt.want)
+			}
+			if id := auth.FromContext(ctx); id.Subject != tt.subject {
+				t.Errorf("caller %q, want %q", id.Subject, tt.subject)
+			}
+		})
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	tests := []struct {
+		subject string
+		tenant  string
+	}{
+		{testSubject + ".acme.get", "acme"},
+		{"routers.acme.list", "acme"},
+		{"acme.get", "acme"},
+		{"get", ""},
+	}
+	for _, tt := range tests {
+		if got := tenantOf(tt.subject); got != tt.tenant {
+			t.Errorf("tenantOf(%q) = %q, want %q", tt.subject, got, tt.tenant)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	const secret = "secret"
+	s := broker(t, 0)
+	startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+		a.AddStatus("repository", func() interface{} { return map[string]int{"total-conns": 3} })
+		v, err := auth.NewVerifier(secret, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.SetVerifier(v)
+	})
+	nc := client(t, s)
+
+	tests := []struct {
+		name  string
+		roles map[string]string
+		code  string
+	}{
+		{"admin of every tenant", map[string]string{"*": "admin"}, ""},
+		{"admin of one tenant", map[string]string{"acme": "admin"}, "403"},
+		{"no token", nil, "401"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h []string
+			if tt.roles != nil {
+				h = []string{headerAuthorization, token(t, secret, "alice", tt.roles)}
+			}
+			rep := request(t, nc, testSubject+statusSuffix, "", h...)
+			if code := rep.Header.Get(headerErrorCode); code != tt.code {
+				t.Fatalf("error code %q, want %q: %s", code, tt.code, rep.Data)
+			}
+			if tt.code != "" {
+				return
+			}
+			var st struct {
+				Broker     string         `json:"broker"`
+				Repository map[string]int `json:"repository"`
+			}
+			if err := json.Unmarshal(rep.Data, &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Broker != StateConnected || st.Repository["total-conns"] != 3 {
+				t.Errorf("unexpected status %s", rep.Data)
+			}
+		})
+	}
+}
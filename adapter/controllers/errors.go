@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/auth"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/Go-routine-4995/routermgt/ratelimit"
+	"github.com/Go-routine-4995/routermgt/schema"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"math"
+	"strconv"
+	"time"
+)
+
+// error replies carry the same headers as the nats micro framework so that clients can
+// detect an error without decoding the body
+const (
+	headerError     = "Nats-Service-Error"
+	headerErrorCode = "Nats-Service-Error-Code"
+	// headerRetryAfter is the number of seconds to wait before retrying a rate limited request
+	headerRetryAfter = "Retry-After"
+
+	codeBadRequest      = 400
+	codeUnauthorized    = 401
+	codeForbidden       = 403
+	codeNotFound        = 404
+	codeConflict        = 409
+	codePayloadTooLarge = 413
+	codeUnprocessable   = 422
+	codeTooManyRequests = 429
+	codeInternal        = 500
+)
+
+// ApiError is the body of an error reply
+type ApiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"error"`
+	// Details locate the invalid fields of a rejected payload
+	Details schema.Errors `json:"details,omitempty"`
+	// RetryAfter in seconds of a rate limited request
+	RetryAfter float64 `json:"retry-after,omitempty"`
+	// Revision is the current revision of the router after a conflict
+	Revision int `json:"revision,omitempty"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+func badRequest(format string, a ...interface{}) *ApiError {
+	return &ApiError{Code: codeBadRequest, Message: fmt.Sprintf(format, a...)}
+}
+
+func notFound(format string, a ...interface{}) *ApiError {
+	return &ApiError{Code: codeNotFound, Message: fmt.Sprintf(format, a...)}
+}
+
+// toApiError maps an error to its reply code
+func toApiError(err error) *ApiError {
+	var (
+		ae *ApiError
+		re *ratelimit.Error
+		ce *domain.ConflictError
+	)
+
+	switch {
+	case errors.As(err, &ae):
+		return ae
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return &ApiError{Code: codeUnauthorized, Message: err.Error()}
+	case errors.Is(err, auth.ErrForbidden):
+		return &ApiError{Code: codeForbidden, Message: err.Error()}
+	case errors.As(err, &re):
+		return &ApiError{Code: codeTooManyRequests, Message: err.Error(), RetryAfter: re.RetryAfter.Round(time.Millisecond).Seconds()}
+	case errors.As(err, &ce):
+		return &ApiError{Code: codeConflict, Message: err.Error(), Revision: ce.Revision}
+	case errors.Is(err, domain.ErrInvalidLabel), errors.Is(err, domain.ErrInvalidSelector), errors.Is(err, domain.ErrInvalidState):
+		return &ApiError{Code: codeBadRequest, Message: err.Error()}
+	case errors.Is(err, domain.ErrUnknownGroup), errors.Is(err, domain.ErrGroupCycle):
+		return &ApiError{Code: codeUnprocessable, Message: err.Error()}
+	case errors.Is(err, domain.ErrGroupNotEmpty), errors.Is(err, domain.ErrInvalidTransition):
+		return &ApiError{Code: codeConflict, Message: err.Error()}
+	case errors.Is(err, domain.ErrNotFound):
+		return &ApiError{Code: codeNotFound, Message: err.Error()}
+	case errors.Is(err, domain.ErrQuotaExceeded):
+		return &ApiError{Code: codeForbidden, Message: err.Error()}
+	case errors.Is(err, ratelimit.ErrBatchTooLarge):
+		return &ApiError{Code: codePayloadTooLarge, Message: err.Error()}
+	}
+	return &ApiError{Code: codeInternal, Message: err.Error()}
+}
+
+func (a *ApiServer) respondError(msg *nats.Msg, err error) {
+	ae := toApiError(err)
+	b, _ := json.Marshal(ae)
+
+	rep := nats.NewMsg(msg.Reply)
+	rep.Header.Set(headerError, ae.Message)
+	rep.Header.Set(headerErrorCode, strconv.Itoa(ae.Code))
+	if ae.RetryAfter > 0 {
+		rep.Header.Set(headerRetryAfter, retryAfter(ae.RetryAfter))
+	}
+	rep.Data = b
+
+	err = msg.RespondMsg(rep)
+	if err != nil {
+		fmt.Println("error replying: ", err)
+	}
+}
+
+// respondRequestError replies to a service request and counts the error in the endpoint stats
+func (a *ApiServer) respondRequestError(req micro.Request, endpoint string, err error) {
+	ae := toApiError(err)
+	b, _ := json.Marshal(ae)
+
+	a.errs.add(endpoint, ae)
+	var opts []micro.RespondOpt
+	if ae.RetryAfter > 0 {
+		opts = append(opts, micro.WithHeaders(micro.Headers{headerRetryAfter: []string{retryAfter(ae.RetryAfter)}}))
+	}
+	err = req.Error(strconv.Itoa(ae.Code), ae.Message, b, opts...)
+	if err != nil {
+		fmt.Println("error replying: ", err)
+	}
+}
+
+// retryAfter rounds up to whole seconds like the HTTP header
+func retryAfter(seconds float64) string {
+	return strconv.Itoa(int(math.Ceil(seconds)))
+}
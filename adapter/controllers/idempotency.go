@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"strconv"
+	"time"
+)
+
+const (
+	// headerIdempotencyKey makes a change safe to retry, the reply of the first
+	// request is replayed to the retries sent within the idempotency window
+	headerIdempotencyKey = "Idempotency-Key"
+	// headerReplayed is set on a replayed reply
+	headerReplayed = "Idempotent-Replayed"
+
+	defaultIdempotencyWindow = 24 * time.Hour
+	maxIdempotencyKey        = 255
+)
+
+// idempotent lists the operations accepting an Idempotency-Key
+var idempotent = map[int]bool{
+	messageCreate:      true,
+	messageDelete:      true,
+	messageRestore:     true,
+	messageUpdate:      true,
+	messageLabel:       true,
+	messageGroupSave:   true,
+	messageGroupDelete: true,
+	messageAssign:      true,
+	messageTransition:  true,
+}
+
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey records rec as pending unless a live record exists for its tenant and key
+	ClaimIdempotencyKey(ctx context.Context, rec domain.IdempotencyRecord) (domain.IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, rec domain.IdempotencyRecord) error
+	ReleaseIdempotencyKey(ctx context.Context, tenant string, key string) error
+}
+
+// SetIdempotency enables the Idempotency-Key header, the replies are kept for window (24h when 0)
+func (a *ApiServer) SetIdempotency(store interface{}, window time.Duration) {
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+	a.keys = store.(IdempotencyStore)
+	a.keysWindow = window
+}
+
+// claim returns the record to replay when the key was already used, claimed is true when the
+// request must run and its reply be stored with complete
+func (a *ApiServer) claim(ctx context.Context, tenant string, key string, mtype int, version int, data []byte) (rec domain.IdempotencyRecord, claimed bool, err error) {
+	if len(key) > maxIdempotencyKey {
+		return rec, false, badRequest("%s exceeds %d characters", headerIdempotencyKey, maxIdempotencyKey)
+	}
+	h := sha256.New()
+	h.Write([]byte(strconv.Itoa(mtype) + "/" + strconv.Itoa(version) + "/"))
+	h.Write(data)
+
+	now := time.Now()
+	rec = domain.IdempotencyRecord{
+		Tenant:      tenant,
+		Key:         key,
+		Operation:   string(operations[mtype]),
+		RequestHash: hex.EncodeToString(h.Sum(nil)),
+		Version:     version,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(a.keysWindow),
+	}
+	cur, claimed, err := a.keys.ClaimIdempotencyKey(ctx, rec)
+	if err != nil {
+		return rec, false, fmt.Errorf("idempotency key: %w", err)
+	}
+	if claimed {
+		return rec, true, nil
+	}
+	if cur.RequestHash != rec.RequestHash {
+		return rec, false, &ApiError{Code: codeUnprocessable, Message: fmt.Sprintf("%s %q was used with another request", headerIdempotencyKey, key)}
+	}
+	if !cur.Done {
+		return rec, false, &ApiError{Code: codeConflict, Message: fmt.Sprintf("a request with %s %q is in progress", headerIdempotencyKey, key)}
+	}
+	return cur, false, nil
+}
+
+// complete stores the reply of a claimed key, or releases the key when the request failed
+func (a *ApiServer) complete(rec domain.IdempotencyRecord, reply []byte, failed bool) {
+	var err error
+
+	// the request context may be expired, the outcome must still be recorded
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.timeout.Load()))
+	defer cancel()
+
+	if failed {
+		err = a.keys.ReleaseIdempotencyKey(ctx, rec.Tenant, rec.Key)
+	} else {
+		rec.Response = reply
+		err = a.keys.CompleteIdempotencyKey(ctx, rec)
+	}
+	if err != nil {
+		fmt.Println("error recording idempotency key: ", err)
+	}
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/simdb"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	s := broker(t, 0)
+	a, _ := startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+		a.SetIdempotency(db, time.Hour)
+	})
+	nc := client(t, s)
+	create := testSubject + ".acme.create"
+	update := testSubject + ".acme.update"
+
+	steps := []struct {
+		name     string
+		subject  string
+		data     string
+		key      string
+		version  string
+		code     string
+		replayed bool
+		reply    string
+	}{
+		{"first request", create, `[{"router-serial":"S1"}]`, "k1", "", "", false, "sucess!"},
+		// without the key the retry would report S1 as a duplicate
+		{"retry replayed", create, `[{"router-serial":"S1"}]`, "k1", "", "", true, "sucess!"},
+		{"key of another request", create, `[{"router-serial":"S2"}]`, "k1", "", "422", false, ""},
+		{"another version of the request", create, `[{"router-serial":"S1"}]`, "k1", "2", "422", false, ""},
+		{"failed request", update, `{"router-serial":"S2","operator-name":"op"}`, "k2", "", "404", false, ""},
+		{"router created meanwhile", create, `[{"router-serial":"S2"}]`, "k3", "", "", false, "sucess!"},
+		{"retry after the failure runs again", update, `{"router-serial":"S2","operator-name":"op"}`, "k2", "", "", false, ""},
+		{"key too long", create, `[{"router-serial":"S3"}]`, strings.Repeat("k", maxIdempotencyKey+1), "", "400", false, ""},
+	}
+	for _, st := range steps {
+		h := []string{headerIdempotencyKey, st.key}
+		if st.version != "" {
+			h = append(h, headerVersion, st.version)
+		}
+		rep := request(t, nc, st.subject, st.data, h...)
+		if code := rep.Header.Get(headerErrorCode); code != st.code {
+			t.Fatalf("%s: error code %q, want %q: %s", st.name, code, st.code, rep.Data)
+		}
+		if replayed := rep.Header.Get(headerReplayed) == "true"; replayed != st.replayed {
+			t.Errorf("%s: replayed %v", st.name, replayed)
+		}
+		if st.reply != "" && string(rep.Data) != st.reply {
+			t.Errorf("%s: reply %s, want %s", st.name, rep.Data, st.reply)
+		}
+	}
+
+	// a retry sent while the first request runs is rejected instead of run twice
+	data := `[{"router-serial":"S4"}]`
+	if _, claimed, err := a.claim(context.Background(), "acme", "k4", messageCreate, ProtocolV1, []byte(data)); err != nil || !claimed {
+		t.Fatalf("claim: %v %v", claimed, err)
+	}
+	rep := request(t, nc, create, data, headerIdempotencyKey, "k4")
+	if code := rep.Header.Get(headerErrorCode); code != "409" {
+		t.Errorf("pending key: error code %q: %s", code, rep.Data)
+	}
+
+	// the keys are per tenant
+	rep = request(t, nc, testSubject+".other.create", `[{"router-serial":"S1"}]`, headerIdempotencyKey, "k1")
+	if rep.Header.Get(headerErrorCode) != "" || rep.Header.Get(headerReplayed) != "" {
+		t.Errorf("key of another tenant replayed: %s", rep.Data)
+	}
+}
+
+func TestIdempotencyKeyExpired(t *testing.T) {
+	s := broker(t, 0)
+	startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+		a.SetIdempotency(db, 50*time.Millisecond)
+	})
+	nc := client(t, s)
+	create := testSubject + ".acme.create"
+
+	if rep := request(t, nc, create, `[{"router-serial":"S1"}]`, headerIdempotencyKey, "k1"); string(rep.Data) != "sucess!" {
+		t.Fatalf("create replied %s", rep.Data)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// out of the window the key is claimed again and the request runs, S1 is a duplicate
+	rep := request(t, nc, create, `[{"router-serial":"S1"}]`, headerIdempotencyKey, "k1")
+	if rep.Header.Get(headerReplayed) != "" || !strings.Contains(string(rep.Data), `"router-serial":"S1"`) {
+		t.Errorf("expired key replayed: %s", rep.Data)
+	}
+}
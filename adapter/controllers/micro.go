@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go/micro"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	serviceName        = "routermgt"
+	serviceDescription = "OSS routers inventory"
+)
+
+// routing modes, see ApiServer.SetRouting
+const (
+	// RoutingLegacy serves only the envelope subject, the operation is given by Mtype
+	RoutingLegacy = "legacy"
+	// RoutingSubject serves only <subject>.<tenant>.<operation> with plain JSON bodies
+	RoutingSubject = "subject"
+	// RoutingBoth serves both, it is the default
+	RoutingBoth = "both"
+)
+
+// endpoints served on <subject>.<tenant>.<name>, one per operation. The broker can then
+// restrict each account to its tenants and operations, e.g. allow ns.oss.router.acme.get
+var endpoints = []struct {
+	name  string
+	mtype int
+}{
+	{"get", messageGet},
+	{"list", messageGetPaged},
+	{"create", messageCreate},
+	{"delete", messageDelete},
+	{"update", messageUpdate},
+	{"label", messageLabel},
+	{"groups", messageGroups},
+	{"group-save", messageGroupSave},
+	{"group-delete", messageGroupDelete},
+	{"assign", messageAssign},
+	{"transition", messageTransition},
+	{"quota", messageQuota},
+	{"audit", messageAudit},
+	{"history", messageHistory},
+	{"diff", messageDiff},
+	{"restore", messageRestore},
+	{"deleted", messageDeleted},
+}
+
+const (
+	// legacyEndpoint is the name of the envelope subject in the INFO and STATS replies
+	legacyEndpoint = "router"
+	// describeEndpoint is served on <subject>.describe
+	describeEndpoint = "describe"
+)
+
+var semver = regexp.MustCompile(`^\d+\.\d+\.\d+`)
+
+// endpointErrors completes the micro STATS reply: with nats.go v1.28 num_errors only counts
+// replies that could not be sent, errors returned to the caller are reported in data
+type endpointErrors struct {
+	Errors    int    `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type errorStats struct {
+	mu  sync.Mutex
+	per map[string]*endpointErrors
+}
+
+func (s *errorStats) add(endpoint string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.per == nil {
+		s.per = make(map[string]*endpointErrors)
+	}
+	e, ok := s.per[endpoint]
+	if !ok {
+		e = &endpointErrors{}
+		s.per[endpoint] = e
+	}
+	e.Errors++
+	e.LastError = err.Error()
+}
+
+func (s *errorStats) get(endpoint string) endpointErrors {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.per[endpoint]; ok {
+		return *e
+	}
+	return endpointErrors{}
+}
+
+// SetInfo names the instance in the discovery replies, version must be semver
+// ("v1.2.3" is accepted), other values such as "dev" are advertised as 0.0.0-<version>
+func (a *ApiServer) SetInfo(name string, version string) {
+	version = strings.TrimPrefix(version, "v")
+	if !semver.MatchString(version) {
+		version = "0.0.0-" + version
+	}
+	a.name = name
+	a.version = version
+}
+
+// Ready returns nil when the broker is connected and the service endpoints are registered
+func (a *ApiServer) Ready(ctx context.Context) error {
+	if st := a.State(); st != StateConnected {
+		return fmt.Errorf("broker %s", st)
+	}
+	if a.svc == nil || a.svc.Stopped() {
+		return errors.New("not subscribed to " + a.subject)
+	}
+	return nil
+}
+
+// register adds the micro service, it answers PING, INFO and STATS on $SRV.<verb>[.<name>[.<id>]]
+func (a *ApiServer) register() error {
+	var err error
+
+	name := a.name
+	if name == "" {
+		name = serviceName
+	}
+	version := a.version
+	if version == "" {
+		version = "0.0.0"
+	}
+	a.svc, err = micro.AddService(a.con, micro.Config{
+		Name:        name,
+		Version:     version,
+		Description: serviceDescription,
+		StatsHandler: func(e *micro.Endpoint) any {
+			return a.errs.get(e.Name)
+		},
+		ErrorHandler: func(s micro.Service, e *micro.NATSError) {
+			fmt.Println("service error: ", e)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("service registration: %w", err)
+	}
+
+	if a.routing != RoutingSubject {
+		err = a.svc.AddEndpoint(legacyEndpoint, micro.HandlerFunc(a.legacyCB), micro.WithEndpointSubject(a.subject))
+		if err != nil {
+			return fmt.Errorf("error while subscribing to subject %s: %w", a.subject, err)
+		}
+	}
+	if a.routing == RoutingLegacy {
+		return nil
+	}
+	subject := a.subject + "." + describeEndpoint
+	err = a.svc.AddEndpoint(describeEndpoint, micro.HandlerFunc(func(req micro.Request) {
+		a.serve(req, describeEndpoint, messageDescribe, "", 0, req.Data())
+	}), micro.WithEndpointSubject(subject))
+	if err != nil {
+		return fmt.Errorf("error while subscribing to subject %s: %w", subject, err)
+	}
+	for _, e := range endpoints {
+		e := e
+		subject := a.subject + ".*." + e.name
+		err = a.svc.AddEndpoint(e.name, micro.HandlerFunc(func(req micro.Request) {
+			a.serve(req, e.name, e.mtype, tenantOf(req.Subject()), 0, req.Data())
+		}), micro.WithEndpointSubject(subject))
+		if err != nil {
+			return fmt.Errorf("error while subscribing to subject %s: %w", subject, err)
+		}
+	}
+	return nil
+}
+
+// SetRouting selects the subjects served by Start, an empty mode serves both
+func (a *ApiServer) SetRouting(mode string) error {
+	switch mode {
+	case "":
+		mode = RoutingBoth
+	case RoutingLegacy, RoutingSubject, RoutingBoth:
+	default:
+		return fmt.Errorf("unknown routing mode %q", mode)
+	}
+	a.routing = mode
+	return nil
+}
+
+// validTenant tells whether tenant can be a subject token, the events of a tenant are
+// published on subjects containing it
+func validTenant(tenant string) bool {
+	return tenant != "" && !strings.ContainsAny(tenant, ".*> \t\r\n")
+}
+
+// tenantOf returns the tenant token of <subject>.<tenant>.<operation>
+func tenantOf(subject string) string {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) < 2 {
+		return ""
+	}
+	return tokens[len(tokens)-2]
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/simdb"
+	"github.com/Go-routine-4995/routermgt/auth"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/nats-io/nats.go/micro"
+	"testing"
+	"time"
+)
+
+func TestSetInfo(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"1.2.3", "1.2.3"},
+		{"v1.2.3", "1.2.3"},
+		{"1.2.3-rc.1", "1.2.3-rc.1"},
+		{"dev", "0.0.0-dev"},
+		{"1.2", "0.0.0-1.2"},
+	}
+	for _, tt := range tests {
+		a := &ApiServer{}
+		a.SetInfo("routermgt", tt.version)
+		if a.version != tt.want {
+			t.Errorf("SetInfo(%q) advertises %q, want %q", tt.version, a.version, tt.want)
+		}
+	}
+}
+
+func TestValidTenant(t *testing.T) {
+	for tenant, valid := range map[string]bool{
+		"acme":     true,
+		"acme-eu":  true,
+		"":         false,
+		"acme.eu":  false,
+		"*":        false,
+		">":        false,
+		"acme eu":  false,
+		"acme\teu": false,
+	} {
+		if got := validTenant(tenant); got != valid {
+			t.Errorf("validTenant(%q) = %v", tenant, got)
+		}
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	s := broker(t, 0)
+	startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+		a.SetInfo("routermgt", "v1.4.0")
+	})
+	nc := client(t, s)
+
+	var ping micro.Ping
+	if err := json.Unmarshal(request(t, nc, "$SRV.PING.routermgt", "").Data, &ping); err != nil {
+		t.Fatal(err)
+	}
+	if ping.Name != "routermgt" || ping.Version != "1.4.0" || ping.ID == "" {
+		t.Errorf("unexpected ping %+v", ping)
+	}
+
+	var info micro.Info
+	if err := json.Unmarshal(request(t, nc, "$SRV.INFO.routermgt", "").Data, &info); err != nil {
+		t.Fatal(err)
+	}
+	subjects := make(map[string]string)
+	for _, e := range info.Endpoints {
+		subjects[e.Name] = e.Subject
+	}
+	// the envelope subject, describe and one endpoint per operation
+	if len(subjects) != len(endpoints)+2 {
+		t.Errorf("%d endpoints registered, want %d: %v", len(subjects), len(endpoints)+2, subjects)
+	}
+	if subjects[legacyEndpoint] != testSubject || subjects[describeEndpoint] != testSubject+".describe" {
+		t.Errorf("unexpected subjects %v", subjects)
+	}
+	for _, e := range endpoints {
+		if subjects[e.name] != testSubject+".*."+e.name {
+			t.Errorf("endpoint %s on %q", e.name, subjects[e.name])
+		}
+	}
+
+	// the errors replied to the caller are reported in the endpoint data
+	request(t, nc, testSubject, "not json")
+	request(t, nc, testSubject+".acme.get", `{"router-serial":"S1"}`)
+	var stats micro.Stats
+	if err := json.Unmarshal(request(t, nc, "$SRV.STATS.routermgt", "").Data, &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range stats.Endpoints {
+		var data endpointErrors
+		if len(e.Data) > 0 {
+			if err := json.Unmarshal(e.Data, &data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		switch e.Name {
+		case legacyEndpoint:
+			if e.NumRequests != 1 || data.Errors != 1 || data.LastError == "" {
+				t.Errorf("legacy endpoint stats %+v %+v", e, data)
+			}
+		case "get":
+			if e.NumRequests != 1 || data.Errors != 0 {
+				t.Errorf("get endpoint stats %+v %+v", e, data)
+			}
+		}
+	}
+}
+
+func TestSetRouting(t *testing.T) {
+	s := broker(t, 0)
+	nc := client(t, s)
+
+	tests := []struct {
+		mode      string
+		endpoints int
+		legacy    bool
+	}{
+		{RoutingLegacy, 1, true},
+		{RoutingSubject, len(endpoints) + 1, false},
+		{"", len(endpoints) + 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			a, _ := startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+				if err := a.SetRouting(tt.mode); err != nil {
+					t.Fatal(err)
+				}
+			})
+			var info micro.Info
+			if err := json.Unmarshal(request(t, nc, "$SRV.INFO.routermgt."+a.svc.Info().ID, "").Data, &info); err != nil {
+				t.Fatal(err)
+			}
+			legacy := false
+			for _, e := range info.Endpoints {
+				legacy = legacy || e.Name == legacyEndpoint
+			}
+			if len(info.Endpoints) != tt.endpoints || legacy != tt.legacy {
+				t.Errorf("%d endpoints, legacy %v: %+v", len(info.Endpoints), legacy, info.Endpoints)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = a.Shutdown(ctx)
+		})
+	}
+
+	if err := (&ApiServer{}).SetRouting("numeric"); err == nil {
+		t.Errorf("unknown routing mode accepted")
+	}
+}
+
+func TestSubjectRouting(t *testing.T) {
+	const secret = "secret"
+	s := broker(t, 0)
+	_, db := startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+		v, err := auth.NewVerifier(secret, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.SetVerifier(v)
+	})
+	nc := client(t, s)
+	operator := token(t, secret, "alice", map[string]string{"acme": "operator", "other": "operator"})
+
+	events, err := nc.SubscribeSync(testSubject + ".*" + eventSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tenant of the subject wins over the Tenant header
+	rep := request(t, nc, testSubject+".acme.create", `[{"router-serial":"S1"}]`, headerAuthorization, operator, headerTenant, "other")
+	if code := rep.Header.Get(headerErrorCode); code != "" {
+		t.Fatalf("create failed: %s", rep.Data)
+	}
+	for tenant, found := range map[string]bool{"acme": true, "other": false} {
+		if _, ok := db.GetRouter(context.Background(), domain.Router{RouterSerial: "S1"}, tenant); ok != found {
+			t.Errorf("router in tenant %s: %v", tenant, ok)
+		}
+	}
+	msg, err := events.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != testSubject+".acme"+eventSuffix {
+		t.Errorf("event published on %s", msg.Subject)
+	}
+
+	// the body is the plain payload, the operation is given by the subject
+	rep = request(t, nc, testSubject+".acme.get", `{"router-serial":"S1"}`, headerAuthorization, operator)
+	var r domain.Router
+	if err = json.Unmarshal(rep.Data, &r); err != nil || r.RouterSerial != "S1" {
+		t.Errorf("get replied %s: %v", rep.Data, err)
+	}
+	rep = request(t, nc, testSubject+".other.get", `{"router-serial":"S1"}`, headerAuthorization, operator)
+	if len(rep.Data) != 0 {
+		t.Errorf("router of acme read from other: %s", rep.Data)
+	}
+
+	// the token is checked against the tenant of the subject
+	rep = request(t, nc, testSubject+".third.get", `{"router-serial":"S1"}`, headerAuthorization, operator)
+	if code := rep.Header.Get(headerErrorCode); code != "403" {
+		t.Errorf("error code %q on a tenant of another account", code)
+	}
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"time"
+)
+
+// connection states reported by ApiServer.State
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+	StateClosed       = "closed"
+)
+
+// NatsOptions drive the broker connection, zero values keep the nats.go defaults
+type NatsOptions struct {
+	// Name advertised to the broker
+	Name string
+	// ConnectTimeout of each dial attempt
+	ConnectTimeout time.Duration
+	// ReconnectWait between two attempts to the same server
+	ReconnectWait time.Duration
+	// ReconnectJitter added to ReconnectWait to avoid all instances reconnecting at once
+	ReconnectJitter time.Duration
+	// MaxReconnects before giving up, -1 retries forever
+	MaxReconnects int
+	// RetryOnFailedConnect keeps retrying when the broker is down at startup instead of failing
+	RetryOnFailedConnect bool
+	// ReconnectBufSize is the amount of bytes of replies/events buffered while disconnected,
+	// -1 disables buffering and publishing fails immediately during an outage
+	ReconnectBufSize int
+
+	// authentication, at most one method: CredsFile, NKeySeedFile, Token or User/Password
+	CredsFile    string
+	NKeySeedFile string
+	Token        string
+	User         string
+	Password     string
+
+	// TLS, TLSCert and TLSKey enable mutual TLS, TLSCA verifies the broker certificate
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+}
+
+// SecurityOptions returns the authentication and TLS options, it is shared with routerctl
+func SecurityOptions(o NatsOptions) ([]nats.Option, error) {
+	var opts []nats.Option
+
+	switch {
+	case o.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(o.CredsFile))
+	case o.NKeySeedFile != "":
+		nk, err := nats.NkeyOptionFromSeed(o.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("nkey seed %s: %w", o.NKeySeedFile, err)
+		}
+		opts = append(opts, nk)
+	case o.Token != "":
+		opts = append(opts, nats.Token(o.Token))
+	case o.User != "":
+		opts = append(opts, nats.UserInfo(o.User, o.Password))
+	}
+
+	// the files are read again on each reconnect, a rotated certificate is used from then on
+	if o.TLSCert != "" || o.TLSKey != "" {
+		opts = append(opts, nats.ClientCert(o.TLSCert, o.TLSKey))
+	}
+	if o.TLSCA != "" {
+		opts = append(opts, nats.RootCAs(o.TLSCA))
+	}
+	return opts, nil
+}
+
+func (a *ApiServer) connect(u string, o NatsOptions) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			a.setState(StateDisconnected)
+			if err != nil {
+				fmt.Println("broker disconnected: ", err)
+				return
+			}
+			fmt.Println("broker disconnected")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			a.setState(StateConnected)
+			fmt.Println("broker reconnected to ", nc.ConnectedUrlRedacted())
+		}),
+		nats.ConnectHandler(func(nc *nats.Conn) {
+			// only called when the initial connection was retried
+			a.setState(StateConnected)
+			fmt.Println("broker connected to ", nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			a.setState(StateClosed)
+			if err := nc.LastError(); err != nil {
+				fmt.Println("broker connection closed: ", err)
+				return
+			}
+			fmt.Println("broker connection closed")
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				fmt.Printf("broker error on %s: %v\n", sub.Subject, err)
+				return
+			}
+			fmt.Println("broker error: ", err)
+		}),
+	}
+	if o.Name != "" {
+		opts = append(opts, nats.Name(o.Name))
+	}
+	if o.ConnectTimeout > 0 {
+		opts = append(opts, nats.Timeout(o.ConnectTimeout))
+	}
+	if o.ReconnectWait > 0 {
+		opts = append(opts, nats.ReconnectWait(o.ReconnectWait))
+	}
+	if o.ReconnectJitter > 0 {
+		opts = append(opts, nats.ReconnectJitter(o.ReconnectJitter, o.ReconnectJitter))
+	}
+	if o.MaxReconnects != 0 {
+		opts = append(opts, nats.MaxReconnects(o.MaxReconnects))
+	}
+	if o.RetryOnFailedConnect {
+		opts = append(opts, nats.RetryOnFailedConnect(true))
+	}
+	if o.ReconnectBufSize != 0 {
+		opts = append(opts, nats.ReconnectBufSize(o.ReconnectBufSize))
+	}
+
+	sec, err := SecurityOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, sec...)
+
+	a.setState(StateConnecting)
+	nc, err := nats.Connect(u, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if nc.IsConnected() {
+		a.setState(StateConnected)
+	}
+	return nc, nil
+}
+
+func (a *ApiServer) setState(s string) {
+	a.state.Store(s)
+}
+
+// State returns the broker connection state, see the State constants
+func (a *ApiServer) State() string {
+	s, _ := a.state.Load().(string)
+	return s
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/simdb"
+	"github.com/Go-routine-4995/routermgt/service"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionState(t *testing.T) {
+	s := broker(t, 0)
+	p := port(s)
+	a, err := NewApiService(service.NewService(simdb.NewSimDB()), s.ClientURL(), testSubject, NatsOptions{ReconnectWait: 20 * time.Millisecond, MaxReconnects: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := a.State(); st != StateConnected {
+		t.Fatalf("state %q after connect", st)
+	}
+	if err = a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Ready(context.Background()); err != nil {
+		t.Errorf("not ready: %v", err)
+	}
+
+	s.Shutdown()
+	waitFor(t, "disconnected", func() bool { return a.State() == StateDisconnected })
+	if err = a.Ready(context.Background()); err == nil {
+		t.Errorf("ready while disconnected")
+	}
+
+	// the same port again, the client reconnects on its own
+	broker(t, p)
+	waitFor(t, "reconnected", func() bool { return a.State() == StateConnected })
+	if err = a.Ready(context.Background()); err != nil {
+		t.Errorf("not ready after the reconnection: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = a.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "closed", func() bool { return a.State() == StateClosed })
+	if err = a.Ready(context.Background()); err == nil {
+		t.Errorf("ready after shutdown")
+	}
+}
+
+func TestRetryOnFailedConnect(t *testing.T) {
+	// a free port, the broker is started once the service is waiting for it
+	s := broker(t, 0)
+	p, url := port(s), s.ClientURL()
+	s.Shutdown()
+
+	a, err := NewApiService(service.NewService(simdb.NewSimDB()), url, testSubject, NatsOptions{RetryOnFailedConnect: true, ReconnectWait: 20 * time.Millisecond, MaxReconnects: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.con.Close()
+	if st := a.State(); st != StateConnecting {
+		t.Fatalf("state %q without broker", st)
+	}
+
+	broker(t, p)
+	waitFor(t, "connected", func() bool { return a.State() == StateConnected })
+
+	// without retry the broker must be up
+	_, err = NewApiService(service.NewService(simdb.NewSimDB()), "nats://127.0.0.1:1", testSubject, NatsOptions{})
+	if err == nil || !strings.Contains(err.Error(), "broker connection error") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSecurityOptions(t *testing.T) {
+	seed := filepath.Join(t.TempDir(), "seed.nk")
+	if err := os.WriteFile(seed, []byte("not a seed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		o    NatsOptions
+		opts int
+		err  string
+	}{
+		{"none", NatsOptions{}, 0, ""},
+		{"token", NatsOptions{Token: "t"}, 1, ""},
+		{"user", NatsOptions{User: "u", Password: "p"}, 1, ""},
+		// a single authentication method, the first one configured
+		{"creds first", NatsOptions{CredsFile: "user.creds", Token: "t", User: "u"}, 1, ""},
+		{"mutual tls", NatsOptions{Token: "t", TLSCert: "cert.pem", TLSKey: "key.pem", TLSCA: "ca.pem"}, 3, ""},
+		{"invalid nkey", NatsOptions{NKeySeedFile: seed}, 0, "nkey seed"},
+		{"missing nkey", NatsOptions{NKeySeedFile: seed + ".none"}, 0, "nkey seed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := SecurityOptions(tt.o)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(opts) != tt.opts {
+				t.Errorf("%d options, want %d", len(opts), tt.opts)
+			}
+		})
+	}
+}
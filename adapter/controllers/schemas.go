@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/Go-routine-4995/routermgt/schema"
+)
+
+// ListResponse is the reply of list since protocol version 2
+type ListResponse struct {
+	Routers []domain.Router `json:"routers"`
+	Page    int             `json:"page"`
+	Last    int             `json:"last"`
+}
+
+// ListResponseV1 is the reply of list with protocol version 1, routers is null when empty
+type ListResponseV1 struct {
+	Last    int              `json:"last"`
+	Routers *[]domain.Router `json:"routers"`
+}
+
+// CreateResponse is the reply of create since protocol version 2
+type CreateResponse struct {
+	Created    []domain.Router `json:"created"`
+	Duplicates []domain.Router `json:"duplicates"`
+}
+
+// StatusResponse is the reply of delete since protocol version 2
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// QuotaResponse is the reply of quota, the tenant usage comes first
+type QuotaResponse struct {
+	Quotas []domain.QuotaUsage `json:"quotas"`
+}
+
+// AuditResponse is the reply of audit, entries are sorted newest first
+type AuditResponse struct {
+	Entries []domain.AuditEntry `json:"entries"`
+	Page    int                 `json:"page"`
+	Last    int                 `json:"last"`
+}
+
+// HistoryResponse is the reply of history, versions are sorted oldest first
+type HistoryResponse struct {
+	RouterSerial string                 `json:"router-serial"`
+	Versions     []domain.RouterVersion `json:"versions"`
+}
+
+// RestoreResponse is the reply of restore, missing lists the routers without tombstone
+type RestoreResponse struct {
+	Restored []domain.Router `json:"restored"`
+	Missing  []domain.Router `json:"missing"`
+}
+
+// DeletedResponse is the reply of deleted, the most recently deleted routers come first
+type DeletedResponse struct {
+	Routers []domain.DeletedRouter `json:"routers"`
+	Page    int                    `json:"page"`
+	Last    int                    `json:"last"`
+}
+
+// LabelRequest is the payload of label, the labels are set then removed on every router
+type LabelRequest struct {
+	RouterSerials []string `json:"router-serials" jsonschema:"required"`
+	domain.LabelChange
+}
+
+// LabelResponse is the reply of label, missing lists the unknown serials
+type LabelResponse struct {
+	Routers []domain.Router `json:"routers"`
+	Missing []string        `json:"missing"`
+}
+
+// GroupsRequest is the payload of groups, the whole hierarchy is returned when root is empty
+type GroupsRequest struct {
+	Root string `json:"root,omitempty"`
+}
+
+// GroupsResponse is the reply of groups, depth first with the children sorted by id
+type GroupsResponse struct {
+	Groups []domain.GroupCount `json:"groups"`
+}
+
+// AssignRequest is the payload of assign, an empty group removes the routers from their group
+type AssignRequest struct {
+	RouterSerials []string `json:"router-serials" jsonschema:"required"`
+	Group         string   `json:"group,omitempty"`
+}
+
+// AssignResponse is the reply of assign, missing lists the unknown serials
+type AssignResponse struct {
+	Routers []domain.Router `json:"routers"`
+	Missing []string        `json:"missing"`
+}
+
+var (
+	groupSchema      = schema.Generate(domain.Group{})
+	routerSchema     = schema.Generate(domain.Router{})
+	paginationSchema = schema.Generate(domain.Pagination{})
+
+	// requestSchemas validate the payload of each operation before it is decoded
+	requestSchemas = map[int]*schema.Schema{
+		messageGet:      routerSchema,
+		messageGetPaged: paginationSchema,
+		messageCreate:   schema.ArrayOf(routerSchema),
+		messageDelete:   schema.ArrayOf(routerSchema),
+		messageAudit:    schema.Generate(domain.AuditQuery{}),
+		messageHistory:  schema.Generate(domain.HistoryQuery{}),
+		messageDiff:     schema.Generate(domain.DiffQuery{}),
+		messageRestore:  schema.ArrayOf(routerSchema),
+		messageDeleted:  paginationSchema,
+		messageUpdate:   routerSchema,
+		messageLabel:    schema.Generate(LabelRequest{}),
+		messageGroups:   schema.Generate(GroupsRequest{}),
+		// group-delete only needs the id
+		messageGroupSave:   groupSchema,
+		messageGroupDelete: groupSchema,
+		messageAssign:      schema.Generate(AssignRequest{}),
+		messageTransition:  schema.Generate(domain.Transition{}),
+	}
+)
+
+// Schemas returns the JSON Schema of the payloads by name: the domain types, then
+// <operation>.request and <operation>.response for the latest protocol version
+func Schemas() map[string]*schema.Schema {
+	res := map[string]*schema.Schema{
+		"router":                routerSchema,
+		"pagination":            paginationSchema,
+		"router-event":          schema.Generate(domain.RouterEvent{}),
+		"error":                 schema.Generate(ApiError{}),
+		"get.request":           requestSchemas[messageGet],
+		"get.response":          routerSchema,
+		"list.request":          requestSchemas[messageGetPaged],
+		"list.response":         schema.Generate(ListResponse{}),
+		"list.response.v1":      schema.Generate(ListResponseV1{}),
+		"create.request":        requestSchemas[messageCreate],
+		"create.response":       schema.Generate(CreateResponse{}),
+		"delete.request":        requestSchemas[messageDelete],
+		"delete.response":       schema.Generate(StatusResponse{}),
+		"update.request":        requestSchemas[messageUpdate],
+		"update.response":       routerSchema,
+		"label.request":         requestSchemas[messageLabel],
+		"label.response":        schema.Generate(LabelResponse{}),
+		"group":                 groupSchema,
+		"groups.request":        requestSchemas[messageGroups],
+		"groups.response":       schema.Generate(GroupsResponse{}),
+		"group-save.request":    requestSchemas[messageGroupSave],
+		"group-save.response":   groupSchema,
+		"group-delete.request":  requestSchemas[messageGroupDelete],
+		"group-delete.response": schema.Generate(StatusResponse{}),
+		"assign.request":        requestSchemas[messageAssign],
+		"assign.response":       schema.Generate(AssignResponse{}),
+		"transition.request":    requestSchemas[messageTransition],
+		"transition.response":   routerSchema,
+		"quota.response":        schema.Generate(QuotaResponse{}),
+		"quota-event":           schema.Generate(domain.QuotaEvent{}),
+		"audit.request":         requestSchemas[messageAudit],
+		"audit.response":        schema.Generate(AuditResponse{}),
+		"history.request":       requestSchemas[messageHistory],
+		"history.response":      schema.Generate(HistoryResponse{}),
+		"diff.request":          requestSchemas[messageDiff],
+		"diff.response":         schema.Generate(domain.RouterDiff{}),
+		"restore.request":       requestSchemas[messageRestore],
+		"restore.response":      schema.Generate(RestoreResponse{}),
+		"deleted.request":       requestSchemas[messageDeleted],
+		"deleted.response":      schema.Generate(DeletedResponse{}),
+	}
+	for name, s := range res {
+		res[name] = s.Root(name+".json", name)
+	}
+	return res
+}
+
+// validateRequest checks the payload of the operation, the error lists every invalid field
+func validateRequest(mtype int, data []byte) error {
+	s, ok := requestSchemas[mtype]
+	if !ok {
+		return nil
+	}
+	err := schema.Validate(s, data)
+	if err == nil {
+		return nil
+	}
+	ae := badRequest("invalid payload: %v", err)
+	if errs, ok := err.(schema.Errors); ok {
+		ae.Details = errs
+	}
+	return ae
+}
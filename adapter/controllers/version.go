@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"github.com/Go-routine-4995/routermgt/schema"
+	"github.com/nats-io/nats.go"
+	"sort"
+	"strconv"
+)
+
+// protocol versions, a request without version is served as version 1 so that deployed
+// clients keep working. Version 2 replies are always JSON objects:
+//   - get: the router, a missing router is a 404 error instead of an empty body
+//   - list: {"routers": [...], "page": n, "last": n}, routers is never null
+//   - create: {"created": [...], "duplicates": [...]} instead of "sucess!" or the duplicates
+//   - delete: {"status": "ok"} instead of "sucess!", each router must carry its revision
+//   - update: the revision is required, version 1 callers may omit it to overwrite the router
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	// headerVersion selects the protocol version of the request, it is echoed in the reply
+	headerVersion = "Api-Version"
+)
+
+var versions = []int{ProtocolV1, ProtocolV2}
+
+// protocolVersion returns the version of the request, the envelope field wins over the header
+func protocolVersion(h nats.Header, envelope int) (int, error) {
+	v := envelope
+	if v == 0 && h != nil && h.Get(headerVersion) != "" {
+		n, err := strconv.Atoi(h.Get(headerVersion))
+		if err != nil {
+			return 0, badRequest("invalid %s header %q", headerVersion, h.Get(headerVersion))
+		}
+		v = n
+	}
+	if v == 0 {
+		return ProtocolV1, nil
+	}
+	for _, s := range versions {
+		if s == v {
+			return v, nil
+		}
+	}
+	return 0, badRequest("unsupported protocol version %d, supported versions: %v", v, versions)
+}
+
+// Description is the reply of the describe operation
+type Description struct {
+	Name       string                    `json:"name"`
+	Version    string                    `json:"version"`
+	Protocols  []int                     `json:"protocols"`
+	Operations []OperationDescription    `json:"operations"`
+	Schema     map[string]*schema.Schema `json:"schema"`
+}
+
+type OperationDescription struct {
+	Name       string `json:"name"`
+	Mtype      int    `json:"mtype"`
+	Subject    string `json:"subject,omitempty"`
+	Permission string `json:"permission,omitempty"`
+	// Idempotent operations accept an Idempotency-Key header
+	Idempotent bool `json:"idempotent,omitempty"`
+}
+
+// describe lists the protocol versions, the operations and the fields of the payloads
+func (a *ApiServer) describe() Description {
+	d := Description{
+		Name:      a.name,
+		Version:   a.version,
+		Protocols: versions,
+		Schema:    Schemas(),
+	}
+	for _, e := range endpoints {
+		o := OperationDescription{
+			Name:       e.name,
+			Mtype:      e.mtype,
+			Permission: string(operations[e.mtype]),
+			Idempotent: idempotent[e.mtype],
+		}
+		if a.routing != RoutingLegacy {
+			o.Subject = a.subject + ".*." + e.name
+		}
+		d.Operations = append(d.Operations, o)
+	}
+	o := OperationDescription{Name: describeEndpoint, Mtype: messageDescribe}
+	if a.routing != RoutingLegacy {
+		o.Subject = a.subject + "." + describeEndpoint
+	}
+	d.Operations = append(d.Operations, o)
+	sort.Slice(d.Operations, func(i, j int) bool { return d.Operations[i].Mtype < d.Operations[j].Mtype })
+	return d
+}
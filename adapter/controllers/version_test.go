@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/simdb"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/nats-io/nats.go"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		envelope int
+		version  int
+		err      bool
+	}{
+		{"default", "", 0, ProtocolV1, false},
+		{"header", "2", 0, ProtocolV2, false},
+		{"envelope", "", 2, ProtocolV2, false},
+		{"envelope before header", "1", 2, ProtocolV2, false},
+		{"invalid header", "two", 0, 0, true},
+		{"unsupported header", "3", 0, 0, true},
+		{"unsupported envelope", "", 3, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := nats.Header{}
+			if tt.header != "" {
+				h.Set(headerVersion, tt.header)
+			}
+			v, err := protocolVersion(h, tt.envelope)
+			if tt.err {
+				var ae *ApiError
+				if !errors.As(err, &ae) || ae.Code != codeBadRequest {
+					t.Fatalf("expected a bad request, got %v", err)
+				}
+				return
+			}
+			if err != nil || v != tt.version {
+				t.Errorf("got %d %v, want %d", v, err, tt.version)
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	s := broker(t, 0)
+	startAPI(t, s, func(a *ApiServer, db *simdb.Simdb) {
+		a.SetInfo("routermgt", "1.4.0")
+	})
+	nc := client(t, s)
+
+	rep := request(t, nc, testSubject+".describe", "", headerVersion, "2")
+	if v := rep.Header.Get(headerVersion); v != "2" {
+		t.Errorf("reply version %q", v)
+	}
+	var d Description
+	if err := json.Unmarshal(rep.Data, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "routermgt" || d.Version != "1.4.0" || len(d.Protocols) != 2 || len(d.Schema) == 0 {
+		t.Errorf("unexpected description %+v", d)
+	}
+	if len(d.Operations) != len(endpoints)+1 {
+		t.Fatalf("%d operations, want %d", len(d.Operations), len(endpoints)+1)
+	}
+	if !sort.SliceIsSorted(d.Operations, func(i, j int) bool { return d.Operations[i].Mtype < d.Operations[j].Mtype }) {
+		t.Errorf("operations not sorted by mtype")
+	}
+	ops := make(map[string]OperationDescription)
+	for _, o := range d.Operations {
+		ops[o.Name] = o
+	}
+	want := map[string]OperationDescription{
+		"get":          {Name: "get", Mtype: messageGet, Subject: testSubject + ".*.get", Permission: "read"},
+		"create":       {Name: "create", Mtype: messageCreate, Subject: testSubject + ".*.create", Permission: "write", Idempotent: true},
+		"group-save":   {Name: "group-save", Mtype: messageGroupSave, Subject: testSubject + ".*.group-save", Permission: "admin", Idempotent: true},
+		"describe":     {Name: "describe", Mtype: messageDescribe, Subject: testSubject + ".describe"},
+		"transition":   {Name: "transition", Mtype: messageTransition, Subject: testSubject + ".*.transition", Permission: "write", Idempotent: true},
+		"deleted":      {Name: "deleted", Mtype: messageDeleted, Subject: testSubject + ".*.deleted", Permission: "read"},
+		"audit":        {Name: "audit", Mtype: messageAudit, Subject: testSubject + ".*.audit", Permission: "admin"},
+		"delete":       {Name: "delete", Mtype: messageDelete, Subject: testSubject + ".*.delete", Permission: "delete", Idempotent: true},
+		"restore":      {Name: "restore", Mtype: messageRestore, Subject: testSubject + ".*.restore", Permission: "write", Idempotent: true},
+		"quota":        {Name: "quota", Mtype: messageQuota, Subject: testSubject + ".*.quota", Permission: "read"},
+		"list":         {Name: "list", Mtype: messageGetPaged, Subject: testSubject + ".*.list", Permission: "read"},
+		"history":      {Name: "history", Mtype: messageHistory, Subject: testSubject + ".*.history", Permission: "read"},
+		"assign":       {Name: "assign", Mtype: messageAssign, Subject: testSubject + ".*.assign", Permission: "write", Idempotent: true},
+		"label":        {Name: "label", Mtype: messageLabel, Subject: testSubject + ".*.label", Permission: "write", Idempotent: true},
+		"update":       {Name: "update", Mtype: messageUpdate, Subject: testSubject + ".*.update", Permission: "write", Idempotent: true},
+		"diff":         {Name: "diff", Mtype: messageDiff, Subject: testSubject + ".*.diff", Permission: "read"},
+		"groups":       {Name: "groups", Mtype: messageGroups, Subject: testSubject + ".*.groups", Permission: "read"},
+		"group-delete": {Name: "group-delete", Mtype: messageGroupDelete, Subject: testSubject + ".*.group-delete", Permission: "admin", Idempotent: true},
+	}
+	for name, w := range want {
+		if ops[name] != w {
+			t.Errorf("%s described as %+v, want %+v", name, ops[name], w)
+		}
+	}
+
+	// the legacy routing describes the message types without subjects
+	a := &ApiServer{routing: RoutingLegacy}
+	for _, o := range a.describe().Operations {
+		if o.Subject != "" {
+			t.Errorf("%s has subject %q with the legacy routing", o.Name, o.Subject)
+		}
+	}
+}
+
+func TestVersionedReplies(t *testing.T) {
+	s := broker(t, 0)
+	startAPI(t, s, nil)
+	nc := client(t, s)
+	subject := testSubject + ".acme."
+
+	text := func(want string) func(b []byte) bool {
+		return func(b []byte) bool { return string(b) == want }
+	}
+	routers := func(serials ...string) func(b []byte) bool {
+		return func(b []byte) bool {
+			var r []domain.Router
+			return json.Unmarshal(b, &r) == nil && reflect.DeepEqual(serialsOf(r), serials)
+		}
+	}
+	created := func(created []string, duplicates []string) func(b []byte) bool {
+		return func(b []byte) bool {
+			var cr CreateResponse
+			return json.Unmarshal(b, &cr) == nil && reflect.DeepEqual(serialsOf(cr.Created), created) && reflect.DeepEqual(serialsOf(cr.Duplicates), duplicates)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		op      string
+		data    string
+		version string
+		code    string
+		check   func(b []byte) bool
+	}{
+		{"v1 create", "create", `[{"router-serial":"S1"}]`, "", "", text("sucess!")},
+		{"v1 duplicates", "create", `[{"router-serial":"S1"}]`, "1", "", routers("S1")},
+		{"v2 create", "create", `[{"router-serial":"S1"},{"router-serial":"S2"}]`, "2", "", created([]string{"S2"}, []string{"S1"})},
+		{"v2 nothing duplicated", "create", `[{"router-serial":"S3"}]`, "2", "", text(`{"created":[{"router-id":"","router-serial":"S3","operator-name":"","iso-country-code":"","mac":"","router-model":"","account-id":"","agent-last-connection":"","agent-version":""}],"duplicates":[]}`)},
+		{"v1 missing router", "get", `{"router-serial":"S9"}`, "1", "", text("")},
+		{"v2 missing router", "get", `{"router-serial":"S9"}`, "2", "404", nil},
+		{"v2 delete without revision", "delete", `[{"router-serial":"S1"}]`, "2", "400", nil},
+		{"v2 delete", "delete", `[{"router-serial":"S1","revision":1}]`, "2", "", text(`{"status":"ok"}`)},
+		{"v2 update without revision", "update", `{"router-serial":"S2"}`, "2", "400", nil},
+		{"unsupported version", "get", `{"router-serial":"S2"}`, "3", "400", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h []string
+			if tt.version != "" {
+				h = []string{headerVersion, tt.version}
+			}
+			rep := request(t, nc, subject+tt.op, tt.data, h...)
+			if code := rep.Header.Get(headerErrorCode); code != tt.code {
+				t.Fatalf("error code %q, want %q: %s", code, tt.code, rep.Data)
+			}
+			if tt.code != "" {
+				return
+			}
+			want := tt.version
+			if want == "" {
+				want = "1"
+			}
+			if v := rep.Header.Get(headerVersion); v != want {
+				t.Errorf("reply version %q, want %s", v, want)
+			}
+			if !tt.check(rep.Data) {
+				t.Errorf("unexpected reply %s", rep.Data)
+			}
+		})
+	}
+}
+
+func serialsOf(routers []domain.Router) []string {
+	res := []string{}
+	for _, r := range routers {
+		res = append(res, r.RouterSerial)
+	}
+	return res
+}
@@ -0,0 +1,143 @@
+/**
+ * @file    health.go
+ * @brief   HTTP liveness and readiness probes.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * /healthz answers as long as the process serves HTTP, /readyz runs every registered check
+ * (broker connected, subscription active, repository ping...) and answers 503 when one fails.
+ */
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultTimeout = 2 * time.Second
+
+// Check returns nil when the component is ready
+type Check func(ctx context.Context) error
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+type Server struct {
+	srv     *http.Server
+	mux     *http.ServeMux
+	timeout time.Duration
+	mu      sync.RWMutex
+	names   []string
+	checks  map[string]Check
+}
+
+// NewServer listens on addr (e.g. ":8080"), timeout bounds the duration of each readiness check
+func NewServer(addr string, timeout time.Duration) *Server {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	s := &Server{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	s.mux = mux
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: timeout,
+	}
+	return s
+}
+
+// AddCheck registers a readiness check, checks run in registration order
+func (s *Server) AddCheck(name string, c Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.checks[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.checks[name] = c
+}
+
+// Handle serves more documents next to the probes (e.g. the API schemas), before Start
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Ready runs every check and returns the report, Status is "ok" or "unavailable"
+func (s *Server) Ready(ctx context.Context) Report {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rep := Report{
+		Status: "ok",
+		Checks: make(map[string]string, len(s.names)),
+	}
+	for _, n := range s.names {
+		cctx, cancel := context.WithTimeout(ctx, s.timeout)
+		err := s.checks[n](cctx)
+		cancel()
+		if err != nil {
+			rep.Status = "unavailable"
+			rep.Checks[n] = err.Error()
+			continue
+		}
+		rep.Checks[n] = "ok"
+	}
+	return rep
+}
+
+// Start listens in the background, it fails when the address cannot be bound
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("health server: %w", err)
+	}
+	fmt.Println(" health probes on: ", l.Addr())
+	go func() {
+		err := s.srv.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("health server: ", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the HTTP server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	write(w, http.StatusOK, Report{Status: "ok"})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	rep := s.Ready(r.Context())
+	code := http.StatusOK
+	if rep.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	write(w, code, rep)
+}
+
+func write(w http.ResponseWriter, code int, rep Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(rep)
+	if err != nil {
+		fmt.Println("err marshalling health report: ", err)
+	}
+}
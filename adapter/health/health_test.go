@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// get serves path and returns the status code and the decoded report
+func get(t *testing.T, s *Server, path string) (int, Report) {
+	t.Helper()
+	var rep Report
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: content type %q", path, ct)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return w.Code, rep
+}
+
+func TestHealthz(t *testing.T) {
+	s := NewServer("127.0.0.1:0", 0)
+	// liveness does not run the readiness checks
+	s.AddCheck("broker", func(ctx context.Context) error { return errors.New("broker disconnected") })
+	code, rep := get(t, s, "/healthz")
+	if code != http.StatusOK || !reflect.DeepEqual(rep, Report{Status: "ok"}) {
+		t.Errorf("got %d %+v", code, rep)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failed := func(ctx context.Context) error { return errors.New("broker disconnected") }
+	// a check that ignores the deadline would block the probe, this one honours it
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name   string
+		checks map[string]Check
+		code   int
+		want   Report
+	}{
+		{"no check", nil, http.StatusOK, Report{Status: "ok"}},
+		{"all ready", map[string]Check{"broker": ok, "repository": ok}, http.StatusOK, Report{Status: "ok", Checks: map[string]string{"broker": "ok", "repository": "ok"}}},
+		{"one failed", map[string]Check{"broker": failed, "repository": ok}, http.StatusServiceUnavailable, Report{Status: "unavailable", Checks: map[string]string{"broker": "broker disconnected", "repository": "ok"}}},
+		{"timeout", map[string]Check{"repository": slow}, http.StatusServiceUnavailable, Report{Status: "unavailable", Checks: map[string]string{"repository": context.DeadlineExceeded.Error()}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("127.0.0.1:0", 20*time.Millisecond)
+			for name, c := range tt.checks {
+				s.AddCheck(name, c)
+			}
+			code, rep := get(t, s, "/readyz")
+			if code != tt.code || !reflect.DeepEqual(rep, tt.want) {
+				t.Errorf("got %d %+v, want %d %+v", code, rep, tt.code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddCheck(t *testing.T) {
+	s := NewServer("127.0.0.1:0", 0)
+	s.AddCheck("broker", func(ctx context.Context) error { return errors.New("down") })
+	// registered again, the check is replaced and keeps its place
+	s.AddCheck("broker", func(ctx context.Context) error { return nil })
+	if !reflect.DeepEqual(s.names, []string{"broker"}) {
+		t.Errorf("checks %v", s.names)
+	}
+	if rep := s.Ready(context.Background()); rep.Status != "ok" {
+		t.Errorf("replaced check still runs: %+v", rep)
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	s := NewServer("127.0.0.1:0", 0)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+
+	// the address is bound by Start, not in the background
+	err := NewServer("256.0.0.1:0", 0).Start()
+	if err == nil || !strings.Contains(err.Error(), "health server") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"time"
+)
+
+// auditEntry is a row of the audit_log table, a trigger rejects updates and deletes
+type auditEntry struct {
+	tableName    struct{} `pg:"audit_log"`
+	ID           int64    `pg:",pk"`
+	Time         time.Time
+	Tenant       string
+	Actor        string
+	RequestID    string `pg:",use_zero"`
+	Action       string
+	RouterSerial string
+	Before       *domain.Router `pg:"type:jsonb"`
+	After        *domain.Router `pg:"type:jsonb"`
+}
+
+// record inserts the entries in the transaction of the change they describe
+func record(ctx context.Context, tx *pg.Tx, entries []domain.AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	rows := make([]auditEntry, len(entries))
+	for i, e := range entries {
+		rows[i] = auditEntry{
+			Time:         e.Time,
+			Tenant:       e.Tenant,
+			Actor:        e.Actor,
+			RequestID:    e.RequestID,
+			Action:       e.Action,
+			RouterSerial: e.RouterSerial,
+			Before:       e.Before,
+			After:        e.After,
+		}
+	}
+	_, err := tx.ModelContext(ctx, &rows).Insert()
+	return err
+}
+
+// AuditTrail returns a page of the entries of the tenant matching q, newest first, and the index
+// of the last page
+func (p *Postgres) AuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error) {
+	var rows []auditEntry
+
+	count, err := p.db.ModelContext(ctx, &rows).
+		Where("tenant = ?", tenant).
+		Apply(auditFilter(q)).
+		Order("time DESC", "id DESC").
+		Limit(q.Limit).
+		Offset(q.Page * q.Limit).
+		SelectAndCount()
+	if err != nil {
+		return nil, 0, err
+	}
+	last := 0
+	if count > 0 {
+		last = (count - 1) / q.Limit
+	}
+	res := make([]domain.AuditEntry, len(rows))
+	for i, r := range rows {
+		res[i] = domain.AuditEntry{
+			ID:           r.ID,
+			Time:         r.Time,
+			Tenant:       r.Tenant,
+			Actor:        r.Actor,
+			RequestID:    r.RequestID,
+			Action:       r.Action,
+			RouterSerial: r.RouterSerial,
+			Before:       r.Before,
+			After:        r.After,
+		}
+	}
+	return res, last, nil
+}
+
+func auditFilter(q domain.AuditQuery) func(*orm.Query) (*orm.Query, error) {
+	return func(query *orm.Query) (*orm.Query, error) {
+		if q.RouterSerial != "" {
+			query = query.Where("router_serial = ?", q.RouterSerial)
+		}
+		if q.Actor != "" {
+			query = query.Where("actor = ?", q.Actor)
+		}
+		if !q.From.IsZero() {
+			query = query.Where("time >= ?", q.From)
+		}
+		if !q.To.IsZero() {
+			query = query.Where("time < ?", q.To)
+		}
+		return query, nil
+	}
+}
@@ -0,0 +1,73 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditTrail(t *testing.T) {
+	ctx := context.Background()
+	p := testDB(t)
+	if _, err := p.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+	// one entry a minute, S1 and S2 changed in turn by alice and bob, and an entry of another tenant
+	var entries []domain.AuditEntry
+	for i := 0; i < 6; i++ {
+		e := domain.AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Tenant: "acme", Actor: "alice", Action: domain.AuditUpdate, RouterSerial: "S1"}
+		if i%2 == 1 {
+			e.Actor, e.RouterSerial = "bob", "S2"
+		}
+		entries = append(entries, e)
+	}
+	entries = append(entries, domain.AuditEntry{Time: start, Tenant: "other", Actor: "alice", Action: domain.AuditUpdate, RouterSerial: "S1"})
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entries are compared by minute, the ids depend on the sequence
+	tests := []struct {
+		name    string
+		q       domain.AuditQuery
+		minutes []int
+		last    int
+	}{
+		{"newest first", domain.AuditQuery{Limit: 10}, []int{5, 4, 3, 2, 1, 0}, 0},
+		{"first page", domain.AuditQuery{Limit: 4}, []int{5, 4, 3, 2}, 1},
+		{"last page", domain.AuditQuery{Limit: 4, Page: 1}, []int{1, 0}, 1},
+		{"out of range", domain.AuditQuery{Limit: 4, Page: 2}, []int{}, 1},
+		{"router", domain.AuditQuery{Limit: 10, RouterSerial: "S2"}, []int{5, 3, 1}, 0},
+		{"actor", domain.AuditQuery{Limit: 2, Actor: "alice"}, []int{4, 2}, 1},
+		{"actor last page", domain.AuditQuery{Limit: 2, Page: 1, Actor: "alice"}, []int{0}, 1},
+		// From is inclusive, To is exclusive
+		{"time range", domain.AuditQuery{Limit: 10, From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}, []int{2, 1}, 0},
+		{"all filters", domain.AuditQuery{Limit: 10, RouterSerial: "S1", Actor: "alice", From: start.Add(time.Minute)}, []int{4, 2}, 0},
+		{"no match", domain.AuditQuery{Limit: 10, Actor: "carol"}, []int{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, last, err := p.AuditTrail(ctx, tt.q, "acme")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			minutes := []int{}
+			for _, e := range res {
+				if e.Tenant != "acme" {
+					t.Errorf("entry of tenant %s", e.Tenant)
+				}
+				minutes = append(minutes, int(e.Time.Sub(start)/time.Minute))
+			}
+			if !reflect.DeepEqual(minutes, tt.minutes) || last != tt.last {
+				t.Errorf("got %v last %d, want %v last %d", minutes, last, tt.minutes, tt.last)
+			}
+		})
+	}
+}
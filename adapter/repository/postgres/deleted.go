@@ -0,0 +1,135 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"time"
+)
+
+// Restore brings back the deleted routers and returns them, the routers without tombstone are
+// ignored. A router whose group was deleted meanwhile is restored without group. Like Add it
+// fails without restoring anything when a quota would be exceeded.
+func (p *Postgres) Restore(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error) {
+	var restored []domain.Router
+
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var (
+			quotas  []quota
+			entries []domain.AuditEntry
+		)
+		err := tx.ModelContext(ctx, &quotas).Where("tenant = ?", tenant).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+		for _, k := range routers {
+			var rows []router
+			_, err = tx.ModelContext(ctx, &rows).
+				Set("deleted_at = NULL, deleted_by = NULL, revision = revision + 1").
+				Where("router_serial = ?", k.RouterSerial).
+				Where("tenant = ?", tenant).
+				Where("deleted_at IS NOT NULL").
+				Returning("*").
+				Update()
+			if err != nil {
+				return err
+			}
+			for i := range rows {
+				err = keepGroup(ctx, tx, &rows[i])
+				if err != nil {
+					return err
+				}
+				e := domain.Audit(ctx, tenant, domain.AuditRestore, nil, &rows[i].Router)
+				err = openVersion(ctx, tx, tenant, rows[i].Router, e.Time)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, e)
+				restored = append(restored, rows[i].Router)
+			}
+		}
+		err = checkQuotas(ctx, tx, quotas, restored)
+		if err != nil {
+			return err
+		}
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// keepGroup removes the restored router r from its group when the group no longer exists, the
+// group is locked until the end of the restore
+func keepGroup(ctx context.Context, tx *pg.Tx, r *router) error {
+	if r.Group == "" {
+		return nil
+	}
+	n, err := tx.ModelContext(ctx, (*group)(nil)).
+		Where("tenant = ?", r.Tenant).
+		Where("id = ?", r.Group).
+		For("SHARE").
+		Count()
+	if err != nil || n > 0 {
+		return err
+	}
+	r.Group = ""
+	_, err = tx.ModelContext(ctx, (*router)(nil)).
+		Set("group_id = NULL").
+		Where("router_serial = ?", r.RouterSerial).
+		Where("tenant = ?", r.Tenant).
+		Update()
+	return err
+}
+
+// Deleted returns a page of the tombstones of the tenant, most recently deleted first, and the
+// index of the last page
+func (p *Postgres) Deleted(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error) {
+	var rows []router
+
+	count, err := p.db.ModelContext(ctx, &rows).
+		Where("tenant = ?", tenant).
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC", "router_serial").
+		Limit(page.Limit).
+		Offset(page.Page * page.Limit).
+		SelectAndCount()
+	if err != nil {
+		return nil, 0, err
+	}
+	last := 0
+	if count > 0 {
+		last = (count - 1) / page.Limit
+	}
+	res := make([]domain.DeletedRouter, len(rows))
+	for i, r := range rows {
+		res[i] = domain.DeletedRouter{Router: r.Router, DeletedAt: r.DeletedAt, DeletedBy: r.DeletedBy}
+	}
+	return res, last, nil
+}
+
+// PurgeDeleted removes the tombstones older than before and returns how many were removed, the
+// purge is recorded in the audit trail
+func (p *Postgres) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	var rows []router
+
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		_, err := tx.ModelContext(ctx, &rows).
+			Where("deleted_at < ?", before).
+			Returning("*").
+			Delete()
+		if err != nil {
+			return err
+		}
+		entries := make([]domain.AuditEntry, len(rows))
+		for i := range rows {
+			entries[i] = domain.Audit(ctx, rows[i].Tenant, domain.AuditPurge, &rows[i].Router, nil)
+		}
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
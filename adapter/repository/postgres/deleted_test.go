@@ -0,0 +1,55 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"testing"
+)
+
+func TestDeleteGroupTombstones(t *testing.T) {
+	ctx := context.Background()
+	p := groupFleet(t)
+	if err := p.Delete(ctx, []domain.Router{{RouterSerial: "S1"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Assign(ctx, []string{"S2"}, "", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteGroup(ctx, "eu", "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tombstone is not changed by the deletion of the group
+	tombstones, _, err := p.Deleted(ctx, domain.Pagination{Limit: 10}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 || tombstones[0].Router.Group != "eu" || tombstones[0].Router.Revision != 3 {
+		t.Fatalf("tombstones %+v", tombstones)
+	}
+	// the router leaves the group when it is restored, the change is audited and versioned
+	restored, err := p.Restore(ctx, []domain.Router{{RouterSerial: "S1"}}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0].Group != "" || restored[0].Revision != 4 {
+		t.Fatalf("restored %+v", restored)
+	}
+	if r, _ := p.GetRouter(ctx, domain.Router{RouterSerial: "S1"}, "acme"); r.Group != "" {
+		t.Errorf("restored router in group %s", r.Group)
+	}
+	entries, _, err := p.AuditTrail(ctx, domain.AuditQuery{Limit: 1, RouterSerial: "S1"}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != domain.AuditRestore || entries[0].After.Group != "" {
+		t.Errorf("restore recorded as %+v", entries)
+	}
+	versions, err := p.RouterHistory(ctx, "S1", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur := versions[len(versions)-1]; !cur.Current() || cur.Router.Group != "" || cur.Router.Revision != 4 {
+		t.Errorf("current version %+v", cur)
+	}
+}
@@ -0,0 +1,238 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// group is a row of the router_groups table, parent is NULL for a root
+type group struct {
+	tableName struct{} `pg:"router_groups"`
+	Tenant    string   `pg:",pk"`
+	ID        string   `pg:",pk"`
+	Name      string
+	Parent    string
+}
+
+func (g group) toDomain() domain.Group {
+	return domain.Group{ID: g.ID, Name: g.Name, Parent: g.Parent}
+}
+
+// Groups returns the groups of the tenant
+func (p *Postgres) Groups(ctx context.Context, tenant string) ([]domain.Group, error) {
+	return groupsOf(ctx, p.db, tenant, "")
+}
+
+// groupsOf reads the groups of the tenant, lock is a row lock such as "UPDATE" or "SHARE"
+func groupsOf(ctx context.Context, db orm.DB, tenant string, lock string) ([]domain.Group, error) {
+	var rows []group
+
+	q := db.ModelContext(ctx, &rows).Where("tenant = ?", tenant)
+	if lock != "" {
+		q = q.For(lock)
+	}
+	err := q.Select()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.Group, len(rows))
+	for i, g := range rows {
+		res[i] = g.toDomain()
+	}
+	return res, nil
+}
+
+// GroupCounts returns the number of routers of each group, the sub-groups are not counted
+func (p *Postgres) GroupCounts(ctx context.Context, tenant string) (map[string]int, error) {
+	var counts []struct {
+		GroupID string
+		Count   int
+	}
+
+	err := p.db.ModelContext(ctx, (*router)(nil)).
+		ColumnExpr("group_id, count(*) AS count").
+		Where("tenant = ?", tenant).
+		Where("group_id IS NOT NULL").
+		Apply(live).
+		Group("group_id").
+		Select(&counts)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]int, len(counts))
+	for _, c := range counts {
+		res[c.GroupID] = c.Count
+	}
+	return res, nil
+}
+
+// SaveGroup creates or replaces a group, its parent must exist
+func (p *Postgres) SaveGroup(ctx context.Context, g domain.Group, tenant string) error {
+	return p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		// the groups of the tenant cannot change until the cycle check is committed
+		groups, err := groupsOf(ctx, tx, tenant, "UPDATE")
+		if err != nil {
+			return err
+		}
+		err = domain.CheckGroup(groups, g)
+		if err != nil {
+			return err
+		}
+		row := group{Tenant: tenant, ID: g.ID, Name: g.Name, Parent: g.Parent}
+		_, err = tx.ModelContext(ctx, &row).
+			OnConflict("(tenant, id) DO UPDATE").
+			Set("name = EXCLUDED.name, parent = EXCLUDED.parent").
+			Insert()
+		return err
+	})
+}
+
+// DeleteGroup removes a group without sub-group nor router, the tombstones are not changed and
+// a router of the group is restored without group
+func (p *Postgres) DeleteGroup(ctx context.Context, id string, tenant string) error {
+	return p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var row group
+
+		err := tx.ModelContext(ctx, &row).
+			Where("tenant = ?", tenant).
+			Where("id = ?", id).
+			For("UPDATE").
+			Select()
+		if err == pg.ErrNoRows {
+			return fmt.Errorf("%w: group %s", domain.ErrNotFound, id)
+		}
+		if err != nil {
+			return err
+		}
+		n, err := tx.ModelContext(ctx, (*group)(nil)).Where("tenant = ?", tenant).Where("parent = ?", id).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%w: group %s has %d sub-group(s)", domain.ErrGroupNotEmpty, id, n)
+		}
+		n, err = tx.ModelContext(ctx, (*router)(nil)).Where("tenant = ?", tenant).Where("group_id = ?", id).Apply(live).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%w: group %s has %d router(s)", domain.ErrGroupNotEmpty, id, n)
+		}
+		_, err = tx.ModelContext(ctx, &row).WherePK().Delete()
+		return err
+	})
+}
+
+// Assign moves the routers with the given serials to group, an empty group removes them from
+// their group. The routers are returned with their new revision, unknown serials are ignored.
+func (p *Postgres) Assign(ctx context.Context, serials []string, groupID string, tenant string) ([]domain.Router, error) {
+	var res []domain.Router
+
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var (
+			entries []domain.AuditEntry
+			g       group
+		)
+
+		res = nil
+		if groupID != "" {
+			// the group cannot be deleted until the routers are moved
+			err := tx.ModelContext(ctx, &g).
+				Where("tenant = ?", tenant).
+				Where("id = ?", groupID).
+				For("SHARE").
+				Select()
+			if err == pg.ErrNoRows {
+				return fmt.Errorf("%w: %s", domain.ErrUnknownGroup, groupID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, serial := range serials {
+			before, ok, err := lockRouter(ctx, tx, serial, tenant)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			after := before.Router
+			if before.Group != groupID {
+				after.Group = groupID
+				after.Revision++
+				_, err = tx.ModelContext(ctx, (*router)(nil)).
+					Set("group_id = NULLIF(?, ''), revision = ?", groupID, after.Revision).
+					Where("router_serial = ?", serial).
+					Where("tenant = ?", tenant).
+					Apply(live).
+					Update()
+				if err != nil {
+					return err
+				}
+				e := domain.Audit(ctx, tenant, domain.AuditUpdate, &before.Router, &after)
+				err = openVersion(ctx, tx, tenant, after, e.Time)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, e)
+			}
+			res = append(res, after)
+		}
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkGroups fails when a router refers to a group that does not exist, the groups are locked
+// until the end of the transaction so that they cannot be deleted meanwhile
+func checkGroups(ctx context.Context, tx *pg.Tx, tenant string, routers []domain.Router) error {
+	var (
+		ids   []string
+		found []group
+	)
+	seen := make(map[string]bool)
+	for _, r := range routers {
+		if r.Group != "" && !seen[r.Group] {
+			seen[r.Group] = true
+			ids = append(ids, r.Group)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	err := tx.ModelContext(ctx, &found).
+		Where("tenant = ?", tenant).
+		Where("id IN (?)", pg.In(ids)).
+		For("SHARE").
+		Select()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(found))
+	for _, g := range found {
+		exists[g.ID] = true
+	}
+	for _, r := range routers {
+		if r.Group != "" && !exists[r.Group] {
+			return fmt.Errorf("%w: %s of router %s", domain.ErrUnknownGroup, r.Group, r.RouterSerial)
+		}
+	}
+	return nil
+}
+
+// inGroups keeps the routers of the group ids, nil ids keeps every router
+func inGroups(ids []string) func(q *orm.Query) (*orm.Query, error) {
+	return func(q *orm.Query) (*orm.Query, error) {
+		if ids == nil {
+			return q, nil
+		}
+		return q.Where("group_id IN (?)", pg.In(ids)), nil
+	}
+}
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"reflect"
+	"testing"
+)
+
+// groupFleet migrates the test database and stores the routers S1 and S2 of acme, labelled and
+// assigned to the group eu
+func groupFleet(t *testing.T) *Postgres {
+	t.Helper()
+	ctx := context.Background()
+	p := testDB(t)
+	if _, err := p.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add(ctx, []domain.Router{{RouterSerial: "S1"}, {RouterSerial: "S2"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SaveGroup(ctx, domain.Group{ID: "eu"}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Assign(ctx, []string{"S1", "S2"}, "eu", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Label(ctx, []string{"S1", "S2"}, domain.LabelChange{Set: map[string]string{"ring": "canary"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUpdateKeepsLabels(t *testing.T) {
+	ctx := context.Background()
+	p := groupFleet(t)
+
+	// the labels and the group are changed by Label and Assign only
+	r, err := p.Update(ctx, domain.Router{RouterSerial: "S1", OperatorName: "op", Labels: map[string]string{"ring": "stable"}, Group: "us"}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := p.GetRouter(ctx, domain.Router{RouterSerial: "S1"}, "acme")
+	for _, got := range []domain.Router{r, stored} {
+		if !reflect.DeepEqual(got.Labels, map[string]string{"ring": "canary"}) || got.Group != "eu" || got.OperatorName != "op" || got.Revision != 4 {
+			t.Errorf("unexpected router %+v", got)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"time"
+)
+
+// routerVersion is a row of the router_history table, valid_to is NULL for the current version
+type routerVersion struct {
+	tableName    struct{} `pg:"router_history"`
+	Tenant       string   `pg:",pk"`
+	RouterSerial string   `pg:",pk"`
+	Version      int      `pg:",pk"`
+	ValidFrom    time.Time
+	ValidTo      time.Time
+	Router       domain.Router `pg:"type:jsonb"`
+}
+
+func (v routerVersion) toDomain() domain.RouterVersion {
+	res := domain.RouterVersion{Version: v.Version, ValidFrom: v.ValidFrom, Router: v.Router}
+	if !v.ValidTo.IsZero() {
+		to := v.ValidTo
+		res.ValidTo = &to
+	}
+	return res
+}
+
+// openVersion closes the current version of the router and starts a new one at t, in the
+// transaction of the change
+func openVersion(ctx context.Context, tx *pg.Tx, tenant string, r domain.Router, t time.Time) error {
+	err := closeVersion(ctx, tx, tenant, r.RouterSerial, t)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO router_history (tenant, router_serial, version, valid_from, router)
+SELECT ?, ?, coalesce(max(version), 0) + 1, ?, ?::jsonb FROM router_history WHERE tenant = ? AND router_serial = ?`,
+		tenant, r.RouterSerial, t, string(b), tenant, r.RouterSerial)
+	return err
+}
+
+// closeVersion ends the current version of the router at t
+func closeVersion(ctx context.Context, tx *pg.Tx, tenant string, serial string, t time.Time) error {
+	_, err := tx.ModelContext(ctx, (*routerVersion)(nil)).
+		Set("valid_to = ?", t).
+		Where("tenant = ?", tenant).
+		Where("router_serial = ?", serial).
+		Where("valid_to IS NULL").
+		Update()
+	return err
+}
+
+// RouterHistory returns the versions of the router, oldest first
+func (p *Postgres) RouterHistory(ctx context.Context, serial string, tenant string) ([]domain.RouterVersion, error) {
+	var rows []routerVersion
+
+	err := p.db.ModelContext(ctx, &rows).
+		Where("tenant = ?", tenant).
+		Where("router_serial = ?", serial).
+		Order("version").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.RouterVersion, len(rows))
+	for i, r := range rows {
+		res[i] = r.toDomain()
+	}
+	return res, nil
+}
+
+// RouterAt returns the version of the router valid at t, nil when the router did not exist
+func (p *Postgres) RouterAt(ctx context.Context, serial string, tenant string, t time.Time) (*domain.RouterVersion, error) {
+	var row routerVersion
+
+	err := p.db.ModelContext(ctx, &row).
+		Where("tenant = ?", tenant).
+		Where("router_serial = ?", serial).
+		Where("valid_from <= ?", t).
+		Where("valid_to IS NULL OR valid_to > ?", t).
+		Limit(1).
+		Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v := row.toDomain()
+	return &v, nil
+}
@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"time"
+)
+
+// idempotencyKey is a row of the idempotency_keys table
+type idempotencyKey struct {
+	tableName   struct{} `pg:"idempotency_keys"`
+	Tenant      string   `pg:",pk"`
+	Key         string   `pg:",pk"`
+	Operation   string
+	RequestHash string
+	Done        bool `pg:",use_zero"`
+	Version     int
+	Response    []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// ClaimIdempotencyKey records rec as pending unless a live record exists for the same tenant
+// and key, in which case the existing record is returned and claimed is false. Expired records
+// are replaced.
+func (p *Postgres) ClaimIdempotencyKey(ctx context.Context, rec domain.IdempotencyRecord) (domain.IdempotencyRecord, bool, error) {
+	row := idempotencyKey{
+		Tenant:      rec.Tenant,
+		Key:         rec.Key,
+		Operation:   rec.Operation,
+		RequestHash: rec.RequestHash,
+		Version:     rec.Version,
+		CreatedAt:   rec.CreatedAt,
+		ExpiresAt:   rec.ExpiresAt,
+	}
+	res, err := p.db.ModelContext(ctx, &row).
+		OnConflict("(tenant, key) DO UPDATE").
+		Set("operation = EXCLUDED.operation, request_hash = EXCLUDED.request_hash, done = false, " +
+			"version = EXCLUDED.version, response = NULL, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at").
+		Where("idempotency_key.expires_at < now()").
+		Insert()
+	if err != nil {
+		return rec, false, err
+	}
+	if res.RowsAffected() > 0 {
+		return rec, true, nil
+	}
+
+	err = p.db.ModelContext(ctx, &row).WherePK().Select()
+	if err == pg.ErrNoRows {
+		// expired and purged in between, the caller retries as a new request
+		return rec, false, err
+	}
+	if err != nil {
+		return rec, false, err
+	}
+	return domain.IdempotencyRecord{
+		Tenant:      row.Tenant,
+		Key:         row.Key,
+		Operation:   row.Operation,
+		RequestHash: row.RequestHash,
+		Done:        row.Done,
+		Version:     row.Version,
+		Response:    row.Response,
+		CreatedAt:   row.CreatedAt,
+		ExpiresAt:   row.ExpiresAt,
+	}, false, nil
+}
+
+// CompleteIdempotencyKey stores the reply of a claimed key
+func (p *Postgres) CompleteIdempotencyKey(ctx context.Context, rec domain.IdempotencyRecord) error {
+	_, err := p.db.ModelContext(ctx, (*idempotencyKey)(nil)).
+		Set("done = true, response = ?", rec.Response).
+		Where("tenant = ?", rec.Tenant).
+		Where("key = ?", rec.Key).
+		Update()
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claimed key whose request failed, a retry runs it again
+func (p *Postgres) ReleaseIdempotencyKey(ctx context.Context, tenant string, key string) error {
+	_, err := p.db.ModelContext(ctx, (*idempotencyKey)(nil)).
+		Where("tenant = ?", tenant).
+		Where("key = ?", key).
+		Where("done = false").
+		Delete()
+	return err
+}
+
+// PurgeIdempotencyKeys deletes the expired records and returns how many were deleted
+func (p *Postgres) PurgeIdempotencyKeys(ctx context.Context) (int, error) {
+	res, err := p.db.ModelContext(ctx, (*idempotencyKey)(nil)).
+		Where("expires_at < now()").
+		Delete()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	s := testDB(t)
+	if _, err := s.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rec := func(tenant string, key string, hash string, expires time.Duration) domain.IdempotencyRecord {
+		return domain.IdempotencyRecord{Tenant: tenant, Key: key, Operation: "write", RequestHash: hash, Version: 1, CreatedAt: now, ExpiresAt: now.Add(expires)}
+	}
+	claim := func(r domain.IdempotencyRecord) (domain.IdempotencyRecord, bool) {
+		t.Helper()
+		cur, claimed, err := s.ClaimIdempotencyKey(ctx, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cur, claimed
+	}
+
+	if _, claimed := claim(rec("acme", "k1", "h1", time.Hour)); !claimed {
+		t.Fatal("new key not claimed")
+	}
+	// a concurrent request sees the pending claim
+	cur, claimed := claim(rec("acme", "k1", "h1", time.Hour))
+	if claimed || cur.Done || cur.RequestHash != "h1" {
+		t.Fatalf("pending key claimed %v: %+v", claimed, cur)
+	}
+	// the same key with another request returns the first one, the caller compares the hashes
+	if cur, claimed = claim(rec("acme", "k1", "h2", time.Hour)); claimed || cur.RequestHash != "h1" {
+		t.Fatalf("key reused with another request claimed %v: %+v", claimed, cur)
+	}
+	// the keys are per tenant
+	if _, claimed = claim(rec("other", "k1", "h2", time.Hour)); !claimed {
+		t.Fatal("key of another tenant not claimed")
+	}
+
+	// released after a failure, the retry runs again
+	if err := s.ReleaseIdempotencyKey(ctx, "acme", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, claimed = claim(rec("acme", "k1", "h1", time.Hour)); !claimed {
+		t.Fatal("released key not claimed")
+	}
+
+	// completed, the reply is replayed and cannot be released
+	done := rec("acme", "k1", "h1", time.Hour)
+	done.Response = []byte("sucess!")
+	if err := s.CompleteIdempotencyKey(ctx, done); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReleaseIdempotencyKey(ctx, "acme", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if cur, claimed = claim(rec("acme", "k1", "h1", time.Hour)); claimed || !cur.Done || string(cur.Response) != "sucess!" {
+		t.Fatalf("completed key claimed %v: %+v", claimed, cur)
+	}
+
+	// an expired key is claimed again by the next request
+	claim(rec("acme", "k2", "h1", -time.Second))
+	if cur, claimed = claim(rec("acme", "k2", "h2", time.Hour)); !claimed || cur.RequestHash != "h2" {
+		t.Fatalf("expired key claimed %v: %+v", claimed, cur)
+	}
+
+	claim(rec("acme", "k3", "h1", -time.Second))
+	if n, err := s.PurgeIdempotencyKeys(ctx); err != nil || n != 1 {
+		t.Errorf("%d keys purged: %v", n, err)
+	}
+	if _, claimed = claim(rec("acme", "k1", "h1", time.Hour)); claimed {
+		t.Errorf("live key purged")
+	}
+}
@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// selector filters the routers by label. Equality and set membership use the GIN index of the
+// labels column (@> containment), the existence tests and the negations scan the tenant rows.
+func selector(sel domain.Selector) func(q *orm.Query) (*orm.Query, error) {
+	return func(q *orm.Query) (*orm.Query, error) {
+		for _, r := range sel {
+			contains, err := containment(r)
+			if err != nil {
+				return nil, err
+			}
+			switch r.Operator {
+			case domain.SelectorExists:
+				q = q.Where("jsonb_exists(labels, ?)", r.Key)
+			case domain.SelectorNotExists:
+				q = q.Where("labels IS NULL OR NOT jsonb_exists(labels, ?)", r.Key)
+			case domain.SelectorEquals, domain.SelectorIn:
+				q = q.WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+					for _, c := range contains {
+						q = q.WhereOr("labels @> ?::jsonb", c)
+					}
+					return q, nil
+				})
+			case domain.SelectorNotEquals, domain.SelectorNotIn:
+				q = q.Where("labels IS NULL OR NOT labels @> ANY (?::jsonb[])", pg.Array(contains))
+			}
+		}
+		return q, nil
+	}
+}
+
+// containment returns the {"key": "value"} documents of the values of the requirement
+func containment(r domain.Requirement) ([]string, error) {
+	res := make([]string, len(r.Values))
+	for i, v := range r.Values {
+		b, err := json.Marshal(map[string]string{r.Key: v})
+		if err != nil {
+			return nil, err
+		}
+		res[i] = string(b)
+	}
+	return res, nil
+}
+
+// labelsJSON returns the document stored in the labels column, NULL when there is no label
+func labelsJSON(labels map[string]string) interface{} {
+	if len(labels) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(labels)
+	return string(b)
+}
+
+// Label changes the labels of the routers with the given serials and returns them with their new
+// labels and revision, unknown serials are ignored. The routers are changed in one transaction.
+func (p *Postgres) Label(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error) {
+	var res []domain.Router
+
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var entries []domain.AuditEntry
+
+		res = nil
+		for _, serial := range serials {
+			before, ok, err := lockRouter(ctx, tx, serial, tenant)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			after := before.Router
+			labels, changed := change.Apply(before.Labels)
+			if changed {
+				after.Labels = labels
+				after.Revision++
+				_, err = tx.ModelContext(ctx, (*router)(nil)).
+					Set("labels = ?::jsonb, revision = ?", labelsJSON(labels), after.Revision).
+					Where("router_serial = ?", serial).
+					Where("tenant = ?", tenant).
+					Apply(live).
+					Update()
+				if err != nil {
+					return err
+				}
+				e := domain.Audit(ctx, tenant, domain.AuditUpdate, &before.Router, &after)
+				err = openVersion(ctx, tx, tenant, after, e.Time)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, e)
+			}
+			res = append(res, after)
+		}
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
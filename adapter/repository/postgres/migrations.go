@@ -0,0 +1,304 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"time"
+)
+
+// Migration is one step of the database schema, migrations are applied in Version order
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is returned by MigrationStatus
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrations must only be appended, never edited once released
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create routers",
+		Up: `CREATE TABLE IF NOT EXISTS routers (
+	router_id uuid,
+	router_serial text,
+	operator_name text,
+	iso_country_code text,
+	mac text,
+	router_model text,
+	account_id text,
+	agent_last_connection text,
+	agent_version text
+)`,
+		Down: `DROP TABLE IF EXISTS routers`,
+	},
+	{
+		Version: 2,
+		Name:    "routers tenant",
+		// the serials and the ids are unique per tenant, a serial used by a tenant, even
+		// deleted, does not prevent another tenant from creating it
+		Up: `ALTER TABLE routers ADD COLUMN IF NOT EXISTS tenant text NOT NULL DEFAULT 'test';
+ALTER TABLE routers ADD CONSTRAINT routers_tenant_serial_key UNIQUE (tenant, router_serial);
+ALTER TABLE routers ADD CONSTRAINT routers_tenant_id_key UNIQUE (tenant, router_id)`,
+		Down: `ALTER TABLE routers DROP CONSTRAINT IF EXISTS routers_tenant_id_key;
+ALTER TABLE routers DROP CONSTRAINT IF EXISTS routers_tenant_serial_key;
+ALTER TABLE routers DROP COLUMN IF EXISTS tenant`,
+	},
+	{
+		Version: 3,
+		Name:    "idempotency keys",
+		Up: `CREATE TABLE IF NOT EXISTS idempotency_keys (
+	tenant text NOT NULL,
+	key text NOT NULL,
+	operation text NOT NULL,
+	request_hash text NOT NULL,
+	done boolean NOT NULL DEFAULT false,
+	version integer NOT NULL DEFAULT 1,
+	response bytea,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	expires_at timestamptz NOT NULL,
+	PRIMARY KEY (tenant, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at)`,
+		Down: `DROP TABLE IF EXISTS idempotency_keys`,
+	},
+	{
+		Version: 4,
+		Name:    "router quotas",
+		Up: `CREATE TABLE IF NOT EXISTS quotas (
+	tenant text NOT NULL,
+	account_id text NOT NULL DEFAULT '',
+	max_routers integer NOT NULL,
+	PRIMARY KEY (tenant, account_id)
+);
+CREATE INDEX IF NOT EXISTS routers_account_idx ON routers (tenant, account_id)`,
+		Down: `DROP INDEX IF EXISTS routers_account_idx;
+DROP TABLE IF EXISTS quotas`,
+	},
+	{
+		Version: 5,
+		Name:    "audit log",
+		Up: `CREATE TABLE IF NOT EXISTS audit_log (
+	id bigserial PRIMARY KEY,
+	time timestamptz NOT NULL DEFAULT now(),
+	tenant text NOT NULL,
+	actor text NOT NULL,
+	request_id text NOT NULL DEFAULT '',
+	action text NOT NULL,
+	router_serial text NOT NULL,
+	before jsonb,
+	after jsonb
+);
+CREATE INDEX IF NOT EXISTS audit_log_router_idx ON audit_log (tenant, router_serial, time);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (tenant, actor, time);
+CREATE INDEX IF NOT EXISTS audit_log_time_idx ON audit_log (tenant, time);
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append only';
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+		Down: `DROP TABLE IF EXISTS audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only()`,
+	},
+	{
+		Version: 6,
+		Name:    "router history",
+		Up: `CREATE TABLE IF NOT EXISTS router_history (
+	tenant text NOT NULL,
+	router_serial text NOT NULL,
+	version integer NOT NULL,
+	valid_from timestamptz NOT NULL,
+	valid_to timestamptz,
+	router jsonb NOT NULL,
+	PRIMARY KEY (tenant, router_serial, version)
+);
+CREATE INDEX IF NOT EXISTS router_history_at_idx ON router_history (tenant, router_serial, valid_from);
+INSERT INTO router_history (tenant, router_serial, version, valid_from, router)
+SELECT tenant, router_serial, 1, now(), jsonb_build_object(
+	'router-id', coalesce(router_id::text, ''),
+	'router-serial', router_serial,
+	'operator-name', coalesce(operator_name, ''),
+	'iso-country-code', coalesce(iso_country_code, ''),
+	'mac', coalesce(mac, ''),
+	'router-model', coalesce(router_model, ''),
+	'account-id', coalesce(account_id, ''),
+	'agent-last-connection', coalesce(agent_last_connection, ''),
+	'agent-version', coalesce(agent_version, ''))
+FROM routers
+ON CONFLICT DO NOTHING`,
+		Down: `DROP TABLE IF EXISTS router_history`,
+	},
+	{
+		Version: 7,
+		Name:    "routers tombstones",
+		Up: `ALTER TABLE routers ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+ALTER TABLE routers ADD COLUMN IF NOT EXISTS deleted_by text;
+CREATE INDEX IF NOT EXISTS routers_deleted_idx ON routers (tenant, deleted_at) WHERE deleted_at IS NOT NULL`,
+		Down: `DELETE FROM routers WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS routers_deleted_idx;
+ALTER TABLE routers DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE routers DROP COLUMN IF EXISTS deleted_at`,
+	},
+	{
+		Version: 8,
+		Name:    "routers revision",
+		Up:      `ALTER TABLE routers ADD COLUMN IF NOT EXISTS revision integer NOT NULL DEFAULT 1`,
+		Down:    `ALTER TABLE routers DROP COLUMN IF EXISTS revision`,
+	},
+	{
+		Version: 9,
+		Name:    "routers labels",
+		Up: `ALTER TABLE routers ADD COLUMN IF NOT EXISTS labels jsonb;
+CREATE INDEX IF NOT EXISTS routers_labels_idx ON routers USING gin (labels)`,
+		Down: `DROP INDEX IF EXISTS routers_labels_idx;
+ALTER TABLE routers DROP COLUMN IF EXISTS labels`,
+	},
+	{
+		Version: 10,
+		Name:    "router groups",
+		Up: `CREATE TABLE IF NOT EXISTS router_groups (
+	tenant text NOT NULL,
+	id text NOT NULL,
+	name text,
+	parent text,
+	PRIMARY KEY (tenant, id),
+	FOREIGN KEY (tenant, parent) REFERENCES router_groups (tenant, id)
+);
+CREATE INDEX IF NOT EXISTS router_groups_parent_idx ON router_groups (tenant, parent);
+ALTER TABLE routers ADD COLUMN IF NOT EXISTS group_id text;
+CREATE INDEX IF NOT EXISTS routers_group_idx ON routers (tenant, group_id) WHERE group_id IS NOT NULL`,
+		Down: `DROP INDEX IF EXISTS routers_group_idx;
+ALTER TABLE routers DROP COLUMN IF EXISTS group_id;
+DROP TABLE IF EXISTS router_groups`,
+	},
+	{
+		Version: 11,
+		Name:    "router lifecycle",
+		// the routers existing before the lifecycle are in service
+		Up: `ALTER TABLE routers ADD COLUMN IF NOT EXISTS state text;
+ALTER TABLE routers ADD COLUMN IF NOT EXISTS state_since timestamptz;
+ALTER TABLE routers ADD COLUMN IF NOT EXISTS state_reason text;
+UPDATE routers SET state = 'active' WHERE state IS NULL;
+CREATE INDEX IF NOT EXISTS routers_state_idx ON routers (tenant, state)`,
+		Down: `DROP INDEX IF EXISTS routers_state_idx;
+ALTER TABLE routers DROP COLUMN IF EXISTS state_reason;
+ALTER TABLE routers DROP COLUMN IF EXISTS state_since;
+ALTER TABLE routers DROP COLUMN IF EXISTS state`,
+	},
+}
+
+const migrationTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+type appliedMigration struct {
+	tableName struct{} `pg:"schema_migrations"`
+	Version   int      `pg:",pk"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (p *Postgres) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	var (
+		rows []appliedMigration
+		res  map[int]appliedMigration
+		err  error
+	)
+	_, err = p.db.ExecContext(ctx, migrationTable)
+	if err != nil {
+		return nil, err
+	}
+	err = p.db.ModelContext(ctx, &rows).Select()
+	if err != nil {
+		return nil, err
+	}
+	res = make(map[int]appliedMigration, len(rows))
+	for _, r := range rows {
+		res[r.Version] = r
+	}
+	return res, nil
+}
+
+// MigrateUp applies every pending migration, each one in its own transaction
+func (p *Postgres) MigrateUp(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	applied, err := p.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err = p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+			if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+				return err
+			}
+			_, err := tx.ModelContext(ctx, &appliedMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Insert()
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the last applied migration, it returns nil when there is nothing to revert
+func (p *Postgres) MigrateDown(ctx context.Context) (*Migration, error) {
+	applied, err := p.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err = p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+			if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+				return err
+			}
+			_, err := tx.ModelContext(ctx, &appliedMigration{Version: m.Version}).WherePK().Delete()
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		return &m, nil
+	}
+	return nil, nil
+}
+
+// MigrationStatus lists every known migration and whether it has been applied
+func (p *Postgres) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	var res []MigrationState
+
+	applied, err := p.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		a, ok := applied[m.Version]
+		res = append(res, MigrationState{
+			Migration: m,
+			Applied:   ok,
+			AppliedAt: a.AppliedAt,
+		})
+	}
+	return res, nil
+}
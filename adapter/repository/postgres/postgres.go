@@ -2,22 +2,17 @@ package postgres
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"github.com/Go-routine-4995/routermgt/domain"
 	"github.com/go-pg/pg/v10"
 	"github.com/go-pg/pg/v10/orm"
-	"log"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
+	"time"
 )
 
 type Rule struct {
 	Id       int    `pg:",pk"`
-	RuleID   string `json:"action" pg:"type:uuid""`
+	RuleID   string `json:"action" pg:"type:uuid"`
 	RuleByte []byte `json:"condition"`
 }
 
@@ -27,8 +22,16 @@ type Profile struct {
 	Rules []string `json:"rules"`
 }
 
-type Postgres struct {
-	db         *pg.DB
+// TLS modes, they mirror libpq sslmode
+const (
+	TLSDisable    = "disable"
+	TLSRequire    = "require"
+	TLSVerifyCA   = "verify-ca"
+	TLSVerifyFull = "verify-full"
+)
+
+// Options of the connection, an empty TLSMode means verify-full
+type Options struct {
 	Address    string
 	User       string
 	Password   string
@@ -36,94 +39,290 @@ type Postgres struct {
 	ClientCert string
 	ClientKey  string
 	ServerCert string
-	wg         *sync.WaitGroup
+	TLSMode    string
+	// ServerName checked by verify-full, the host of Address when empty
+	ServerName string
+
+	// pool, zero values keep the go-pg defaults
+	PoolSize     int
+	MinIdleConns int
+	MaxConnAge   time.Duration
+	IdleTimeout  time.Duration
+	PoolTimeout  time.Duration
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// ConnectAttempts of the initial connection, 0 retries until the database answers
+	ConnectAttempts int
+	// RetryBackoff is the first delay between two attempts, it doubles up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// QueryRetries on network errors, only for idempotent statements
+	QueryRetries int
+}
+
+// PoolStats is reported by the status endpoint
+type PoolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total-conns"`
+	IdleConns  uint32 `json:"idle-conns"`
+	StaleConns uint32 `json:"stale-conns"`
 }
 
-func NewPostgres(address string, user string, password string, database string, clCert string, clKey string, serCert string, wg *sync.WaitGroup) *Postgres {
+const (
+	defaultRetryBackoff    = 500 * time.Millisecond
+	defaultMaxRetryBackoff = 30 * time.Second
+	defaultPingTimeout     = 5 * time.Second
+)
+
+type Postgres struct {
+	db    *pg.DB
+	mu    sync.Mutex // guards opts, updated by ReloadTLS
+	opts  Options
+	certs *certStore
+}
+
+// NewPostgres fails when the configured certificates cannot be loaded, the connection is never
+// opened without the requested TLS verification. The database is pinged with an exponential
+// backoff until it answers or o.ConnectAttempts is reached.
+func NewPostgres(o Options) (*Postgres, error) {
 
 	var (
-		conf *tls.Config
-		db   *pg.DB
-		ctx  context.Context
-		err  error
+		certs   *certStore
+		db      *pg.DB
+		err     error
+		backoff time.Duration
 	)
 
-	conf = ConfTLS(clCert, clKey, serCert)
-	db = pg.Connect(&pg.Options{
-		Addr:      address,
-		User:      user,
-		Password:  password,
-		Database:  database,
-		TLSConfig: conf,
+	certs, err = newCertStore(o)
+	if err != nil {
+		return nil, err
+	}
+	db = connect(o, certs)
+
+	backoff = o.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := o.MaxRetryBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = ping(db, o.DialTimeout)
+		if err == nil {
+			break
+		}
+		if o.ConnectAttempts > 0 && attempt >= o.ConnectAttempts {
+			_ = db.Close()
+			return nil, fmt.Errorf("database %s unreachable after %d attempt(s): %w", o.Address, attempt, err)
+		}
+		fmt.Printf("database %s unreachable (attempt %d): %v, retrying in %s\n", o.Address, attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	return &Postgres{
+		db:    db,
+		opts:  o,
+		certs: certs,
+	}, nil
+}
+
+func ping(db *pg.DB, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return db.Ping(ctx)
+}
+
+func connect(o Options, certs *certStore) *pg.DB {
+	return pg.Connect(&pg.Options{
+		Addr:            o.Address,
+		User:            o.User,
+		Password:        o.Password,
+		Database:        o.Database,
+		TLSConfig:       certs.tlsConfig(),
+		PoolSize:        o.PoolSize,
+		MinIdleConns:    o.MinIdleConns,
+		MaxConnAge:      o.MaxConnAge,
+		IdleTimeout:     o.IdleTimeout,
+		PoolTimeout:     o.PoolTimeout,
+		DialTimeout:     o.DialTimeout,
+		ReadTimeout:     o.ReadTimeout,
+		WriteTimeout:    o.WriteTimeout,
+		MaxRetries:      o.QueryRetries,
+		MinRetryBackoff: o.RetryBackoff,
+		MaxRetryBackoff: o.MaxRetryBackoff,
 	})
+}
 
-	ctx = context.Background()
-	err = db.Ping(ctx)
+// Stats returns the connection pool counters
+func (p *Postgres) Stats() PoolStats {
+	st := p.db.PoolStats()
+	return PoolStats{
+		Hits:       st.Hits,
+		Misses:     st.Misses,
+		Timeouts:   st.Timeouts,
+		TotalConns: st.TotalConns,
+		IdleConns:  st.IdleConns,
+		StaleConns: st.StaleConns,
+	}
+}
+
+// Ping checks that the database answers, it is used by the readiness probe
+func (p *Postgres) Ping(ctx context.Context) error {
+	return p.db.Ping(ctx)
+}
 
+// Check opens a connection to the database and pings it, it is used to validate a configuration
+func Check(ctx context.Context, o Options) error {
+	certs, err := newCertStore(o)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(0)
+		return err
 	}
+	db := connect(o, certs)
+	defer db.Close()
 
-	// trap SIGINT / SIGTERM to exit cleanly
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT)
-	signal.Notify(c, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("Shutting down DB...")
-		_ = db.Close()
-		fmt.Println("BD connection closed gracefully")
-		wg.Done()
-	}()
+	return db.Ping(ctx)
+}
 
-	return &Postgres{
-		db:         db,
-		Address:    address,
-		User:       user,
-		Password:   password,
-		Database:   database,
-		ClientCert: clCert,
-		ClientKey:  clKey,
-		ServerCert: serCert,
-		wg:         wg,
+// Close the connection pool, the API must be stopped first
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// router is a row of the routers table, routers are scoped by tenant. A deleted router is kept
+// as a tombstone (deleted_at is set) until it is purged.
+type router struct {
+	tableName struct{} `pg:"routers"`
+	domain.Router
+	Tenant    string
+	DeletedAt time.Time
+	DeletedBy string
+}
+
+// live excludes the tombstones
+func live(q *orm.Query) (*orm.Query, error) {
+	return q.Where("deleted_at IS NULL"), nil
+}
+
+// inStates keeps the routers in one of the states, nil keeps every router
+func inStates(states []string) func(q *orm.Query) (*orm.Query, error) {
+	return func(q *orm.Query) (*orm.Query, error) {
+		if states == nil {
+			return q, nil
+		}
+		return q.Where("state IN (?)", pg.In(states)), nil
 	}
 }
 
-// Add a list of router and return a list of routers that are already in the DB
-func (p *Postgres) Add(routes []domain.Router, tenant string) *[]domain.Router {
+func toDomain(rows []router) []domain.Router {
+	res := make([]domain.Router, len(rows))
+	for i, r := range rows {
+		res[i] = r.Router
+	}
+	return res
+}
+
+// Add a list of router and return a list of routers that are already in the DB. The routers are
+// inserted in one transaction holding the quotas of the tenant, nothing is added when a quota
+// would be exceeded.
+func (p *Postgres) Add(ctx context.Context, routes []domain.Router, tenant string) (*[]domain.Router, error) {
 	var (
 		err        error
-		r          domain.Router
-		res        orm.Result
 		resRouters *[]domain.Router
 	)
 
-	for _, v := range routes {
-		r = v
-		res, err = p.db.Model(&r).
-			OnConflict("DO NOTHING").
-			Insert()
+	err = p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var (
+			quotas []quota
+			added  []domain.Router
+			r      router
+			res    orm.Result
+			err    error
+		)
+		// concurrent Add of the tenant wait here, the counts below cannot change under us
+		err = tx.ModelContext(ctx, &quotas).Where("tenant = ?", tenant).For("UPDATE").Select()
 		if err != nil {
-			fmt.Println(err)
+			return err
+		}
+
+		for _, v := range routes {
+			v.Revision = 1
+			// creating a deleted router replaces its tombstone
+			_, err = tx.ModelContext(ctx, (*router)(nil)).
+				Where("tenant = ?", tenant).
+				Where("router_serial = ?", v.RouterSerial).
+				Where("deleted_at IS NOT NULL").
+				Delete()
+			if err != nil {
+				return err
+			}
+			r = router{Router: v, Tenant: tenant}
+			res, err = tx.ModelContext(ctx, &r).
+				OnConflict("DO NOTHING").
+				Insert()
+			if err != nil {
+				return err
+			}
+			if res.RowsAffected() <= 0 {
+				if resRouters == nil {
+					resRouters = new([]domain.Router)
+					*resRouters = make([]domain.Router, 0)
+				}
+				*resRouters = append(*resRouters, v)
+				fmt.Println("row already existing")
+				continue
+			}
+			added = append(added, v)
+		}
+
+		err = checkGroups(ctx, tx, tenant, added)
+		if err != nil {
+			return err
 		}
-		if res.RowsAffected() <= 0 {
-			if resRouters == nil {
-				resRouters = new([]domain.Router)
-				*resRouters = make([]domain.Router, 0)
+		err = checkQuotas(ctx, tx, quotas, added)
+		if err != nil {
+			return err
+		}
+		entries := make([]domain.AuditEntry, len(added))
+		for i := range added {
+			entries[i] = domain.Audit(ctx, tenant, domain.AuditCreate, nil, &added[i])
+			err = openVersion(ctx, tx, tenant, added[i], entries[i].Time)
+			if err != nil {
+				return err
 			}
-			*resRouters = append(*resRouters, v)
-			fmt.Println("row already existing")
 		}
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
 	}
 
-	return resRouters
+	return resRouters, nil
 }
 
 // GetPaged return a pointer of a slice of routers, and the total number of page with the given limit.
-func (p *Postgres) GetPaged(page domain.Pagination, tenant string) (*[]domain.Router, int) {
+// Only the routers matching page.Selector and in the subtree of page.Group are returned.
+func (p *Postgres) GetPaged(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error) {
 	var (
 		routers   *[]domain.Router
+		rows      []router
+		sel       domain.Selector
+		groups    []domain.Group
+		ids       []string
+		states    []string
 		err       error
 		count     int
 		ps        int
@@ -134,7 +333,30 @@ func (p *Postgres) GetPaged(page domain.Pagination, tenant string) (*[]domain.Ro
 	routers = new([]domain.Router)
 	*routers = make([]domain.Router, 0)
 
-	count, err = p.db.Model((*domain.Router)(nil)).Count()
+	sel, err = domain.ParseSelector(page.Selector)
+	if err != nil {
+		return nil, 0, err
+	}
+	states, err = domain.ParseStates(page.State)
+	if err != nil {
+		return nil, 0, err
+	}
+	if page.Group != "" {
+		groups, err = p.Groups(ctx, tenant)
+		if err != nil {
+			return nil, 0, err
+		}
+		// an unknown group has no router
+		ids = domain.Subtree(groups, page.Group)
+		if ids == nil {
+			return routers, -1, nil
+		}
+	}
+
+	count, err = p.db.ModelContext(ctx, (*router)(nil)).Where("tenant = ?", tenant).Apply(live).Apply(selector(sel)).Apply(inGroups(ids)).Apply(inStates(states)).Count()
+	if err != nil {
+		return nil, 0, err
+	}
 
 	ps = count / page.Limit
 	r = count % page.Limit
@@ -144,7 +366,7 @@ func (p *Postgres) GetPaged(page domain.Pagination, tenant string) (*[]domain.Ro
 
 	// we are out of range!
 	if (page.Page * page.Limit) > count {
-		return routers, ps - 1
+		return routers, ps - 1, nil
 	}
 
 	// /!\ p and page.Page index are different p [1..n] page.Page [0..n-1] page.Page is 0 indexed
@@ -152,73 +374,158 @@ func (p *Postgres) GetPaged(page domain.Pagination, tenant string) (*[]domain.Ro
 	// p == 1 && page.Limit > l we have only one page and the limit asked is bigger than the number of elements
 	// p == page.Limit + 1 && page.Limit > l this is the last page and there is fewer elements than the limit asked
 	if (ps == 1 && page.Limit > count) || (ps == page.Page+1 && page.Limit > count) {
-		*routers = make([]domain.Router, count)
 		fetchSize = count
 	} else {
-		*routers = make([]domain.Router, page.Limit)
 		fetchSize = page.Limit
 	}
 
-	// we need to find the right page in the DB to do so we are fetching one row (sorted by router_serial) the last row of a page
-	// if the last row of the page is smaller that the previous router_serial then we are in the right offset/page
-	err = p.db.Model(routers).Limit(fetchSize).Offset(ps - 1).Select()
+	// rows are sorted by router_serial so that consecutive pages are stable
+	err = p.db.ModelContext(ctx, &rows).
+		Where("tenant = ?", tenant).
+		Apply(live).
+		Apply(selector(sel)).
+		Apply(inGroups(ids)).
+		Apply(inStates(states)).
+		Order("router_serial").
+		Limit(fetchSize).
+		Offset(page.Page * page.Limit).
+		Select()
 	if err != nil {
-		fmt.Println(err)
+		return nil, 0, err
 	}
-	//for i, k := range receiver {
-	//	(*routers)[i] = k.Router
-	//}
+	*routers = toDomain(rows)
 
-	return routers, ps - 1
+	return routers, ps - 1, nil
 }
 
-func (p *Postgres) GetRouter(router domain.Router, tenant string) (domain.Router, bool) {
+func (p *Postgres) GetRouter(ctx context.Context, r domain.Router, tenant string) (domain.Router, bool) {
 	var (
-		res domain.Router
+		res router
 		err error
 	)
 
-	fmt.Println("GetRouter")
-	err = p.db.Model(&res).Where("router_serial = ?", res.RouterSerial).Limit(1).Select()
-	fmt.Printf("GetRouter returned: %+v \n", res)
+	err = p.db.ModelContext(ctx, &res).
+		Where("router_serial = ?", r.RouterSerial).
+		Where("tenant = ?", tenant).
+		Apply(live).
+		Limit(1).
+		Select()
 	if err != nil {
-		fmt.Println(err)
-		return res, false
+		if err != pg.ErrNoRows {
+			fmt.Println(err)
+		}
+		return res.Router, false
 	}
-	return res, true
+	return res.Router, true
 }
 
-func (p *Postgres) Delete(routers []domain.Router, tenant string) {
-	var (
-		router domain.Router
-		err    error
-	)
+// Delete the routers, they are kept as tombstones until purged, and record them in the audit
+// trail, in one transaction. Nothing is deleted when the revision of one of them does not match.
+func (p *Postgres) Delete(ctx context.Context, routers []domain.Router, tenant string) error {
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var entries []domain.AuditEntry
 
-	for _, k := range routers {
-		_, err = p.db.Model(&router).Where("router_serial =?", k.RouterSerial).Delete()
-		if err != nil {
-			fmt.Println(err)
+		for _, k := range routers {
+			current, ok, err := lockRouter(ctx, tx, k.RouterSerial, tenant)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			err = domain.CheckRevision(current.Router, k.Revision)
+			if err != nil {
+				return err
+			}
+			e := domain.Audit(ctx, tenant, domain.AuditDelete, &current.Router, nil)
+			_, err = tx.ModelContext(ctx, (*router)(nil)).
+				Set("deleted_at = ?, deleted_by = ?", e.Time, e.Actor).
+				Where("router_serial = ?", k.RouterSerial).
+				Where("tenant = ?", tenant).
+				Apply(live).
+				Update()
+			if err != nil {
+				return err
+			}
+			err = closeVersion(ctx, tx, tenant, k.RouterSerial, e.Time)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
 		}
+		return record(ctx, tx, entries)
+	})
+	if err != nil {
+		fmt.Println(err)
 	}
+	return err
 }
 
-func ConfTLS(clientCert string, clientKey string, serverCert string) *tls.Config {
-	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
-	if err != nil {
-		log.Println("failed to load client certificate: %v", err)
-	}
+// Update replaces the router with the same serial and returns it with its new revision
+func (p *Postgres) Update(ctx context.Context, r domain.Router, tenant string) (domain.Router, error) {
+	err := p.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var quotas []quota
 
-	CACert, err := os.ReadFile(serverCert)
+		err := tx.ModelContext(ctx, &quotas).Where("tenant = ?", tenant).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+		before, ok, err := lockRouter(ctx, tx, r.RouterSerial, tenant)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: router %s", domain.ErrNotFound, r.RouterSerial)
+		}
+		err = domain.CheckRevision(before.Router, r.Revision)
+		if err != nil {
+			return err
+		}
+		// the labels and the group are changed by Label and Assign
+		r.Labels, r.Group = before.Labels, before.Group
+		r.Revision = before.Revision + 1
+		row := router{Router: r, Tenant: tenant}
+		_, err = tx.ModelContext(ctx, &row).
+			ExcludeColumn("tenant", "deleted_at", "deleted_by").
+			Where("router_serial = ?", r.RouterSerial).
+			Where("tenant = ?", tenant).
+			Apply(live).
+			Update()
+		if err != nil {
+			return err
+		}
+		if r.AccountID != before.AccountID {
+			// the router moves to another account, it is counted again by the quotas
+			err = checkQuotas(ctx, tx, quotas, []domain.Router{r})
+			if err != nil {
+				return err
+			}
+		}
+		e := domain.Audit(ctx, tenant, domain.AuditUpdate, &before.Router, &r)
+		err = openVersion(ctx, tx, tenant, r, e.Time)
+		if err != nil {
+			return err
+		}
+		return record(ctx, tx, []domain.AuditEntry{e})
+	})
 	if err != nil {
-		log.Println("failed to load server certificate: %v", err)
+		return r, err
 	}
+	return r, nil
+}
 
-	CACertPool := x509.NewCertPool()
-	CACertPool.AppendCertsFromPEM(CACert)
+// lockRouter reads the live router and locks its row until the end of the transaction
+func lockRouter(ctx context.Context, tx *pg.Tx, serial string, tenant string) (router, bool, error) {
+	var res router
 
-	return &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            CACertPool,
-		InsecureSkipVerify: true,
+	err := tx.ModelContext(ctx, &res).
+		Where("router_serial = ?", serial).
+		Where("tenant = ?", tenant).
+		Apply(live).
+		For("UPDATE").
+		Select()
+	if err == pg.ErrNoRows {
+		return res, false, nil
 	}
+	return res, err == nil, err
 }
@@ -0,0 +1,121 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectOptions(t *testing.T) {
+	o := Options{
+		Address:         "db:5432",
+		User:            "routermgt",
+		Database:        "routers",
+		TLSMode:         TLSDisable,
+		PoolSize:        7,
+		MinIdleConns:    2,
+		MaxConnAge:      time.Hour,
+		IdleTimeout:     time.Minute,
+		PoolTimeout:     3 * time.Second,
+		DialTimeout:     4 * time.Second,
+		ReadTimeout:     5 * time.Second,
+		WriteTimeout:    6 * time.Second,
+		QueryRetries:    2,
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: time.Second,
+	}
+	certs, err := newCertStore(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := connect(o, certs)
+	defer db.Close()
+
+	po := db.Options()
+	if po.Addr != o.Address || po.User != o.User || po.Database != o.Database || po.TLSConfig != nil {
+		t.Errorf("unexpected connection options %+v", po)
+	}
+	if po.PoolSize != 7 || po.MinIdleConns != 2 || po.MaxConnAge != time.Hour || po.IdleTimeout != time.Minute || po.PoolTimeout != 3*time.Second {
+		t.Errorf("unexpected pool options %+v", po)
+	}
+	if po.DialTimeout != 4*time.Second || po.ReadTimeout != 5*time.Second || po.WriteTimeout != 6*time.Second {
+		t.Errorf("unexpected timeouts %+v", po)
+	}
+	if po.MaxRetries != 2 || po.MinRetryBackoff != 100*time.Millisecond || po.MaxRetryBackoff != time.Second {
+		t.Errorf("unexpected retries %+v", po)
+	}
+}
+
+func TestConnectAttempts(t *testing.T) {
+	// a port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	start := time.Now()
+	_, err = NewPostgres(Options{
+		Address:         addr,
+		TLSMode:         TLSDisable,
+		DialTimeout:     time.Second,
+		ConnectAttempts: 3,
+		RetryBackoff:    20 * time.Millisecond,
+		MaxRetryBackoff: 30 * time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "unreachable after 3 attempt(s)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 20ms then 30ms, the backoff doubles up to its maximum
+	if d := time.Since(start); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("3 attempts in %s", d)
+	}
+
+	// the certificates are checked before any attempt
+	_, err = NewPostgres(Options{Address: addr, TLSMode: TLSVerifyFull, ConnectAttempts: 1})
+	if err == nil || !strings.Contains(err.Error(), "requires the server CA certificate") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	p := testDB(t)
+	if _, err := p.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+	in := []domain.Router{
+		{RouterSerial: "S1", State: domain.StateSuspended, StateSince: &since, StateReason: "unpaid"},
+		{RouterSerial: "S2", State: domain.StateRMA, StateSince: &since, StateReason: "broken fan"},
+		{RouterSerial: "S3", State: domain.StateDecommissioned, StateSince: &since},
+	}
+	if _, err := p.Add(ctx, in, "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the exported routers are imported in another tenant as they were
+	exported, _, err := p.GetPaged(ctx, domain.Pagination{Limit: 10}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Add(ctx, *exported, "other"); err != nil {
+		t.Fatal(err)
+	}
+	imported, _, err := p.GetPaged(ctx, domain.Pagination{Limit: 10}, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*imported) != len(in) {
+		t.Fatalf("%d router(s) imported", len(*imported))
+	}
+	for i, r := range *imported {
+		if r.State != in[i].State || r.StateSince == nil || !r.StateSince.Equal(since) || r.StateReason != in[i].StateReason {
+			t.Errorf("%s in state %q since %v (%q)", r.RouterSerial, r.State, r.StateSince, r.StateReason)
+		}
+	}
+}
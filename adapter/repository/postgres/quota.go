@@ -0,0 +1,131 @@
+package postgres
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// quota is a row of the quotas table, an empty account_id is the quota of the whole tenant
+type quota struct {
+	tableName  struct{} `pg:"quotas"`
+	Tenant     string   `pg:",pk"`
+	AccountID  string   `pg:",pk,use_zero"`
+	MaxRouters int      `pg:",use_zero"`
+}
+
+func (q quota) toDomain() domain.Quota {
+	return domain.Quota{Tenant: q.Tenant, AccountID: q.AccountID, Limit: q.MaxRouters}
+}
+
+// SetQuota creates or replaces the quota of a tenant or account
+func (p *Postgres) SetQuota(ctx context.Context, q domain.Quota) error {
+	row := quota{Tenant: q.Tenant, AccountID: q.AccountID, MaxRouters: q.Limit}
+	_, err := p.db.ModelContext(ctx, &row).
+		OnConflict("(tenant, account_id) DO UPDATE").
+		Set("max_routers = EXCLUDED.max_routers").
+		Insert()
+	return err
+}
+
+func (p *Postgres) DeleteQuota(ctx context.Context, tenant string, account string) error {
+	_, err := p.db.ModelContext(ctx, (*quota)(nil)).
+		Where("tenant = ?", tenant).
+		Where("account_id = ?", account).
+		Delete()
+	return err
+}
+
+// Quotas returns the quotas of the tenant
+func (p *Postgres) Quotas(ctx context.Context, tenant string) ([]domain.Quota, error) {
+	var rows []quota
+
+	err := p.db.ModelContext(ctx, &rows).Where("tenant = ?", tenant).Order("account_id").Select()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.Quota, len(rows))
+	for i, q := range rows {
+		res[i] = q.toDomain()
+	}
+	return res, nil
+}
+
+// QuotaUsage returns the usage of the whole tenant first, limited or not, then of each account quota
+func (p *Postgres) QuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error) {
+	var counts []struct {
+		AccountID string
+		Count     int
+	}
+
+	quotas, err := p.Quotas(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	err = p.db.ModelContext(ctx, (*router)(nil)).
+		ColumnExpr("account_id, count(*) AS count").
+		Where("tenant = ?", tenant).
+		Apply(live).
+		Group("account_id").
+		Select(&counts)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	used := make(map[string]int)
+	for _, c := range counts {
+		total += c.Count
+		used[c.AccountID] = c.Count
+	}
+
+	res := []domain.QuotaUsage{{Tenant: tenant, Used: total}}
+	for _, q := range quotas {
+		if q.AccountID == "" {
+			res[0].Limit = q.Limit
+			continue
+		}
+		res = append(res, domain.QuotaUsage{Tenant: tenant, AccountID: q.AccountID, Limit: q.Limit, Used: used[q.AccountID]})
+	}
+	return res, nil
+}
+
+// checkQuotas runs after the inserts of Add, in its transaction, it fails when a quota is exceeded
+// by the added routers
+func checkQuotas(ctx context.Context, tx *pg.Tx, quotas []quota, added []domain.Router) error {
+	for _, row := range quotas {
+		q := row.toDomain()
+		if q.Limit <= 0 {
+			continue
+		}
+		adding := 0
+		for _, r := range added {
+			if q.Counts(r) {
+				adding++
+			}
+		}
+		if adding == 0 {
+			continue
+		}
+		used, err := tx.ModelContext(ctx, (*router)(nil)).
+			Where("tenant = ?", q.Tenant).
+			Apply(live).
+			Apply(func(query *orm.Query) (*orm.Query, error) {
+				if q.AccountID != "" {
+					query = query.Where("account_id = ?", q.AccountID)
+				}
+				return query, nil
+			}).
+			Count()
+		if err != nil {
+			return err
+		}
+		if used > q.Limit {
+			return &domain.QuotaExceededError{
+				Usage:  domain.QuotaUsage{Tenant: q.Tenant, AccountID: q.AccountID, Limit: q.Limit, Used: used - adding},
+				Adding: adding,
+			}
+		}
+	}
+	return nil
+}
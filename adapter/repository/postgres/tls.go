@@ -0,0 +1,170 @@
+package postgres
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// certStore keeps the certificates used by the pool, new connections pick up the
+// certificates loaded by the last reload without recreating the pool
+type certStore struct {
+	mu         sync.RWMutex
+	mode       string
+	serverName string
+	cert       *tls.Certificate
+	pool       *x509.CertPool
+}
+
+func newCertStore(o Options) (*certStore, error) {
+	s := &certStore{
+		mode:       o.TLSMode,
+		serverName: o.ServerName,
+	}
+	if s.mode == "" {
+		s.mode = TLSVerifyFull
+	}
+	switch s.mode {
+	case TLSDisable, TLSRequire, TLSVerifyCA, TLSVerifyFull:
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q", s.mode)
+	}
+	if s.serverName == "" {
+		host, _, err := net.SplitHostPort(o.Address)
+		if err != nil {
+			host = o.Address
+		}
+		s.serverName = host
+	}
+	if s.mode == TLSDisable {
+		return s, nil
+	}
+
+	cert, pool, err := loadCerts(s.mode, o.ClientCert, o.ClientKey, o.ServerCert)
+	if err != nil {
+		return nil, err
+	}
+	s.set(cert, pool)
+	return s, nil
+}
+
+// loadCerts fails on any configured certificate that cannot be read, the client certificate is
+// optional and the server certificate is required by the verify modes
+func loadCerts(mode string, clientCert string, clientKey string, serverCert string) (*tls.Certificate, *x509.CertPool, error) {
+	var (
+		cert *tls.Certificate
+		pool *x509.CertPool
+	)
+
+	if clientCert != "" || clientKey != "" {
+		c, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	if serverCert == "" {
+		if mode == TLSVerifyCA || mode == TLSVerifyFull {
+			return nil, nil, fmt.Errorf("TLS mode %s requires the server CA certificate", mode)
+		}
+		return cert, nil, nil
+	}
+	CACert, err := os.ReadFile(serverCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(CACert) {
+		return nil, nil, fmt.Errorf("failed to load server certificate: no PEM certificate in %s", serverCert)
+	}
+	return cert, pool, nil
+}
+
+func (s *certStore) set(cert *tls.Certificate, pool *x509.CertPool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = cert
+	s.pool = pool
+}
+
+func (s *certStore) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return s.cert, nil
+}
+
+// tlsConfig returns nil when TLS is disabled. The verification is done by verifyConnection
+// rather than by crypto/tls so that a reloaded CA applies to new connections.
+func (s *certStore) tlsConfig() *tls.Config {
+	if s.mode == TLSDisable {
+		return nil
+	}
+	return &tls.Config{
+		ServerName:           s.serverName,
+		GetClientCertificate: s.clientCertificate,
+		InsecureSkipVerify:   true,
+		VerifyConnection:     s.verifyConnection,
+		MinVersion:           tls.VersionTLS12,
+	}
+}
+
+func (s *certStore) verifyConnection(cs tls.ConnectionState) error {
+	if s.mode == TLSRequire {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+
+	s.mu.RLock()
+	pool := s.pool
+	s.mu.RUnlock()
+
+	leaf := cs.PeerCertificates[0]
+	inter := x509.NewCertPool()
+	for _, c := range cs.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: inter,
+	})
+	if err != nil {
+		return fmt.Errorf("server certificate: %w", err)
+	}
+
+	if s.mode == TLSVerifyFull {
+		// some providers (e.g. Cloud SQL) only set the common name, it is accepted when it
+		// matches the configured server name exactly
+		if err = leaf.VerifyHostname(s.serverName); err != nil && leaf.Subject.CommonName != s.serverName {
+			return fmt.Errorf("server certificate: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReloadTLS reads the certificates again, on error the previous certificates are kept
+func (p *Postgres) ReloadTLS(clientCert string, clientKey string, serverCert string) error {
+	if p.certs.mode == TLSDisable {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cert, pool, err := loadCerts(p.certs.mode, clientCert, clientKey, serverCert)
+	if err != nil {
+		return err
+	}
+	p.certs.set(cert, pool)
+	p.opts.ClientCert = clientCert
+	p.opts.ClientKey = clientKey
+	p.opts.ServerCert = serverCert
+	return nil
+}
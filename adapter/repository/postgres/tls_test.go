@@ -0,0 +1,232 @@
+package postgres
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert returns a certificate signed by parent, self-signed when parent is nil
+func newCert(t *testing.T, cn string, hosts []string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// write saves the certificate and its key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewCertStore(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	clientCert, clientKey := newCert(t, "routermgt", nil, ca).write(t, dir, "client")
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       Options
+		serverName string
+		err        string
+	}{
+		{"disable", Options{TLSMode: TLSDisable, Address: "db:5432"}, "db", ""},
+		{"require without certificate", Options{TLSMode: TLSRequire, Address: "db:5432"}, "db", ""},
+		{"verify-ca", Options{TLSMode: TLSVerifyCA, Address: "db:5432", ServerCert: caFile}, "db", ""},
+		{"verify-full by default", Options{Address: "db.example.com:5432", ServerCert: caFile}, "db.example.com", ""},
+		{"server name", Options{Address: "10.0.0.1:5432", ServerName: "db.example.com", ServerCert: caFile}, "db.example.com", ""},
+		{"address without port", Options{TLSMode: TLSRequire, Address: "db"}, "db", ""},
+		{"client certificate", Options{TLSMode: TLSRequire, Address: "db:5432", ClientCert: clientCert, ClientKey: clientKey}, "db", ""},
+		{"unknown mode", Options{TLSMode: "prefer", Address: "db:5432"}, "", "unknown TLS mode"},
+		{"verify-ca without CA", Options{TLSMode: TLSVerifyCA, Address: "db:5432"}, "", "requires the server CA certificate"},
+		{"verify-full without CA", Options{Address: "db:5432"}, "", "requires the server CA certificate"},
+		{"missing CA file", Options{TLSMode: TLSVerifyCA, Address: "db:5432", ServerCert: filepath.Join(dir, "none")}, "", "failed to load server certificate"},
+		{"CA not PEM", Options{TLSMode: TLSVerifyCA, Address: "db:5432", ServerCert: notPEM}, "", "no PEM certificate"},
+		{"client key missing", Options{TLSMode: TLSRequire, Address: "db:5432", ClientCert: clientCert}, "", "failed to load client certificate"},
+		{"client key mismatch", Options{TLSMode: TLSRequire, Address: "db:5432", ClientCert: clientCert, ClientKey: caFile}, "", "failed to load client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newCertStore(tt.opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s.serverName != tt.serverName {
+				t.Errorf("server name %q, want %q", s.serverName, tt.serverName)
+			}
+			c := s.tlsConfig()
+			if (c == nil) != (tt.opts.TLSMode == TLSDisable) {
+				t.Fatalf("TLS config %v for mode %q", c, tt.opts.TLSMode)
+			}
+			if c != nil && c.ServerName != tt.serverName {
+				t.Errorf("TLS server name %q, want %q", c.ServerName, tt.serverName)
+			}
+		})
+	}
+}
+
+func TestVerifyConnection(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	other := newCert(t, "other", nil, nil)
+
+	server := newCert(t, "db", []string{"db.example.com"}, ca)
+	wrongHost := newCert(t, "db", []string{"other.example.com"}, ca)
+	commonName := newCert(t, "db.example.com", nil, ca)
+	untrusted := newCert(t, "db", []string{"db.example.com"}, other)
+
+	tests := []struct {
+		name  string
+		mode  string
+		peers []*x509.Certificate
+		err   string
+	}{
+		{"require accepts any certificate", TLSRequire, []*x509.Certificate{untrusted.cert}, ""},
+		{"require without certificate", TLSRequire, nil, ""},
+		{"verify-ca", TLSVerifyCA, []*x509.Certificate{server.cert}, ""},
+		{"verify-ca ignores the host", TLSVerifyCA, []*x509.Certificate{wrongHost.cert}, ""},
+		{"verify-ca untrusted", TLSVerifyCA, []*x509.Certificate{untrusted.cert}, "server certificate"},
+		{"verify-ca without certificate", TLSVerifyCA, nil, "did not present a certificate"},
+		{"verify-full", TLSVerifyFull, []*x509.Certificate{server.cert}, ""},
+		{"verify-full with the chain", TLSVerifyFull, []*x509.Certificate{server.cert, ca.cert}, ""},
+		{"verify-full wrong host", TLSVerifyFull, []*x509.Certificate{wrongHost.cert}, "server certificate"},
+		{"verify-full common name", TLSVerifyFull, []*x509.Certificate{commonName.cert}, ""},
+		{"verify-full untrusted", TLSVerifyFull, []*x509.Certificate{untrusted.cert}, "server certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newCertStore(Options{TLSMode: tt.mode, Address: "db.example.com:5432", ServerCert: caFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.verifyConnection(tls.ConnectionState{PeerCertificates: tt.peers})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, "ca", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	next := newCert(t, "next", nil, nil)
+	nextFile, _ := next.write(t, dir, "next")
+	clientCert, clientKey := newCert(t, "routermgt", nil, next).write(t, dir, "client")
+	server := newCert(t, "db", []string{"db.example.com"}, next)
+
+	o := Options{Address: "db.example.com:5432", ServerCert: caFile}
+	certs, err := newCertStore(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Postgres{opts: o, certs: certs}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{server.cert}}
+	if err = certs.verifyConnection(state); err == nil {
+		t.Fatal("server certificate of the next CA accepted before the reload")
+	}
+
+	// a failed reload keeps the previous certificates
+	if err = p.ReloadTLS("", "", filepath.Join(dir, "none")); err == nil {
+		t.Fatal("reload of a missing CA succeeded")
+	}
+	if p.opts.ServerCert != caFile {
+		t.Errorf("options changed by a failed reload: %+v", p.opts)
+	}
+
+	if err = p.ReloadTLS(clientCert, clientKey, nextFile); err != nil {
+		t.Fatal(err)
+	}
+	if err = certs.verifyConnection(state); err != nil {
+		t.Errorf("server certificate of the next CA rejected after the reload: %v", err)
+	}
+	c, err := certs.clientCertificate(nil)
+	if err != nil || len(c.Certificate) == 0 {
+		t.Errorf("client certificate not loaded: %v", err)
+	}
+	if p.opts.ClientCert != clientCert || p.opts.ServerCert != nextFile {
+		t.Errorf("options not updated: %+v", p.opts)
+	}
+
+	// nothing is loaded when TLS is disabled
+	off, err := newCertStore(Options{TLSMode: TLSDisable, Address: "db:5432"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Postgres{certs: off}).ReloadTLS("", "", filepath.Join(dir, "none")); err != nil {
+		t.Errorf("reload with TLS disabled: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package simdb
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+)
+
+// record appends e to the audit trail, the caller holds tenantdbLock
+func (s *Simdb) record(e domain.AuditEntry) {
+	e.ID = int64(len(s.audit) + 1)
+	s.audit = append(s.audit, e)
+}
+
+// AuditTrail returns a page of the entries of the tenant matching q, newest first, and the index
+// of the last page
+func (s *Simdb) AuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error) {
+	var match []domain.AuditEntry
+
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if s.audit[i].Tenant == tenant && q.Match(s.audit[i]) {
+			match = append(match, s.audit[i])
+		}
+	}
+	last := 0
+	if len(match) > 0 {
+		last = (len(match) - 1) / q.Limit
+	}
+	start := q.Page * q.Limit
+	if start >= len(match) {
+		return []domain.AuditEntry{}, last, nil
+	}
+	end := start + q.Limit
+	if end > len(match) {
+		end = len(match)
+	}
+	return match[start:end], last, nil
+}
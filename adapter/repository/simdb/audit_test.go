@@ -0,0 +1,92 @@
+package simdb
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditTrail(t *testing.T) {
+	s := NewSimDB()
+	start := time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+	// one entry a minute, S1 and S2 changed in turn by alice and bob, and an entry of another tenant
+	for i := 0; i < 6; i++ {
+		e := domain.AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Tenant: "acme", Actor: "alice", Action: domain.AuditUpdate, RouterSerial: "S1"}
+		if i%2 == 1 {
+			e.Actor, e.RouterSerial = "bob", "S2"
+		}
+		s.record(e)
+	}
+	s.record(domain.AuditEntry{Time: start, Tenant: "other", Actor: "alice", RouterSerial: "S1"})
+
+	tests := []struct {
+		name string
+		q    domain.AuditQuery
+		ids  []int64
+		last int
+	}{
+		{"newest first", domain.AuditQuery{Limit: 10}, []int64{6, 5, 4, 3, 2, 1}, 0},
+		{"first page", domain.AuditQuery{Limit: 4}, []int64{6, 5, 4, 3}, 1},
+		{"last page", domain.AuditQuery{Limit: 4, Page: 1}, []int64{2, 1}, 1},
+		{"out of range", domain.AuditQuery{Limit: 4, Page: 2}, []int64{}, 1},
+		{"router", domain.AuditQuery{Limit: 10, RouterSerial: "S2"}, []int64{6, 4, 2}, 0},
+		{"actor", domain.AuditQuery{Limit: 2, Actor: "alice"}, []int64{5, 3}, 1},
+		{"actor last page", domain.AuditQuery{Limit: 2, Page: 1, Actor: "alice"}, []int64{1}, 1},
+		// From is inclusive, To is exclusive
+		{"time range", domain.AuditQuery{Limit: 10, From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}, []int64{3, 2}, 0},
+		{"all filters", domain.AuditQuery{Limit: 10, RouterSerial: "S1", Actor: "alice", From: start.Add(time.Minute)}, []int64{5, 3}, 0},
+		{"no match", domain.AuditQuery{Limit: 10, Actor: "carol"}, []int64{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, last, err := s.AuditTrail(context.Background(), tt.q, "acme")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ids := []int64{}
+			for _, e := range entries {
+				if e.Tenant != "acme" {
+					t.Errorf("entry of tenant %s", e.Tenant)
+				}
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) || last != tt.last {
+				t.Errorf("got %v last %d, want %v last %d", ids, last, tt.ids, tt.last)
+			}
+		})
+	}
+}
+
+func TestAuditTrailChanges(t *testing.T) {
+	s := NewSimDB()
+	ctx := domain.WithActor(context.Background(), domain.Actor{Name: "alice", RequestID: "r1"})
+	if _, err := s.Add(ctx, []domain.Router{{RouterSerial: "S1"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Update(ctx, domain.Router{RouterSerial: "S1", OperatorName: "op"}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, []domain.Router{{RouterSerial: "S1"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _, err := s.AuditTrail(context.Background(), domain.AuditQuery{Limit: 10}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	for _, e := range entries {
+		if e.Actor != "alice" || e.RequestID != "r1" || e.RouterSerial != "S1" {
+			t.Errorf("unexpected entry %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if want := []string{domain.AuditDelete, domain.AuditUpdate, domain.AuditCreate}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("actions %v, want %v", actions, want)
+	}
+	if entries[1].Before.OperatorName != "" || entries[1].After.OperatorName != "op" {
+		t.Errorf("update recorded %+v to %+v", entries[1].Before, entries[1].After)
+	}
+}
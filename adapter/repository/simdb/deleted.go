@@ -0,0 +1,101 @@
+package simdb
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"sort"
+	"time"
+)
+
+// Restore brings back the deleted routers and returns them, the routers without tombstone are
+// ignored. A router whose group was deleted meanwhile is restored without group. Like Add it
+// fails without restoring anything when a quota would be exceeded.
+func (s *Simdb) Restore(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error) {
+	var restored []domain.Router
+
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	seen := make(map[string]bool)
+	for _, v := range routers {
+		d, ok := s.deleted[tenant][v.RouterSerial]
+		if ok && !seen[v.RouterSerial] {
+			seen[v.RouterSerial] = true
+			restored = append(restored, d.Router)
+		}
+	}
+	err := s.checkQuotas(tenant, restored)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.tenantdb[tenant]; !ok {
+		s.tenantdb[tenant] = make(map[string]domain.Router)
+	}
+	for i := range restored {
+		v := &restored[i]
+		v.Revision++
+		if _, ok := s.groups[tenant][v.Group]; !ok {
+			v.Group = ""
+		}
+		delete(s.deleted[tenant], v.RouterSerial)
+		s.tenantdb[tenant][v.RouterSerial] = *v
+		e := domain.Audit(ctx, tenant, domain.AuditRestore, nil, v)
+		s.record(e)
+		s.openVersion(tenant, *v, e.Time)
+	}
+	return restored, nil
+}
+
+// Deleted returns a page of the tombstones of the tenant, most recently deleted first, and the
+// index of the last page
+func (s *Simdb) Deleted(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error) {
+	var res []domain.DeletedRouter
+
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	for _, d := range s.deleted[tenant] {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].DeletedAt.Equal(res[j].DeletedAt) {
+			return res[i].DeletedAt.After(res[j].DeletedAt)
+		}
+		return res[i].Router.RouterSerial < res[j].Router.RouterSerial
+	})
+	last := 0
+	if len(res) > 0 {
+		last = (len(res) - 1) / page.Limit
+	}
+	start := page.Page * page.Limit
+	if start >= len(res) {
+		return []domain.DeletedRouter{}, last, nil
+	}
+	end := start + page.Limit
+	if end > len(res) {
+		end = len(res)
+	}
+	return res[start:end], last, nil
+}
+
+// PurgeDeleted removes the tombstones older than before and returns how many were removed, the
+// purge is recorded in the audit trail
+func (s *Simdb) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	n := 0
+	for tenant, tombstones := range s.deleted {
+		for serial, d := range tombstones {
+			if !d.DeletedAt.Before(before) {
+				continue
+			}
+			r := d.Router
+			delete(tombstones, serial)
+			s.record(domain.Audit(ctx, tenant, domain.AuditPurge, &r, nil))
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,196 @@
+package simdb
+
+import (
+	"context"
+	"errors"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	if err := s.Delete(ctx, []domain.Router{{RouterSerial: "S00"}, {RouterSerial: "S01"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the routers without tombstone are ignored, so is a serial given twice
+	restored, err := s.Restore(ctx, []domain.Router{{RouterSerial: "S00"}, {RouterSerial: "S00"}, {RouterSerial: "S02"}, {RouterSerial: "S09"}}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serials(&restored); !reflect.DeepEqual(got, []string{"S00"}) {
+		t.Fatalf("restored %v", got)
+	}
+	r, ok := s.GetRouter(ctx, domain.Router{RouterSerial: "S00"}, "acme")
+	if !ok || r.Revision != 2 || r.Labels["ring"] != "canary" {
+		t.Errorf("restored router %+v", r)
+	}
+	// the tombstones are per tenant
+	if restored, _ = s.Restore(ctx, []domain.Router{{RouterSerial: "S01"}}, "other"); len(restored) != 0 {
+		t.Errorf("router of acme restored in other")
+	}
+	tombstones, _, _ := s.Deleted(ctx, domain.Pagination{Limit: 10}, "acme")
+	if len(tombstones) != 1 || tombstones[0].Router.RouterSerial != "S01" {
+		t.Errorf("tombstones %+v", tombstones)
+	}
+	entries, _, _ := s.AuditTrail(ctx, domain.AuditQuery{Limit: 1, RouterSerial: "S00"}, "acme")
+	if len(entries) != 1 || entries[0].Action != domain.AuditRestore || entries[0].Before != nil || entries[0].After.Revision != 2 {
+		t.Errorf("restore recorded as %+v", entries)
+	}
+	versions, _ := s.RouterHistory(ctx, "S00", "acme")
+	if len(versions) != 2 || versions[0].Current() || !versions[1].Current() {
+		t.Errorf("history %+v", versions)
+	}
+
+	// like Add, nothing is restored over the quota
+	if err = s.SetQuota(ctx, domain.Quota{Tenant: "acme", Limit: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete(ctx, []domain.Router{{RouterSerial: "S02"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Restore(ctx, []domain.Router{{RouterSerial: "S01"}, {RouterSerial: "S02"}}, "acme")
+	if !errors.Is(err, domain.ErrQuotaExceeded) {
+		t.Fatalf("expected %v, got %v", domain.ErrQuotaExceeded, err)
+	}
+	if _, ok = s.GetRouter(ctx, domain.Router{RouterSerial: "S01"}, "acme"); ok {
+		t.Errorf("router restored over the quota")
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	if err := s.Delete(ctx, []domain.Router{{RouterSerial: "S00"}, {RouterSerial: "S01"}, {RouterSerial: "S02"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	// most recently deleted first, the serial breaks the ties
+	now := time.Now().UTC()
+	for serial, at := range map[string]time.Time{"S00": now.Add(-time.Hour), "S01": now, "S02": now} {
+		d := s.deleted["acme"][serial]
+		d.DeletedAt = at
+		s.deleted["acme"][serial] = d
+	}
+
+	tests := []struct {
+		name    string
+		page    domain.Pagination
+		serials []string
+		last    int
+	}{
+		{"one page", domain.Pagination{Limit: 10}, []string{"S01", "S02", "S00"}, 0},
+		{"first page", domain.Pagination{Limit: 2}, []string{"S01", "S02"}, 1},
+		{"last page", domain.Pagination{Limit: 2, Page: 1}, []string{"S00"}, 1},
+		{"out of range", domain.Pagination{Limit: 2, Page: 2}, []string{}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tombstones, last, err := s.Deleted(ctx, tt.page, "acme")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := []string{}
+			for _, d := range tombstones {
+				got = append(got, d.Router.RouterSerial)
+			}
+			if !reflect.DeepEqual(got, tt.serials) || last != tt.last {
+				t.Errorf("got %v last %d, want %v last %d", got, last, tt.serials, tt.last)
+			}
+		})
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	if err := s.Delete(ctx, []domain.Router{{RouterSerial: "S00"}, {RouterSerial: "S01"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, []domain.Router{{RouterSerial: "X00"}}, "other"); err != nil {
+		t.Fatal(err)
+	}
+	// S00 and the router of other were deleted a day ago
+	now := time.Now().UTC()
+	for tenant, serial := range map[string]string{"acme": "S00", "other": "X00"} {
+		d := s.deleted[tenant][serial]
+		d.DeletedAt = now.Add(-24 * time.Hour)
+		s.deleted[tenant][serial] = d
+	}
+
+	n, err := s.PurgeDeleted(ctx, now.Add(-time.Hour))
+	if err != nil || n != 2 {
+		t.Fatalf("purged %d: %v", n, err)
+	}
+	tombstones, _, _ := s.Deleted(ctx, domain.Pagination{Limit: 10}, "acme")
+	if len(tombstones) != 1 || tombstones[0].Router.RouterSerial != "S01" {
+		t.Errorf("tombstones %+v", tombstones)
+	}
+	if tombstones, _, _ = s.Deleted(ctx, domain.Pagination{Limit: 10}, "other"); len(tombstones) != 0 {
+		t.Errorf("tombstones of other %+v", tombstones)
+	}
+	// a purged router can no longer be restored
+	if restored, _ := s.Restore(ctx, []domain.Router{{RouterSerial: "S00"}}, "acme"); len(restored) != 0 {
+		t.Errorf("purged router restored")
+	}
+	entries, _, _ := s.AuditTrail(ctx, domain.AuditQuery{Limit: 1, RouterSerial: "S00"}, "acme")
+	if len(entries) != 1 || entries[0].Action != domain.AuditPurge || entries[0].After != nil || entries[0].Before.RouterSerial != "S00" {
+		t.Errorf("purge recorded as %+v", entries)
+	}
+
+	// the tombstones deleted at the limit are kept
+	if n, _ = s.PurgeDeleted(ctx, s.deleted["acme"]["S01"].DeletedAt); n != 0 {
+		t.Errorf("purged %d tombstones at the limit", n)
+	}
+}
+
+func TestDeleteGroupTombstones(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	if err := s.SaveGroup(ctx, domain.Group{ID: "eu"}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Assign(ctx, []string{"S00", "S01"}, "eu", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, []domain.Router{{RouterSerial: "S00"}, {RouterSerial: "S01"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	// a router restored before the group is deleted stays in it
+	if _, err := s.Restore(ctx, []domain.Router{{RouterSerial: "S01"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteGroup(ctx, "eu", "acme"); !errors.Is(err, domain.ErrGroupNotEmpty) {
+		t.Fatalf("group of a restored router deleted: %v", err)
+	}
+	if _, err := s.Assign(ctx, []string{"S01"}, "", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteGroup(ctx, "eu", "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tombstone is not changed by the deletion of the group
+	tombstones, _, _ := s.Deleted(ctx, domain.Pagination{Limit: 10}, "acme")
+	if len(tombstones) != 1 || tombstones[0].Router.Group != "eu" || tombstones[0].Router.Revision != 2 {
+		t.Fatalf("tombstones %+v", tombstones)
+	}
+	// the router leaves the group when it is restored, the change is audited and versioned
+	restored, err := s.Restore(ctx, []domain.Router{{RouterSerial: "S00"}}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0].Group != "" || restored[0].Revision != 3 {
+		t.Fatalf("restored %+v", restored)
+	}
+	entries, _, _ := s.AuditTrail(ctx, domain.AuditQuery{Limit: 1, RouterSerial: "S00"}, "acme")
+	if len(entries) != 1 || entries[0].Action != domain.AuditRestore || entries[0].After.Group != "" {
+		t.Errorf("restore recorded as %+v", entries)
+	}
+	versions, _ := s.RouterHistory(ctx, "S00", "acme")
+	if cur := versions[len(versions)-1]; !cur.Current() || cur.Router.Group != "" || cur.Router.Revision != 3 {
+		t.Errorf("current version %+v", cur)
+	}
+}
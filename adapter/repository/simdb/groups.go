@@ -0,0 +1,116 @@
+package simdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/domain"
+)
+
+// Groups returns the groups of the tenant
+func (s *Simdb) Groups(ctx context.Context, tenant string) ([]domain.Group, error) {
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	return s.groupsOf(tenant), nil
+}
+
+// GroupCounts returns the number of routers of each group, the sub-groups are not counted
+func (s *Simdb) GroupCounts(ctx context.Context, tenant string) (map[string]int, error) {
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	res := make(map[string]int)
+	for _, r := range s.tenantdb[tenant] {
+		if r.Group != "" {
+			res[r.Group]++
+		}
+	}
+	return res, nil
+}
+
+// SaveGroup creates or replaces a group, its parent must exist
+func (s *Simdb) SaveGroup(ctx context.Context, g domain.Group, tenant string) error {
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	err := domain.CheckGroup(s.groupsOf(tenant), g)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.groups[tenant]; !ok {
+		s.groups[tenant] = make(map[string]domain.Group)
+	}
+	s.groups[tenant][g.ID] = g
+	return nil
+}
+
+// DeleteGroup removes a group without sub-group nor router, the tombstones are not changed and
+// a router of the group is restored without group
+func (s *Simdb) DeleteGroup(ctx context.Context, id string, tenant string) error {
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	if _, ok := s.groups[tenant][id]; !ok {
+		return fmt.Errorf("%w: group %s", domain.ErrNotFound, id)
+	}
+	for _, g := range s.groups[tenant] {
+		if g.Parent == id {
+			return fmt.Errorf("%w: group %s has sub-group %s", domain.ErrGroupNotEmpty, id, g.ID)
+		}
+	}
+	for _, r := range s.tenantdb[tenant] {
+		if r.Group == id {
+			return fmt.Errorf("%w: group %s has router %s", domain.ErrGroupNotEmpty, id, r.RouterSerial)
+		}
+	}
+	delete(s.groups[tenant], id)
+	return nil
+}
+
+// Assign moves the routers with the given serials to group, an empty group removes them from
+// their group. The routers are returned with their new revision, unknown serials are ignored.
+func (s *Simdb) Assign(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error) {
+	var res []domain.Router
+
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	if _, ok := s.groups[tenant][group]; !ok && group != "" {
+		return nil, fmt.Errorf("%w: %s", domain.ErrUnknownGroup, group)
+	}
+	for _, serial := range serials {
+		before, ok := s.tenantdb[tenant][serial]
+		if !ok {
+			continue
+		}
+		after := before
+		if before.Group != group {
+			after.Group = group
+			after.Revision++
+			s.tenantdb[tenant][serial] = after
+			e := domain.Audit(ctx, tenant, domain.AuditUpdate, &before, &after)
+			s.record(e)
+			s.openVersion(tenant, after, e.Time)
+		}
+		res = append(res, after)
+	}
+	return res, nil
+}
+
+func (s *Simdb) groupsOf(tenant string) []domain.Group {
+	res := make([]domain.Group, 0, len(s.groups[tenant]))
+	for _, g := range s.groups[tenant] {
+		res = append(res, g)
+	}
+	return res
+}
+
+// checkGroups fails when a router refers to a group that does not exist, the caller holds tenantdbLock
+func (s *Simdb) checkGroups(tenant string, routers []domain.Router) error {
+	for _, r := range routers {
+		if _, ok := s.groups[tenant][r.Group]; !ok && r.Group != "" {
+			return fmt.Errorf("%w: %s of router %s", domain.ErrUnknownGroup, r.Group, r.RouterSerial)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package simdb
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"time"
+)
+
+// openVersion closes the current version of the router and starts a new one at t, the caller
+// holds tenantdbLock
+func (s *Simdb) openVersion(tenant string, r domain.Router, t time.Time) {
+	if _, ok := s.history[tenant]; !ok {
+		s.history[tenant] = make(map[string][]domain.RouterVersion)
+	}
+	s.closeVersion(tenant, r.RouterSerial, t)
+	versions := s.history[tenant][r.RouterSerial]
+	s.history[tenant][r.RouterSerial] = append(versions, domain.RouterVersion{
+		Version:   len(versions) + 1,
+		ValidFrom: t,
+		Router:    r,
+	})
+}
+
+// closeVersion ends the current version of the router at t, the caller holds tenantdbLock
+func (s *Simdb) closeVersion(tenant string, serial string, t time.Time) {
+	versions := s.history[tenant][serial]
+	if len(versions) == 0 || !versions[len(versions)-1].Current() {
+		return
+	}
+	versions[len(versions)-1].ValidTo = &t
+}
+
+// RouterHistory returns the versions of the router, oldest first
+func (s *Simdb) RouterHistory(ctx context.Context, serial string, tenant string) ([]domain.RouterVersion, error) {
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	versions := s.history[tenant][serial]
+	res := make([]domain.RouterVersion, len(versions))
+	copy(res, versions)
+	return res, nil
+}
+
+// RouterAt returns the version of the router valid at t, nil when the router did not exist
+func (s *Simdb) RouterAt(ctx context.Context, serial string, tenant string, t time.Time) (*domain.RouterVersion, error) {
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	for _, v := range s.history[tenant][serial] {
+		if v.At(t) {
+			return &v, nil
+		}
+	}
+	return nil, nil
+}
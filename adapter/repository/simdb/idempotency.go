@@ -0,0 +1,70 @@
+package simdb
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"time"
+)
+
+func idempotencyID(tenant string, key string) string {
+	return tenant + "\x00" + key
+}
+
+// ClaimIdempotencyKey records rec as pending unless a live record exists for the same tenant and key
+func (s *Simdb) ClaimIdempotencyKey(ctx context.Context, rec domain.IdempotencyRecord) (domain.IdempotencyRecord, bool, error) {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	id := idempotencyID(rec.Tenant, rec.Key)
+	if cur, ok := s.keys[id]; ok && cur.ExpiresAt.After(time.Now()) {
+		return cur, false, nil
+	}
+	rec.Done = false
+	rec.Response = nil
+	s.keys[id] = rec
+	return rec, true, nil
+}
+
+// CompleteIdempotencyKey stores the reply of a claimed key
+func (s *Simdb) CompleteIdempotencyKey(ctx context.Context, rec domain.IdempotencyRecord) error {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	id := idempotencyID(rec.Tenant, rec.Key)
+	cur, ok := s.keys[id]
+	if !ok {
+		return nil
+	}
+	cur.Done = true
+	cur.Response = rec.Response
+	s.keys[id] = cur
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a claimed key whose request failed
+func (s *Simdb) ReleaseIdempotencyKey(ctx context.Context, tenant string, key string) error {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	id := idempotencyID(tenant, key)
+	if cur, ok := s.keys[id]; ok && !cur.Done {
+		delete(s.keys, id)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the expired records
+func (s *Simdb) PurgeIdempotencyKeys(ctx context.Context) (int, error) {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	n := 0
+	now := time.Now()
+	for id, rec := range s.keys {
+		if !rec.ExpiresAt.After(now) {
+			delete(s.keys, id)
+			n++
+		}
+	}
+	return n, nil
+}
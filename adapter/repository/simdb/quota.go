@@ -0,0 +1,93 @@
+package simdb
+
+import (
+	"context"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"sort"
+)
+
+// SetQuota creates or replaces the quota of a tenant or account
+func (s *Simdb) SetQuota(ctx context.Context, q domain.Quota) error {
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	if _, ok := s.quotas[q.Tenant]; !ok {
+		s.quotas[q.Tenant] = make(map[string]int)
+	}
+	s.quotas[q.Tenant][q.AccountID] = q.Limit
+	return nil
+}
+
+func (s *Simdb) DeleteQuota(ctx context.Context, tenant string, account string) error {
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	delete(s.quotas[tenant], account)
+	return nil
+}
+
+// Quotas returns the quotas of the tenant
+func (s *Simdb) Quotas(ctx context.Context, tenant string) ([]domain.Quota, error) {
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	return s.quotasOf(tenant), nil
+}
+
+// QuotaUsage returns the usage of the whole tenant first, limited or not, then of each account quota
+func (s *Simdb) QuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error) {
+	s.tenantdbLock.RLock()
+	defer s.tenantdbLock.RUnlock()
+
+	res := []domain.QuotaUsage{{Tenant: tenant, Limit: s.quotas[tenant][""], Used: len(s.tenantdb[tenant])}}
+	for _, q := range s.quotasOf(tenant) {
+		if q.AccountID == "" {
+			continue
+		}
+		res = append(res, domain.QuotaUsage{Tenant: tenant, AccountID: q.AccountID, Limit: q.Limit, Used: s.count(q)})
+	}
+	return res, nil
+}
+
+func (s *Simdb) quotasOf(tenant string) []domain.Quota {
+	var res []domain.Quota
+
+	for account, limit := range s.quotas[tenant] {
+		res = append(res, domain.Quota{Tenant: tenant, AccountID: account, Limit: limit})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].AccountID < res[j].AccountID })
+	return res
+}
+
+func (s *Simdb) count(q domain.Quota) int {
+	n := 0
+	for _, r := range s.tenantdb[q.Tenant] {
+		if q.Counts(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// checkQuotas fails when adding the routers exceeds a quota of the tenant, the caller holds tenantdbLock
+func (s *Simdb) checkQuotas(tenant string, added []domain.Router) error {
+	for _, q := range s.quotasOf(tenant) {
+		if q.Limit <= 0 {
+			continue
+		}
+		adding := 0
+		for _, r := range added {
+			if q.Counts(r) {
+				adding++
+			}
+		}
+		used := s.count(q)
+		if adding > 0 && used+adding > q.Limit {
+			return &domain.QuotaExceededError{
+				Usage:  domain.QuotaUsage{Tenant: tenant, AccountID: q.AccountID, Limit: q.Limit, Used: used},
+				Adding: adding,
+			}
+		}
+	}
+	return nil
+}
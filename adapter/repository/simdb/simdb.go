@@ -1,23 +1,44 @@
 package simdb
 
 import (
+	"context"
+	"fmt"
 	"github.com/Go-routine-4995/routermgt/domain"
+	"sort"
 	"sync"
 )
 
 type Simdb struct {
 	tenantdbLock *sync.RWMutex
 	tenantdb     map[string]map[string]domain.Router
+	// quotas by tenant then account, "" is the quota of the whole tenant. They are guarded by
+	// tenantdbLock so that Add checks and inserts atomically
+	quotas map[string]map[string]int
+	// audit trail, appended under tenantdbLock with the change it records
+	audit []domain.AuditEntry
+	// history of the routers by tenant then serial, oldest version first
+	history map[string]map[string][]domain.RouterVersion
+	// tombstones of the deleted routers by tenant then serial
+	deleted map[string]map[string]domain.DeletedRouter
+	// groups by tenant then id
+	groups   map[string]map[string]domain.Group
+	keysLock sync.Mutex
+	keys     map[string]domain.IdempotencyRecord
 }
 
 func NewSimDB() *Simdb {
 	return &Simdb{
 		tenantdb:     make(map[string]map[string]domain.Router),
 		tenantdbLock: &sync.RWMutex{},
+		quotas:       make(map[string]map[string]int),
+		history:      make(map[string]map[string][]domain.RouterVersion),
+		deleted:      make(map[string]map[string]domain.DeletedRouter),
+		groups:       make(map[string]map[string]domain.Group),
+		keys:         make(map[string]domain.IdempotencyRecord),
 	}
 }
 
-func (s *Simdb) GetRouter(router domain.Router, tenant string) (domain.Router, bool) {
+func (s *Simdb) GetRouter(ctx context.Context, router domain.Router, tenant string) (domain.Router, bool) {
 
 	var (
 		re domain.Router
@@ -34,72 +55,90 @@ func (s *Simdb) GetRouter(router domain.Router, tenant string) (domain.Router, b
 }
 
 // GetPaged return a pointer of a slice of routers, and the total number of page with the given limit.
-func (s *Simdb) GetPaged(page domain.Pagination, tenant string) (*[]domain.Router, int) {
+// The routers matching page.Selector, page.Group and page.State are sorted by serial like in the database.
+func (s *Simdb) GetPaged(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error) {
 	var (
-		re *[]domain.Router
-		l  int
-		p  int
-		i  int
-		r  int
+		re  *[]domain.Router
+		all []domain.Router
+		l   int
+		p   int
 	)
+	re = new([]domain.Router)
+	*re = make([]domain.Router, 0)
+
+	sel, err := domain.ParseSelector(page.Selector)
+	if err != nil {
+		return nil, 0, err
+	}
+	states, err := domain.ParseStates(page.State)
+	if err != nil {
+		return nil, 0, err
+	}
+	var inStates map[string]bool
+	if states != nil {
+		inStates = make(map[string]bool)
+		for _, v := range states {
+			inStates[v] = true
+		}
+	}
+
 	// page.Page start at index 0 to ... ceil(l/page.Limit)
 	s.tenantdbLock.RLock()
-	defer s.tenantdbLock.RUnlock()
+	var groups map[string]bool
+	if page.Group != "" {
+		groups = make(map[string]bool)
+		for _, id := range domain.Subtree(s.groupsOf(tenant), page.Group) {
+			groups[id] = true
+		}
+	}
+	for _, v := range s.tenantdb[tenant] {
+		if sel.Matches(v.Labels) && (groups == nil || groups[v.Group]) && (inStates == nil || inStates[v.CurrentState()]) {
+			all = append(all, v)
+		}
+	}
+	s.tenantdbLock.RUnlock()
 
-	l = len(s.tenantdb[tenant])
+	sort.Slice(all, func(i, j int) bool { return all[i].RouterSerial < all[j].RouterSerial })
+	l = len(all)
 	p = l / page.Limit
-	r = l % page.Limit
-	if r != 0 {
+	if l%page.Limit != 0 {
 		p++
 	}
 
-	re = new([]domain.Router)
-
 	// we are out of range!
-	if (page.Page * page.Limit) > l {
-		return re, p - 1
+	start := page.Page * page.Limit
+	if start >= l {
+		return re, p - 1, nil
 	}
-
-	// /!\ p and page.Page index are different p [1..n] page.Page [0..n-1] page.Page is 0 indexed
-	// p indicates the number of page(s)
-	// p == 1 && page.Limit > l we have only one page and the limit asked is bigger than the number of elements
-	// p == page.Limit + 1 && page.Limit > l this is the last page and there is fewer elements than the limit asked
-	if (p == 1 && page.Limit > l) || (p == page.Page+1 && page.Limit > l) {
-		*re = make([]domain.Router, l)
-	} else {
-		*re = make([]domain.Router, page.Limit)
-	}
-	// /!\ we are using a map to simulate a DB,  Go spec says that the iteration order over maps is not specified.
-	// That is to say, you should not expect the map keys to appear in any particular order.
-	for _, v := range s.tenantdb[tenant] {
-		if i >= (page.Page*page.Limit) && i < ((page.Page+1)*page.Limit) {
-			(*re)[i-(page.Page*(page.Limit))] = v
-		}
-		i++
+	end := start + page.Limit
+	if end > l {
+		end = l
 	}
+	*re = append(*re, all[start:end]...)
 
-	return re, p - 1
+	return re, p - 1, nil
 }
 
-// Add a list of router and return a list of routers that are already in the DB
-func (s *Simdb) Add(routers []domain.Router, tenant string) *[]domain.Router {
+// Add a list of router and return a list of routers that are already in the DB, nothing is added
+// when a quota of the tenant would be exceeded
+func (s *Simdb) Add(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error) {
 
 	var (
-		re *[]domain.Router
-		ok bool
+		re    *[]domain.Router
+		ok    bool
+		added []domain.Router
+		seen  map[string]bool
 	)
 
 	s.tenantdbLock.Lock()
 	defer s.tenantdbLock.Unlock()
 
-	_, ok = s.tenantdb[tenant]
-	if !ok {
-		s.tenantdb[tenant] = make(map[string]domain.Router)
-	}
+	seen = make(map[string]bool)
 	for _, v := range routers {
 		_, ok = s.tenantdb[tenant][v.RouterSerial]
-		if !ok {
-			s.tenantdb[tenant][v.RouterSerial] = v
+		if !ok && !seen[v.RouterSerial] {
+			seen[v.RouterSerial] = true
+			added = append(added, v)
 		} else {
 			if re == nil {
 				re = new([]domain.Router)
@@ -108,14 +147,121 @@ func (s *Simdb) Add(routers []domain.Router, tenant string) *[]domain.Router {
 			*re = append(*re, v)
 		}
 	}
-	return re
+
+	err := s.checkGroups(tenant, added)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkQuotas(tenant, added)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok = s.tenantdb[tenant]
+	if !ok {
+		s.tenantdb[tenant] = make(map[string]domain.Router)
+	}
+	for _, v := range added {
+		v := v
+		v.Revision = 1
+		// creating a deleted router replaces its tombstone
+		delete(s.deleted[tenant], v.RouterSerial)
+		s.tenantdb[tenant][v.RouterSerial] = v
+		e := domain.Audit(ctx, tenant, domain.AuditCreate, nil, &v)
+		s.record(e)
+		s.openVersion(tenant, v, e.Time)
+	}
+	return re, nil
 }
 
-func (s *Simdb) Delete(routers []domain.Router, tenant string) {
+// Delete the routers, nothing is deleted when the revision of one of them does not match
+func (s *Simdb) Delete(ctx context.Context, routers []domain.Router, tenant string) error {
 	s.tenantdbLock.Lock()
 	defer s.tenantdbLock.Unlock()
 
 	for _, v := range routers {
+		current, ok := s.tenantdb[tenant][v.RouterSerial]
+		if !ok {
+			continue
+		}
+		err := domain.CheckRevision(current, v.Revision)
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range routers {
+		before, ok := s.tenantdb[tenant][v.RouterSerial]
+		if !ok {
+			continue
+		}
 		delete(s.tenantdb[tenant], v.RouterSerial)
+		e := domain.Audit(ctx, tenant, domain.AuditDelete, &before, nil)
+		if _, ok := s.deleted[tenant]; !ok {
+			s.deleted[tenant] = make(map[string]domain.DeletedRouter)
+		}
+		s.deleted[tenant][v.RouterSerial] = domain.DeletedRouter{Router: before, DeletedAt: e.Time, DeletedBy: e.Actor}
+		s.record(e)
+		s.closeVersion(tenant, v.RouterSerial, e.Time)
+	}
+	return nil
+}
+
+// Update replaces the router with the same serial and returns it with its new revision
+func (s *Simdb) Update(ctx context.Context, r domain.Router, tenant string) (domain.Router, error) {
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	before, ok := s.tenantdb[tenant][r.RouterSerial]
+	if !ok {
+		return r, fmt.Errorf("%w: router %s", domain.ErrNotFound, r.RouterSerial)
+	}
+	err := domain.CheckRevision(before, r.Revision)
+	if err != nil {
+		return r, err
+	}
+	// the labels and the group are changed by Label and Assign
+	r.Labels, r.Group = before.Labels, before.Group
+	r.Revision = before.Revision + 1
+	if r.AccountID != before.AccountID {
+		// the router moves to another account, it is counted again by the quotas
+		delete(s.tenantdb[tenant], r.RouterSerial)
+		err = s.checkQuotas(tenant, []domain.Router{r})
+		if err != nil {
+			s.tenantdb[tenant][r.RouterSerial] = before
+			return r, err
+		}
+	}
+	s.tenantdb[tenant][r.RouterSerial] = r
+	e := domain.Audit(ctx, tenant, domain.AuditUpdate, &before, &r)
+	s.record(e)
+	s.openVersion(tenant, r, e.Time)
+	return r, nil
+}
+
+// Label changes the labels of the routers with the given serials and returns them with their new
+// labels and revision, unknown serials are ignored
+func (s *Simdb) Label(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error) {
+	var res []domain.Router
+
+	s.tenantdbLock.Lock()
+	defer s.tenantdbLock.Unlock()
+
+	for _, serial := range serials {
+		before, ok := s.tenantdb[tenant][serial]
+		if !ok {
+			continue
+		}
+		after := before
+		labels, changed := change.Apply(before.Labels)
+		if changed {
+			after.Labels = labels
+			after.Revision++
+			s.tenantdb[tenant][serial] = after
+			e := domain.Audit(ctx, tenant, domain.AuditUpdate, &before, &after)
+			s.record(e)
+			s.openVersion(tenant, after, e.Time)
+		}
+		res = append(res, after)
 	}
+	return res, nil
 }
@@ -0,0 +1,187 @@
+package simdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"reflect"
+	"testing"
+)
+
+// fleet returns a database with the routers S00 to S09 of tenant acme, the even ones in the
+// canary ring, and one router of another tenant
+func fleet(t *testing.T) *Simdb {
+	t.Helper()
+	s := NewSimDB()
+	var routers []domain.Router
+	for i := 0; i < 10; i++ {
+		r := domain.Router{RouterSerial: fmt.Sprintf("S%02d", i), Labels: map[string]string{"ring": "stable"}}
+		if i%2 == 0 {
+			r.Labels["ring"] = "canary"
+		}
+		routers = append(routers, r)
+	}
+	// inserted out of order, the pages are sorted by serial
+	routers[0], routers[9] = routers[9], routers[0]
+	if _, err := s.Add(context.Background(), routers, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(context.Background(), []domain.Router{{RouterSerial: "X00"}}, "other"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func serials(routers *[]domain.Router) []string {
+	res := []string{}
+	for _, r := range *routers {
+		res = append(res, r.RouterSerial)
+	}
+	return res
+}
+
+func TestGetPaged(t *testing.T) {
+	s := fleet(t)
+
+	tests := []struct {
+		name    string
+		page    domain.Pagination
+		serials []string
+		last    int
+		err     error
+	}{
+		{"first page", domain.Pagination{Limit: 4}, []string{"S00", "S01", "S02", "S03"}, 2, nil},
+		{"last page", domain.Pagination{Limit: 4, Page: 2}, []string{"S08", "S09"}, 2, nil},
+		{"out of range", domain.Pagination{Limit: 4, Page: 3}, []string{}, 2, nil},
+		{"one page", domain.Pagination{Limit: 100}, []string{"S00", "S01", "S02", "S03", "S04", "S05", "S06", "S07", "S08", "S09"}, 0, nil},
+		{"selector", domain.Pagination{Limit: 2, Selector: "ring=canary"}, []string{"S00", "S02"}, 2, nil},
+		{"selector last page", domain.Pagination{Limit: 2, Page: 2, Selector: "ring=canary"}, []string{"S08"}, 2, nil},
+		{"selector set", domain.Pagination{Limit: 10, Selector: "ring notin (canary)"}, []string{"S01", "S03", "S05", "S07", "S09"}, 0, nil},
+		{"no match", domain.Pagination{Limit: 10, Selector: "ring=beta"}, []string{}, -1, nil},
+		{"invalid selector", domain.Pagination{Limit: 10, Selector: "ring in (a"}, nil, 0, domain.ErrInvalidSelector},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routers, last, err := s.GetPaged(context.Background(), tt.page, "acme")
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := serials(routers); !reflect.DeepEqual(got, tt.serials) || last != tt.last {
+				t.Errorf("got %v last %d, want %v last %d", got, last, tt.serials, tt.last)
+			}
+		})
+	}
+}
+
+func TestGetPagedGroup(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	for _, g := range []domain.Group{{ID: "eu"}, {ID: "fr", Parent: "eu"}, {ID: "paris", Parent: "fr"}, {ID: "us"}} {
+		if err := s.SaveGroup(ctx, g, "acme"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for group, assigned := range map[string][]string{"eu": {"S00"}, "fr": {"S01", "S02"}, "paris": {"S03", "S04"}, "us": {"S05"}} {
+		if _, err := s.Assign(ctx, assigned, group, "acme"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		page    domain.Pagination
+		serials []string
+		last    int
+	}{
+		{"subtree", domain.Pagination{Limit: 10, Group: "eu"}, []string{"S00", "S01", "S02", "S03", "S04"}, 0},
+		{"sub-group", domain.Pagination{Limit: 10, Group: "fr"}, []string{"S01", "S02", "S03", "S04"}, 0},
+		{"leaf", domain.Pagination{Limit: 1, Page: 1, Group: "paris"}, []string{"S04"}, 1},
+		{"with selector", domain.Pagination{Limit: 10, Group: "fr", Selector: "ring=canary"}, []string{"S02", "S04"}, 0},
+		{"unknown group", domain.Pagination{Limit: 10, Group: "asia"}, []string{}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routers, last, err := s.GetPaged(ctx, tt.page, "acme")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := serials(routers); !reflect.DeepEqual(got, tt.serials) || last != tt.last {
+				t.Errorf("got %v last %d, want %v last %d", got, last, tt.serials, tt.last)
+			}
+		})
+	}
+}
+
+func TestGetPagedState(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	// the routers stored before the lifecycle have no state and are active
+	for serial, state := range map[string]string{"S00": domain.StateOrdered, "S01": domain.StateSuspended, "S02": domain.StateSuspended, "S03": domain.StateActive} {
+		r, _ := s.GetRouter(ctx, domain.Router{RouterSerial: serial}, "acme")
+		r.State = state
+		if _, err := s.Update(ctx, r, "acme"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		page    domain.Pagination
+		serials []string
+		err     error
+	}{
+		{"one state", domain.Pagination{Limit: 10, State: "suspended"}, []string{"S01", "S02"}, nil},
+		{"several states", domain.Pagination{Limit: 10, State: "ordered,suspended"}, []string{"S00", "S01", "S02"}, nil},
+		{"active without state", domain.Pagination{Limit: 3, State: "active"}, []string{"S03", "S04", "S05"}, nil},
+		{"with selector", domain.Pagination{Limit: 10, State: "suspended", Selector: "ring=canary"}, []string{"S02"}, nil},
+		{"no match", domain.Pagination{Limit: 10, State: "rma"}, []string{}, nil},
+		{"invalid state", domain.Pagination{Limit: 10, State: "suspended,broken"}, nil, domain.ErrInvalidState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routers, _, err := s.GetPaged(ctx, tt.page, "acme")
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := serials(routers); !reflect.DeepEqual(got, tt.serials) {
+				t.Errorf("got %v, want %v", got, tt.serials)
+			}
+		})
+	}
+}
+
+func TestUpdateKeepsLabels(t *testing.T) {
+	ctx := context.Background()
+	s := fleet(t)
+	if err := s.SaveGroup(ctx, domain.Group{ID: "eu"}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Assign(ctx, []string{"S00"}, "eu", "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the labels and the group are changed by Label and Assign only
+	r, err := s.Update(ctx, domain.Router{RouterSerial: "S00", OperatorName: "op", Labels: map[string]string{"ring": "stable"}, Group: "us"}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := s.GetRouter(ctx, domain.Router{RouterSerial: "S00"}, "acme")
+	for _, got := range []domain.Router{r, stored} {
+		if !reflect.DeepEqual(got.Labels, map[string]string{"ring": "canary"}) || got.Group != "eu" || got.OperatorName != "op" || got.Revision != 3 {
+			t.Errorf("unexpected router %+v", got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/**
+ * @file    auth.go
+ * @brief   Caller identity and authorization.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * Callers send a signed JWT in the Authorization header of the NATS request. The token grants
+ * a role per tenant: {"sub": "alice", "roles": {"acme": "operator", "*": "viewer"}}.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+
+	// AnyTenant in the roles claim applies to every tenant
+	AnyTenant = "*"
+)
+
+type Operation string
+
+const (
+	OpRead   Operation = "read"
+	OpWrite  Operation = "write"
+	OpDelete Operation = "delete"
+	OpAdmin  Operation = "admin"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// rank orders the roles, a role is allowed everything a lower role is allowed
+var rank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// required is the minimal role of each operation
+var required = map[Operation]Role{
+	OpRead:   RoleViewer,
+	OpWrite:  RoleOperator,
+	OpDelete: RoleAdmin,
+	OpAdmin:  RoleAdmin,
+}
+
+// Identity is the authenticated caller
+type Identity struct {
+	Subject string
+	Roles   map[string]Role
+}
+
+// Anonymous is used when authentication is disabled
+var Anonymous = Identity{
+	Subject: "anonymous",
+	Roles:   map[string]Role{AnyTenant: RoleAdmin},
+}
+
+// Role returns the role granted on tenant, an empty role means no access
+func (id Identity) Role(tenant string) Role {
+	if r, ok := id.Roles[tenant]; ok {
+		return r
+	}
+	return id.Roles[AnyTenant]
+}
+
+// Tenant returns the only tenant of the identity, it is used when the request does not name one
+func (id Identity) Tenant() (string, bool) {
+	if len(id.Roles) != 1 {
+		return "", false
+	}
+	for t := range id.Roles {
+		if t != AnyTenant {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// Authorize checks that the identity may perform op on tenant
+func (id Identity) Authorize(tenant string, op Operation) error {
+	need, ok := required[op]
+	if !ok {
+		return fmt.Errorf("%w: unknown operation %s", ErrForbidden, op)
+	}
+	have := id.Role(tenant)
+	if rank[have] < rank[need] {
+		return fmt.Errorf("%w: %s needs role %s on tenant %s", ErrForbidden, op, need, tenant)
+	}
+	return nil
+}
+
+type ctxKey struct{}
+
+// WithIdentity returns a context carrying the caller identity
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the caller identity, Anonymous when there is none
+func FromContext(ctx context.Context) Identity {
+	id, ok := ctx.Value(ctxKey{}).(Identity)
+	if !ok {
+		return Anonymous
+	}
+	return id
+}
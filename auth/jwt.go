@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// leeway accepted on exp and nbf
+const skew = 30 * time.Second
+
+// Verifier validates JWT signed with a shared HMAC secret (HS256/384/512) or
+// with the private key matching a RSA (RS256/384/512) or ECDSA (ES256/384/512) public key
+type Verifier struct {
+	secret   []byte
+	key      crypto.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+type header struct {
+	Alg string `json:"alg"`
+}
+
+type claims struct {
+	Subject   string            `json:"sub"`
+	Issuer    string            `json:"iss"`
+	Audience  audience          `json:"aud"`
+	ExpiresAt *float64          `json:"exp"`
+	NotBefore *float64          `json:"nbf"`
+	Roles     map[string]string `json:"roles"`
+}
+
+// audience accepts both the string and the array forms of the aud claim
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = []string{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// NewVerifier needs a secret or a PEM public key file, issuer and audience are checked when not empty
+func NewVerifier(secret string, publicKeyFile string, issuer string, aud string) (*Verifier, error) {
+	v := &Verifier{
+		issuer:   issuer,
+		audience: aud,
+		now:      time.Now,
+	}
+	if secret != "" {
+		v.secret = []byte(secret)
+	}
+	if publicKeyFile != "" {
+		b, err := os.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, fmt.Errorf("%s: no PEM data", publicKeyFile)
+		}
+		v.key, err = x509.ParsePKIXPublicKey(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", publicKeyFile, err)
+		}
+	}
+	if v.secret == nil && v.key == nil {
+		return nil, fmt.Errorf("a secret or a public key is required to verify tokens")
+	}
+	return v, nil
+}
+
+// Verify checks the token and returns the identity it carries
+func (v *Verifier) Verify(token string) (Identity, error) {
+	var (
+		h  header
+		c  claims
+		id Identity
+	)
+
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	if token == "" {
+		return id, fmt.Errorf("%w: missing token", ErrUnauthenticated)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return id, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	err := decode(parts[0], &h)
+	if err != nil {
+		return id, fmt.Errorf("%w: header: %v", ErrUnauthenticated, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return id, fmt.Errorf("%w: signature: %v", ErrUnauthenticated, err)
+	}
+	err = v.verifySignature(h.Alg, parts[0]+"."+parts[1], sig)
+	if err != nil {
+		return id, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	err = decode(parts[1], &c)
+	if err != nil {
+		return id, fmt.Errorf("%w: claims: %v", ErrUnauthenticated, err)
+	}
+	err = v.validate(c)
+	if err != nil {
+		return id, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	id.Subject = c.Subject
+	id.Roles = make(map[string]Role, len(c.Roles))
+	for t, r := range c.Roles {
+		if _, ok := rank[Role(r)]; !ok {
+			return Identity{}, fmt.Errorf("%w: unknown role %q", ErrUnauthenticated, r)
+		}
+		id.Roles[t] = Role(r)
+	}
+	return id, nil
+}
+
+func (v *Verifier) validate(c claims) error {
+	now := v.now()
+	if c.Subject == "" {
+		return fmt.Errorf("missing sub claim")
+	}
+	if c.ExpiresAt == nil {
+		return fmt.Errorf("missing exp claim")
+	}
+	if now.After(time.Unix(int64(*c.ExpiresAt), 0).Add(skew)) {
+		return fmt.Errorf("token expired")
+	}
+	if c.NotBefore != nil && now.Add(skew).Before(time.Unix(int64(*c.NotBefore), 0)) {
+		return fmt.Errorf("token not valid yet")
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if v.audience != "" {
+		found := false
+		for _, a := range c.Audience {
+			found = found || a == v.audience
+		}
+		if !found {
+			return fmt.Errorf("token not issued for %q", v.audience)
+		}
+	}
+	return nil
+}
+
+func (v *Verifier) verifySignature(alg string, signed string, sig []byte) error {
+	var h crypto.Hash
+
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	switch alg[2:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	d := h.New()
+	d.Write([]byte(signed))
+	digest := d.Sum(nil)
+
+	switch alg[:2] {
+	case "HS":
+		if v.secret == nil {
+			return fmt.Errorf("algorithm %s not accepted", alg)
+		}
+		mac := hmac.New(h.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "RS":
+		k, ok := v.key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s not accepted", alg)
+		}
+		if rsa.VerifyPKCS1v15(k, h, digest, sig) != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "ES":
+		k, ok := v.key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s not accepted", alg)
+		}
+		// r and s are each padded to the byte size of the curve (RFC 7518 section 3.4)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature length %d, %s with this key needs %d bytes", len(sig), alg, 2*size)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+func decode(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
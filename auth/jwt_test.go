@@ -0,0 +1,362 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+
+const testSecret = "s3cr3t"
+
+func segment(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns a token signed with key: a []byte secret for HS, a private key for RS and ES
+func sign(t *testing.T, alg string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	return signRaw(t, alg, segment(t, claims), key)
+}
+
+// signRaw signs an encoded claims segment
+func signRaw(t *testing.T, alg string, claims string, key interface{}) string {
+	t.Helper()
+	signed := segment(t, map[string]string{"alg": alg, "typ": "JWT"}) + "." + claims
+
+	var h crypto.Hash
+	switch strings.TrimLeft(alg, "HRSE") {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	default:
+		h = crypto.SHA512
+	}
+	d := h.New()
+	d.Write([]byte(signed))
+	digest := d.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(h.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, h, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	case nil:
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeKey writes the PEM public key of k and returns its path and content
+func writeKey(t *testing.T, k crypto.PublicKey) (string, []byte) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, b
+}
+
+func verifier(t *testing.T, secret string, keyFile string, iss string, aud string) *Verifier {
+	t.Helper()
+	v, err := NewVerifier(secret, keyFile, iss, aud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func valid(extra map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"sub":   "alice",
+		"exp":   testNow.Add(time.Hour).Unix(),
+		"roles": map[string]string{"acme": "operator", "*": "viewer"},
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(c, k)
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	v := verifier(t, testSecret, "", "https://idp.example.com", "routermgt")
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := valid(map[string]interface{}{"iss": "https://idp.example.com", "aud": "routermgt"})
+		for k, x := range extra {
+			c[k] = x
+			if x == nil {
+				delete(c, k)
+			}
+		}
+		return c
+	}
+	secret := []byte(testSecret)
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", sign(t, "HS256", claims(nil), secret), ""},
+		{"bearer prefix", "Bearer " + sign(t, "HS256", claims(nil), secret), ""},
+		{"HS384", sign(t, "HS384", claims(nil), secret), ""},
+		{"HS512", sign(t, "HS512", claims(nil), secret), ""},
+		{"aud array", sign(t, "HS256", claims(map[string]interface{}{"aud": []string{"other", "routermgt"}}), secret), ""},
+		{"missing token", "", "missing token"},
+		{"two segments", "a.b", "malformed token"},
+		{"four segments", sign(t, "HS256", claims(nil), secret) + ".x", "malformed token"},
+		{"header not base64", "%%%." + segment(t, claims(nil)) + ".sig", "header"},
+		{"header not json", base64.RawURLEncoding.EncodeToString([]byte("{")) + "." + segment(t, claims(nil)) + ".", "header"},
+		{"signature not base64", sign(t, "HS256", claims(nil), secret) + "!", "signature"},
+		{"claims not base64", signRaw(t, "HS256", "%%%", secret), "claims"},
+		{"claims not json", signRaw(t, "HS256", base64.RawURLEncoding.EncodeToString([]byte("[")), secret), "claims"},
+		{"wrong secret", sign(t, "HS256", claims(nil), []byte("other")), "invalid signature"},
+		{"tampered claims", tamper(t, sign(t, "HS256", claims(nil), secret), claims(map[string]interface{}{"roles": map[string]string{"*": "admin"}})), "invalid signature"},
+		{"alg none", sign(t, "none", claims(nil), nil), "unsupported algorithm"},
+		{"alg NONE", sign(t, "NONE", claims(nil), nil), "unsupported algorithm"},
+		{"alg empty", sign(t, "", claims(nil), nil), "unsupported algorithm"},
+		{"alg HS1", sign(t, "HS1", claims(nil), nil), "unsupported algorithm"},
+		{"alg HS128", sign(t, "HS128", claims(nil), nil), "unsupported algorithm"},
+		{"RS without key", sign(t, "RS256", claims(nil), secret), "not accepted"},
+		{"ES without key", sign(t, "ES256", claims(nil), secret), "not accepted"},
+		{"missing sub", sign(t, "HS256", claims(map[string]interface{}{"sub": nil}), secret), "missing sub"},
+		{"missing exp", sign(t, "HS256", claims(map[string]interface{}{"exp": nil}), secret), "missing exp"},
+		{"expired", sign(t, "HS256", claims(map[string]interface{}{"exp": testNow.Add(-time.Minute).Unix()}), secret), "expired"},
+		{"expired within leeway", sign(t, "HS256", claims(map[string]interface{}{"exp": testNow.Add(-skew + time.Second).Unix()}), secret), ""},
+		{"not yet valid", sign(t, "HS256", claims(map[string]interface{}{"nbf": testNow.Add(time.Minute).Unix()}), secret), "not valid yet"},
+		{"nbf within leeway", sign(t, "HS256", claims(map[string]interface{}{"nbf": testNow.Add(skew - time.Second).Unix()}), secret), ""},
+		{"wrong issuer", sign(t, "HS256", claims(map[string]interface{}{"iss": "https://evil.example.com"}), secret), "unexpected issuer"},
+		{"missing issuer", sign(t, "HS256", claims(map[string]interface{}{"iss": nil}), secret), "unexpected issuer"},
+		{"wrong audience", sign(t, "HS256", claims(map[string]interface{}{"aud": "other"}), secret), "not issued for"},
+		{"missing audience", sign(t, "HS256", claims(map[string]interface{}{"aud": nil}), secret), "not issued for"},
+		{"unknown role", sign(t, "HS256", claims(map[string]interface{}{"roles": map[string]string{"acme": "root"}}), secret), "unknown role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := v.Verify(tt.token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if id.Subject != "alice" || id.Role("acme") != RoleOperator || id.Role("other") != RoleViewer {
+					t.Fatalf("unexpected identity %+v", id)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error %q, got identity %+v", tt.err, id)
+			}
+			if !errors.Is(err, ErrUnauthenticated) {
+				t.Errorf("error %v does not wrap ErrUnauthenticated", err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q does not contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// tamper replaces the claims of a signed token and keeps its signature
+func tamper(t *testing.T, token string, claims map[string]interface{}) string {
+	parts := strings.Split(token, ".")
+	parts[1] = segment(t, claims)
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyRSA(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, pub := writeKey(t, &k.PublicKey)
+	v := verifier(t, "", path, "", "")
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"RS256", sign(t, "RS256", valid(nil), k), ""},
+		{"RS512", sign(t, "RS512", valid(nil), k), ""},
+		{"other key", sign(t, "RS256", valid(nil), other), "invalid signature"},
+		{"hash mismatch", strings.Replace(sign(t, "RS256", valid(nil), k), segment(t, map[string]string{"alg": "RS256", "typ": "JWT"}), segment(t, map[string]string{"alg": "RS384", "typ": "JWT"}), 1), "invalid signature"},
+		// the public key must not be usable as an HMAC secret
+		{"HS signed with the public key", sign(t, "HS256", valid(nil), pub), "not accepted"},
+		{"ES with a RSA key", sign(t, "ES256", valid(nil), pub), "not accepted"},
+		{"alg none", sign(t, "none", valid(nil), nil), "unsupported algorithm"},
+		{"expired", sign(t, "RS256", valid(map[string]interface{}{"exp": testNow.Add(-time.Hour).Unix()}), k), "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(tt.token)
+			checkErr(t, err, tt.err)
+		})
+	}
+}
+
+func TestVerifyECDSA(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, pub := writeKey(t, &k.PublicKey)
+	v := verifier(t, "", path, "", "")
+
+	// replaces the signature of a valid token
+	withSig := func(sig []byte) string {
+		parts := strings.Split(sign(t, "ES256", valid(nil), k), ".")
+		return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"ES256", sign(t, "ES256", valid(nil), k), ""},
+		{"HS signed with the public key", sign(t, "HS256", valid(nil), pub), "not accepted"},
+		{"RS with an ECDSA key", sign(t, "RS256", valid(nil), pub), "not accepted"},
+		{"zero signature", withSig(make([]byte, 64)), "invalid signature"},
+		{"odd signature length", withSig(make([]byte, 63)), "invalid signature length 63"},
+		{"short signature", withSig(make([]byte, 62)), "invalid signature length 62"},
+		{"long signature", withSig(make([]byte, 66)), "invalid signature length 66"},
+		{"empty signature", withSig(nil), "invalid signature length 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(tt.token)
+			checkErr(t, err, tt.err)
+		})
+	}
+
+	// the length follows the curve of the key, 48 bytes for r and s on P-384
+	k384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ = writeKey(t, &k384.PublicKey)
+	v = verifier(t, "", path, "", "")
+	_, err = v.Verify(sign(t, "ES384", valid(nil), k384))
+	checkErr(t, err, "")
+	_, err = v.Verify(sign(t, "ES384", valid(nil), k))
+	checkErr(t, err, "invalid signature length 64")
+}
+
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("expected error %q", want)
+	}
+	if !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("error %v does not wrap ErrUnauthenticated", err)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	if _, err := NewVerifier("", "", "", ""); err == nil {
+		t.Error("a verifier without secret nor key must be rejected")
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVerifier("", path, "", ""); err == nil {
+		t.Error("a key file without PEM data must be rejected")
+	}
+	if _, err := NewVerifier("", filepath.Join(t.TempDir(), "missing.pem"), "", ""); err == nil {
+		t.Error("a missing key file must be rejected")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	id := Identity{Subject: "alice", Roles: map[string]Role{"acme": RoleOperator, AnyTenant: RoleViewer}}
+
+	tests := []struct {
+		tenant string
+		op     Operation
+		ok     bool
+	}{
+		{"acme", OpRead, true},
+		{"acme", OpWrite, true},
+		{"acme", OpDelete, false},
+		{"acme", OpAdmin, false},
+		{"other", OpRead, true},
+		{"other", OpWrite, false},
+		{"acme", Operation("unknown"), false},
+	}
+	for _, tt := range tests {
+		err := id.Authorize(tt.tenant, tt.op)
+		if (err == nil) != tt.ok {
+			t.Errorf("Authorize(%s, %s) = %v, want allowed %v", tt.tenant, tt.op, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrForbidden) {
+			t.Errorf("Authorize(%s, %s) = %v, does not wrap ErrForbidden", tt.tenant, tt.op, err)
+		}
+	}
+	if _, ok := (Identity{Roles: map[string]Role{AnyTenant: RoleAdmin}}).Tenant(); ok {
+		t.Error("the wildcard role has no default tenant")
+	}
+	if tenant, ok := (Identity{Roles: map[string]Role{"acme": RoleViewer}}).Tenant(); !ok || tenant != "acme" {
+		t.Errorf("Tenant() = %s, %v, want acme", tenant, ok)
+	}
+}
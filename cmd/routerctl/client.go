@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/adapter/controllers"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"os"
+)
+
+// message types, must match adapter/controllers
+const (
+	messageGet = iota + 100
+	messageGetPaged
+	messageCreate
+	messageDelete
+	messageDescribe
+	messageQuota
+	messageAudit
+	messageHistory
+	messageDiff
+	messageRestore
+	messageDeleted
+	messageUpdate
+	messageLabel
+	messageGroups
+	messageGroupSave
+	messageGroupDelete
+	messageAssign
+	messageTransition
+
+	eventSuffix   = ".events"
+	routingLegacy = "legacy"
+	success       = "sucess!"
+
+	headerError      = "Nats-Service-Error"
+	headerErrorCode  = "Nats-Service-Error-Code"
+	headerRetryAfter = "Retry-After"
+	headerVersion    = "Api-Version"
+	headerKey        = "Idempotency-Key"
+	headerRequestID  = "Request-Id"
+
+	// retries of a request that timed out, the changes carry an Idempotency-Key so that a
+	// retry does not report the routers created by the first attempt as duplicates
+	retries = 2
+
+	// protocol version the replies are decoded with
+	protocolVersion = "1"
+)
+
+// operations are the subject suffixes of each message type, must match adapter/controllers
+var operations = map[int]string{
+	messageGet:         "get",
+	messageGetPaged:    "list",
+	messageCreate:      "create",
+	messageDelete:      "delete",
+	messageQuota:       "quota",
+	messageAudit:       "audit",
+	messageHistory:     "history",
+	messageDiff:        "diff",
+	messageRestore:     "restore",
+	messageDeleted:     "deleted",
+	messageUpdate:      "update",
+	messageLabel:       "label",
+	messageGroups:      "groups",
+	messageGroupSave:   "group-save",
+	messageGroupDelete: "group-delete",
+	messageAssign:      "assign",
+	messageTransition:  "transition",
+}
+
+type message struct {
+	Mtype int    `json:"mtype"`
+	Data  []byte `json:"Data"`
+}
+
+type pagedResponse struct {
+	Last    int              `json:"last"`
+	Routers *[]domain.Router `json:"routers"`
+}
+
+type client struct {
+	con *nats.Conn
+	g   globals
+}
+
+func newClient(g globals) (*client, error) {
+	g.resolve()
+	opts, err := controllers.SecurityOptions(g.security)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := nats.Connect(g.nats, append(opts, nats.Name("routerctl"))...)
+	if err != nil {
+		return nil, fmt.Errorf("broker connection error: %w", err)
+	}
+	return &client{
+		con: nc,
+		g:   g,
+	}, nil
+}
+
+func (c *client) close() {
+	c.con.Close()
+}
+
+// request sends the payload on <subject>.<tenant>.<operation> and returns the raw reply.
+// Without tenant, or when the service only serves the legacy subject, the payload is wrapped
+// in the envelope and the service picks the tenant of the token.
+func (c *client) request(mtype int, payload interface{}) ([]byte, error) {
+	var (
+		m       message
+		b       []byte
+		rep     *nats.Msg
+		subject string
+		err     error
+	)
+	b, err = json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	op, ok := operations[mtype]
+	subject = c.g.subject + "." + c.g.tenant + "." + op
+	if !ok || c.g.tenant == "" || c.g.routing == routingLegacy {
+		m.Mtype = mtype
+		m.Data = b
+		b, err = json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		subject = c.g.subject
+	}
+	req := nats.NewMsg(subject)
+	req.Data = b
+	req.Header.Set(headerVersion, protocolVersion)
+	req.Header.Set(headerRequestID, nuid.Next())
+	if mtype == messageCreate || mtype == messageDelete || mtype == messageRestore || mtype == messageUpdate || mtype == messageLabel ||
+		mtype == messageGroupSave || mtype == messageGroupDelete || mtype == messageAssign || mtype == messageTransition {
+		req.Header.Set(headerKey, nuid.Next())
+	}
+	if c.g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.g.token)
+	}
+	if c.g.tenant != "" {
+		req.Header.Set("Tenant", c.g.tenant)
+	}
+	for i := 0; ; i++ {
+		rep, err = c.con.RequestMsg(req, c.g.timeout)
+		if !errors.Is(err, nats.ErrTimeout) || i == retries {
+			break
+		}
+		fmt.Fprintln(os.Stderr, "timeout, retrying...")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request on %s: %w", subject, err)
+	}
+	if e := rep.Header.Get(headerError); e != "" {
+		if ra := rep.Header.Get(headerRetryAfter); ra != "" {
+			return nil, fmt.Errorf("%s (code %s, retry after %ss)", e, rep.Header.Get(headerErrorCode), ra)
+		}
+		return nil, fmt.Errorf("%s (code %s)", e, rep.Header.Get(headerErrorCode))
+	}
+	return rep.Data, nil
+}
+
+// describe returns the protocol versions and the operations supported by the service
+func (c *client) describe() (json.RawMessage, error) {
+	b, err := c.request(messageDescribe, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(b), nil
+}
+
+// quota returns the usage of the tenant quotas
+func (c *client) quota() ([]domain.QuotaUsage, error) {
+	var rep controllers.QuotaResponse
+
+	b, err := c.request(messageQuota, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep.Quotas, nil
+}
+
+// audit returns a page of the audit trail
+func (c *client) audit(q domain.AuditQuery) (controllers.AuditResponse, error) {
+	var rep controllers.AuditResponse
+
+	b, err := c.request(messageAudit, q)
+	if err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return rep, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep, nil
+}
+
+// history returns the versions of a router, or the one valid at q.At
+func (c *client) history(q domain.HistoryQuery) ([]domain.RouterVersion, error) {
+	var rep controllers.HistoryResponse
+
+	b, err := c.request(messageHistory, q)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep.Versions, nil
+}
+
+func (c *client) diff(q domain.DiffQuery) (*domain.RouterDiff, error) {
+	var rep domain.RouterDiff
+
+	b, err := c.request(messageDiff, q)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return &rep, nil
+}
+
+// restore brings back deleted routers and returns the reply listing the missing ones
+func (c *client) restore(routers []domain.Router) (controllers.RestoreResponse, error) {
+	var rep controllers.RestoreResponse
+
+	b, err := c.request(messageRestore, routers)
+	if err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return rep, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep, nil
+}
+
+// deleted returns a page of the deleted routers
+func (c *client) deleted(page domain.Pagination) (controllers.DeletedResponse, error) {
+	var rep controllers.DeletedResponse
+
+	b, err := c.request(messageDeleted, page)
+	if err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return rep, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep, nil
+}
+
+func (c *client) get(serial string) (*domain.Router, error) {
+	var r domain.Router
+
+	b, err := c.request(messageGet, domain.Router{RouterSerial: serial})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return &r, nil
+}
+
+// list fetches every page from the API, q holds the sort and the filters
+func (c *client) list(q domain.Pagination) ([]domain.Router, error) {
+	var res []domain.Router
+
+	q.Limit = pageSize
+	for page := 0; ; page++ {
+		var rep pagedResponse
+
+		q.Page = page
+		b, err := c.request(messageGetPaged, q)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &rep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply: %w", err)
+		}
+		if rep.Routers == nil || len(*rep.Routers) == 0 {
+			return res, nil
+		}
+		res = append(res, *rep.Routers...)
+		if page >= rep.Last {
+			return res, nil
+		}
+	}
+}
+
+// create returns the routers already existing in the inventory
+func (c *client) create(routers []domain.Router) ([]domain.Router, error) {
+	var dup []domain.Router
+
+	b, err := c.request(messageCreate, routers)
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == success {
+		return nil, nil
+	}
+	err = json.Unmarshal(b, &dup)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return dup, nil
+}
+
+func (c *client) delete(routers []domain.Router) error {
+	b, err := c.request(messageDelete, routers)
+	if err != nil {
+		return err
+	}
+	if string(b) != success {
+		return fmt.Errorf("unexpected reply: %s", string(b))
+	}
+	return nil
+}
+
+// update replaces a router and returns it with its new revision
+func (c *client) update(r domain.Router) (*domain.Router, error) {
+	var rep domain.Router
+
+	b, err := c.request(messageUpdate, r)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return &rep, nil
+}
+
+// label sets and removes labels of routers
+func (c *client) label(req controllers.LabelRequest) (controllers.LabelResponse, error) {
+	var rep controllers.LabelResponse
+
+	b, err := c.request(messageLabel, req)
+	if err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return rep, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep, nil
+}
+
+// transition moves a router to another lifecycle state and returns it with its new revision
+func (c *client) transition(t domain.Transition) (*domain.Router, error) {
+	var rep domain.Router
+
+	b, err := c.request(messageTransition, t)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return &rep, nil
+}
+
+// groups returns the site hierarchy under root, every group when root is empty
+func (c *client) groups(root string) ([]domain.GroupCount, error) {
+	var rep controllers.GroupsResponse
+
+	b, err := c.request(messageGroups, controllers.GroupsRequest{Root: root})
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep.Groups, nil
+}
+
+func (c *client) saveGroup(grp domain.Group) error {
+	_, err := c.request(messageGroupSave, grp)
+	return err
+}
+
+func (c *client) deleteGroup(id string) error {
+	_, err := c.request(messageGroupDelete, domain.Group{ID: id})
+	return err
+}
+
+// assign moves routers to a group, an empty group removes them from their group
+func (c *client) assign(req controllers.AssignRequest) (controllers.AssignResponse, error) {
+	var rep controllers.AssignResponse
+
+	b, err := c.request(messageAssign, req)
+	if err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal(b, &rep)
+	if err != nil {
+		return rep, fmt.Errorf("invalid reply: %w", err)
+	}
+	return rep, nil
+}
+
+// watch calls fn for every event until stop is signaled
+func (c *client) watch(fn func(domain.RouterEvent), stop chan os.Signal) error {
+	// without tenant, the events of every tenant the broker lets us subscribe to
+	tenant := c.g.tenant
+	if tenant == "" {
+		tenant = "*"
+	}
+	subject := c.g.subject + "." + tenant + eventSuffix
+	sub, err := c.con.Subscribe(subject, func(msg *nats.Msg) {
+		var ev domain.RouterEvent
+		if err := json.Unmarshal(msg.Data, &ev); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid event: ", err)
+			return
+		}
+		fn(ev)
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	fmt.Fprintln(os.Stderr, "watching", subject, "(ctrl-c to stop)")
+	<-stop
+	return nil
+}
@@ -0,0 +1,923 @@
+/**
+ * @file    main.go
+ * @brief   routerctl, command line client of the routermgt service.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * routerctl talks to the service over NATS using the same protocol as the API server.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/adapter/controllers"
+	"github.com/Go-routine-4995/routermgt/config"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	configFile  = "conf.yml"
+	defaultNats = "nats://127.0.0.1:4222"
+	defaultSubj = "ns.oss.router"
+	pageSize    = 100
+	tokenEnv    = "ROUTERCTL_TOKEN"
+)
+
+// globals are the flags shared by every sub command
+type globals struct {
+	conf    string
+	nats    string
+	subject string
+	timeout time.Duration
+	output  string
+	tenant  string
+	token   string
+	// routing of the service, requests use <subject>.<tenant>.<operation> unless it is legacy
+	routing string
+	// security is read from the configuration file
+	security controllers.NatsOptions
+}
+
+// filters implements flag.Value to accept a repeatable --filter key=value
+type filters map[string]string
+
+func (f filters) String() string {
+	var s []string
+	for k, v := range f {
+		s = append(s, k+"="+v)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f filters) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("filter must be key=value, got %q", v)
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// names implements flag.Value to accept a repeatable flag
+type names []string
+
+func (n *names) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *names) Set(v string) error {
+	*n = append(*n, v)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: routerctl <command> [flags]
+
+Commands:
+  get     -serial <serial>           show one router
+  list    [-selector s] [-group g] [-state s] [-filter k=v] [-sort f]
+                                     list routers (-sort -f for descending order), -selector filters
+                                     by label on the server, e.g. 'ring=canary,site!=lab,tier in (a,b)',
+                                     -group keeps the routers of g and of its sub-groups, -state the
+                                     routers in one of the states, e.g. 'active,suspended'
+  create  -f <file.json>             create the routers listed in a JSON array
+  update  -serial <serial> -set k=v [-revision n]
+                                     change router fields, fails if the router changed since revision n
+                                     (default: the revision read before the update)
+  delete  -serial <serial>|-f <file> [-revision n]
+                                     delete one or several routers, -revision only with -serial
+  watch                              print create/delete events as they happen
+  describe                           show the protocol versions and operations of the service
+  quota                              show the router quotas of the tenant and their usage
+  audit   [-serial s] [-actor a] [-since d|-from t] [-to t] [-limit n] [-page n]
+                                     show who changed the routers, newest first
+  history -serial <serial> [-at t]   show the versions of a router, or the one valid at t (RFC 3339)
+  diff    -serial <serial> -from n [-to n]
+                                     compare two versions of a router (-to defaults to the latest)
+  transition -serial <serial> -state <state> [-reason r] [-revision n]
+                                     move a router along its lifecycle: ordered, provisioned, active,
+                                     suspended, rma, decommissioned
+  label   -serial <serial>|-f <file> [-set k=v] [-remove k]
+                                     set and remove labels of one or several routers
+  groups  [-root id]                 show the group hierarchy with the routers of each group and
+                                     the total including the sub-groups
+  group-save -id <id> [-name n] [-parent id]
+                                     create or change a group, -parent moves it with its sub-groups
+  group-delete -id <id>              delete a group without sub-groups nor routers
+  assign  -serial <serial>|-f <file> -group <id>
+                                     move one or several routers to a group
+  unassign -serial <serial>|-f <file>
+                                     remove one or several routers from their group
+  restore -serial <serial>|-f <file> restore one or several deleted routers
+  deleted [-limit n] [-page n]       list the deleted routers that can be restored, newest first
+
+Common flags:
+  -config  configuration file (default %s)
+  -nats    NATS url, overrides the configuration file
+  -subject API subject, overrides the configuration file
+  -timeout request timeout (default 5s)
+  -o       output format: table, json or csv (default table)
+  -tenant  tenant of the routers, defaults to the only tenant of the token
+  -token   JWT of the caller (default $%s)
+`, configFile, tokenEnv)
+}
+
+func main() {
+	var (
+		g   globals
+		err error
+	)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&g.conf, "config", configFile, "configuration file")
+	fs.StringVar(&g.nats, "nats", "", "NATS url")
+	fs.StringVar(&g.subject, "subject", "", "API subject")
+	fs.DurationVar(&g.timeout, "timeout", 5*time.Second, "request timeout")
+	fs.StringVar(&g.output, "o", "table", "output format: table, json or csv")
+	fs.StringVar(&g.tenant, "tenant", "", "tenant, defaults to the only tenant of the token")
+	fs.StringVar(&g.token, "token", os.Getenv(tokenEnv), "JWT sent in the Authorization header (default $"+tokenEnv+")")
+
+	switch cmd {
+	case "get":
+		serial := fs.String("serial", "", "router serial")
+		_ = fs.Parse(os.Args[2:])
+		err = runGet(g, *serial)
+	case "list":
+		var q domain.Pagination
+		f := make(filters)
+		fs.Var(f, "filter", "filter key=value, can be repeated")
+		fs.StringVar(&q.Sort, "sort", "", "sort field, prefix with - for descending order")
+		fs.StringVar(&q.Selector, "selector", "", "label selector")
+		fs.StringVar(&q.Group, "group", "", "group, including its sub-groups")
+		fs.StringVar(&q.State, "state", "", "comma separated lifecycle states")
+		_ = fs.Parse(os.Args[2:])
+		err = runList(g, f, q)
+	case "create":
+		file := fs.String("f", "", "JSON file containing an array of routers")
+		_ = fs.Parse(os.Args[2:])
+		err = runCreate(g, *file)
+	case "update":
+		set := make(filters)
+		serial := fs.String("serial", "", "router serial")
+		fs.Var(set, "set", "field to change key=value, can be repeated")
+		revision := fs.Int("revision", 0, "expected revision of the router")
+		_ = fs.Parse(os.Args[2:])
+		err = runUpdate(g, *serial, set, *revision)
+	case "delete":
+		serial := fs.String("serial", "", "router serial")
+		file := fs.String("f", "", "JSON file containing an array of routers")
+		revision := fs.Int("revision", 0, "expected revision of the router")
+		_ = fs.Parse(os.Args[2:])
+		err = runDelete(g, *serial, *file, *revision)
+	case "watch":
+		_ = fs.Parse(os.Args[2:])
+		err = runWatch(g)
+	case "describe":
+		_ = fs.Parse(os.Args[2:])
+		err = runDescribe(g)
+	case "quota":
+		_ = fs.Parse(os.Args[2:])
+		err = runQuota(g)
+	case "audit":
+		var q domain.AuditQuery
+		fs.StringVar(&q.RouterSerial, "serial", "", "router serial")
+		fs.StringVar(&q.Actor, "actor", "", "subject of the caller")
+		since := fs.Duration("since", 0, "entries of the last duration, e.g. 24h")
+		from := fs.String("from", "", "RFC 3339 start time, inclusive")
+		to := fs.String("to", "", "RFC 3339 end time, exclusive")
+		fs.IntVar(&q.Limit, "limit", 50, "entries per page")
+		fs.IntVar(&q.Page, "page", 0, "page, 0 is the newest")
+		_ = fs.Parse(os.Args[2:])
+		err = runAudit(g, q, *since, *from, *to)
+	case "history":
+		serial := fs.String("serial", "", "router serial")
+		at := fs.String("at", "", "RFC 3339 time")
+		_ = fs.Parse(os.Args[2:])
+		err = runHistory(g, *serial, *at)
+	case "diff":
+		var q domain.DiffQuery
+		fs.StringVar(&q.RouterSerial, "serial", "", "router serial")
+		fs.IntVar(&q.From, "from", 0, "first version")
+		fs.IntVar(&q.To, "to", 0, "second version, the latest when 0")
+		_ = fs.Parse(os.Args[2:])
+		err = runDiff(g, q)
+	case "transition":
+		var t domain.Transition
+		fs.StringVar(&t.RouterSerial, "serial", "", "router serial")
+		fs.StringVar(&t.State, "state", "", "new state")
+		fs.StringVar(&t.Reason, "reason", "", "reason of the transition")
+		fs.IntVar(&t.Revision, "revision", 0, "expected revision of the router")
+		_ = fs.Parse(os.Args[2:])
+		err = runTransition(g, t)
+	case "label":
+		var remove names
+		set := make(filters)
+		serial := fs.String("serial", "", "router serial")
+		file := fs.String("f", "", "JSON file containing an array of routers")
+		fs.Var(set, "set", "label to set key=value, can be repeated")
+		fs.Var(&remove, "remove", "label key to remove, can be repeated")
+		_ = fs.Parse(os.Args[2:])
+		err = runLabel(g, *serial, *file, set, remove)
+	case "groups":
+		root := fs.String("root", "", "group at the top of the tree")
+		_ = fs.Parse(os.Args[2:])
+		err = runGroups(g, *root)
+	case "group-save":
+		var grp domain.Group
+		fs.StringVar(&grp.ID, "id", "", "group id")
+		fs.StringVar(&grp.Name, "name", "", "display name")
+		fs.StringVar(&grp.Parent, "parent", "", "parent group, none for a root")
+		_ = fs.Parse(os.Args[2:])
+		err = runGroupSave(g, grp)
+	case "group-delete":
+		id := fs.String("id", "", "group id")
+		_ = fs.Parse(os.Args[2:])
+		err = runGroupDelete(g, *id)
+	case "assign", "unassign":
+		group := new(string)
+		serial := fs.String("serial", "", "router serial")
+		file := fs.String("f", "", "JSON file containing an array of routers")
+		if cmd == "assign" {
+			group = fs.String("group", "", "group id")
+		}
+		_ = fs.Parse(os.Args[2:])
+		if cmd == "assign" && *group == "" {
+			err = fmt.Errorf("-group is required, use unassign to remove routers from their group")
+			break
+		}
+		err = runAssign(g, *serial, *file, *group)
+	case "restore":
+		serial := fs.String("serial", "", "router serial")
+		file := fs.String("f", "", "JSON file containing an array of routers")
+		_ = fs.Parse(os.Args[2:])
+		err = runRestore(g, *serial, *file)
+	case "deleted":
+		var page domain.Pagination
+		fs.IntVar(&page.Limit, "limit", 50, "routers per page")
+		fs.IntVar(&page.Page, "page", 0, "page, 0 is the most recent")
+		_ = fs.Parse(os.Args[2:])
+		err = runDeleted(g, page)
+	case "help", "-h", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// resolve merges the configuration (file and environment) with the command line flags, flags win
+func (g *globals) resolve() {
+	cfg, err := config.Load(g.conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: cannot read", g.conf, err)
+	}
+	if g.nats == "" {
+		g.nats = cfg.Service.Nats
+	}
+	if g.nats == "" {
+		g.nats = defaultNats
+	}
+	if g.subject == "" {
+		g.subject = cfg.Service.Subject
+	}
+	if g.subject == "" {
+		g.subject = defaultSubj
+	}
+	g.routing = cfg.Service.Routing
+	g.security = controllers.NatsOptions{
+		CredsFile:    cfg.Service.CredsFile,
+		NKeySeedFile: cfg.Service.NKeySeedFile,
+		Token:        cfg.Service.Token,
+		User:         cfg.Service.User,
+		Password:     cfg.Service.Password,
+		TLSCert:      cfg.Service.TLS.ClientCert,
+		TLSKey:       cfg.Service.TLS.ClientKey,
+		TLSCA:        cfg.Service.TLS.CA,
+	}
+}
+
+func runGet(g globals, serial string) error {
+	if serial == "" {
+		return fmt.Errorf("-serial is required")
+	}
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	r, err := c.get(serial)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("router %s not found", serial)
+	}
+	return printRouters(os.Stdout, g.output, []domain.Router{*r})
+}
+
+func runList(g globals, f filters, q domain.Pagination) error {
+	var (
+		all []domain.Router
+		res []domain.Router
+	)
+	for _, k := range keysOf(f) {
+		if _, ok := fieldValue(domain.Router{}, k); !ok {
+			return fmt.Errorf("unknown filter field %q", k)
+		}
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	all, err = c.list(q)
+	if err != nil {
+		return err
+	}
+	for _, r := range all {
+		if match(r, f) {
+			res = append(res, r)
+		}
+	}
+	if q.Sort != "" {
+		err = sortRouters(res, q.Sort)
+		if err != nil {
+			return err
+		}
+	}
+	return printRouters(os.Stdout, g.output, res)
+}
+
+func runCreate(g globals, file string) error {
+	routers, err := readRouters(file)
+	if err != nil {
+		return err
+	}
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	dup, err := c.create(routers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d router(s) created\n", len(routers)-len(dup))
+	if len(dup) > 0 {
+		fmt.Printf("%d router(s) already existing:\n", len(dup))
+		return printRouters(os.Stdout, g.output, dup)
+	}
+	return nil
+}
+
+// selectRouters returns the router given by -serial or the routers of the -f file
+func selectRouters(serial string, file string) ([]domain.Router, error) {
+	switch {
+	case serial != "" && file != "":
+		return nil, fmt.Errorf("-serial and -f are mutually exclusive")
+	case serial != "":
+		return []domain.Router{{RouterSerial: serial}}, nil
+	case file != "":
+		return readRouters(file)
+	}
+	return nil, fmt.Errorf("-serial or -f is required")
+}
+
+func runUpdate(g globals, serial string, set filters, revision int) error {
+	if serial == "" || len(set) == 0 {
+		return fmt.Errorf("-serial and -set are required")
+	}
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	r, err := c.get(serial)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("router %s not found", serial)
+	}
+	if revision != 0 {
+		r.Revision = revision
+	}
+	for _, k := range keysOf(set) {
+		err = setField(r, k, set[k])
+		if err != nil {
+			return err
+		}
+	}
+	r, err = c.update(*r)
+	if err != nil {
+		return err
+	}
+	return printRouters(os.Stdout, g.output, []domain.Router{*r})
+}
+
+func runDelete(g globals, serial string, file string, revision int) error {
+	if revision != 0 && serial == "" {
+		return fmt.Errorf("-revision requires -serial")
+	}
+	routers, err := selectRouters(serial, file)
+	if err != nil {
+		return err
+	}
+	if revision != 0 {
+		routers[0].Revision = revision
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.delete(routers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d router(s) deleted\n", len(routers))
+	return nil
+}
+
+func runTransition(g globals, t domain.Transition) error {
+	if t.RouterSerial == "" || t.State == "" {
+		return fmt.Errorf("-serial and -state are required")
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	r, err := c.transition(t)
+	if err != nil {
+		return err
+	}
+	return printRouters(os.Stdout, g.output, []domain.Router{*r})
+}
+
+func runLabel(g globals, serial string, file string, set filters, remove names) error {
+	if len(set) == 0 && len(remove) == 0 {
+		return fmt.Errorf("-set or -remove is required")
+	}
+	routers, err := selectRouters(serial, file)
+	if err != nil {
+		return err
+	}
+	req := controllers.LabelRequest{LabelChange: domain.LabelChange{Set: set, Remove: remove}}
+	for _, r := range routers {
+		req.RouterSerials = append(req.RouterSerials, r.RouterSerial)
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	rep, err := c.label(req)
+	if err != nil {
+		return err
+	}
+	if len(rep.Missing) > 0 {
+		fmt.Fprintf(os.Stderr, "%d router(s) not found: %s\n", len(rep.Missing), strings.Join(rep.Missing, ", "))
+	}
+	return printRouters(os.Stdout, g.output, rep.Routers)
+}
+
+func runGroups(g globals, root string) error {
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	groups, err := c.groups(root)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		b, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "group\tname\trouters\ttotal")
+	for _, n := range groups {
+		fmt.Fprintf(tw, "%s%s\t%s\t%d\t%d\n", strings.Repeat("  ", n.Depth), n.ID, n.Name, n.Routers, n.Total)
+	}
+	return tw.Flush()
+}
+
+func runGroupSave(g globals, grp domain.Group) error {
+	if grp.ID == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.saveGroup(grp)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("group %s saved\n", grp.ID)
+	return nil
+}
+
+func runGroupDelete(g globals, id string) error {
+	if id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.deleteGroup(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("group %s deleted\n", id)
+	return nil
+}
+
+func runAssign(g globals, serial string, file string, group string) error {
+	routers, err := selectRouters(serial, file)
+	if err != nil {
+		return err
+	}
+	req := controllers.AssignRequest{Group: group}
+	for _, r := range routers {
+		req.RouterSerials = append(req.RouterSerials, r.RouterSerial)
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	rep, err := c.assign(req)
+	if err != nil {
+		return err
+	}
+	if len(rep.Missing) > 0 {
+		fmt.Fprintf(os.Stderr, "%d router(s) not found: %s\n", len(rep.Missing), strings.Join(rep.Missing, ", "))
+	}
+	return printRouters(os.Stdout, g.output, rep.Routers)
+}
+
+func runRestore(g globals, serial string, file string) error {
+	routers, err := selectRouters(serial, file)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	rep, err := c.restore(routers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d router(s) restored\n", len(rep.Restored))
+	if len(rep.Missing) > 0 {
+		fmt.Printf("%d router(s) not deleted or already purged:\n", len(rep.Missing))
+		return printRouters(os.Stdout, g.output, rep.Missing)
+	}
+	return nil
+}
+
+func runDeleted(g globals, page domain.Pagination) error {
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	rep, err := c.deleted(page)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "router-serial	deleted-at	deleted-by")
+	for _, d := range rep.Routers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Router.RouterSerial, d.DeletedAt.Format(time.RFC3339), d.DeletedBy)
+	}
+	fmt.Fprintf(tw, "page %d/%d\n", rep.Page, rep.Last)
+	return tw.Flush()
+}
+
+func runWatch(g globals) error {
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	return c.watch(func(ev domain.RouterEvent) {
+		if g.output == "json" {
+			b, _ := json.Marshal(ev)
+			fmt.Println(string(b))
+			return
+		}
+		fmt.Printf("%s %s tenant=%s routers=%d\n", ev.Time, ev.Type, ev.Tenant, len(ev.Routers))
+		_ = printRouters(os.Stdout, g.output, ev.Routers)
+	}, stop)
+}
+
+func runDescribe(g globals) error {
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	d, err := c.describe()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func runQuota(g globals) error {
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	usage, err := c.quota()
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		b, err := json.MarshalIndent(usage, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "tenant\taccount-id\tused\tlimit")
+	for _, u := range usage {
+		limit := "unlimited"
+		if u.Limit > 0 {
+			limit = strconv.Itoa(u.Limit)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", u.Tenant, u.AccountID, u.Used, limit)
+	}
+	return tw.Flush()
+}
+
+func runAudit(g globals, q domain.AuditQuery, since time.Duration, from string, to string) error {
+	var err error
+
+	if since > 0 && from != "" {
+		return fmt.Errorf("-since and -from are mutually exclusive")
+	}
+	if since > 0 {
+		q.From = time.Now().Add(-since)
+	}
+	if from != "" {
+		q.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+	if to != "" {
+		q.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	rep, err := c.audit(q)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "time\taction\trouter-serial\tactor\trequest-id")
+	for _, e := range rep.Entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Action, e.RouterSerial, e.Actor, e.RequestID)
+	}
+	fmt.Fprintf(tw, "page %d/%d\n", rep.Page, rep.Last)
+	return tw.Flush()
+}
+
+func runHistory(g globals, serial string, at string) error {
+	var (
+		q   domain.HistoryQuery
+		err error
+	)
+	if serial == "" {
+		return fmt.Errorf("-serial is required")
+	}
+	q.RouterSerial = serial
+	if at != "" {
+		q.At, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			return fmt.Errorf("-at: %w", err)
+		}
+	}
+
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	versions, err := c.history(q)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		b, err := json.MarshalIndent(versions, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "version\tvalid-from\tvalid-to")
+	for _, v := range versions {
+		to := "current"
+		if v.ValidTo != nil {
+			to = v.ValidTo.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", v.Version, v.ValidFrom.Format(time.RFC3339), to)
+	}
+	err = tw.Flush()
+	if err != nil || len(versions) != 1 {
+		return err
+	}
+	fmt.Println()
+	return printRouters(os.Stdout, g.output, []domain.Router{versions[0].Router})
+}
+
+func runDiff(g globals, q domain.DiffQuery) error {
+	if q.RouterSerial == "" || q.From == 0 {
+		return fmt.Errorf("-serial and -from are required")
+	}
+	c, err := newClient(g)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	d, err := c.diff(q)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		b, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	fmt.Printf("router %s, version %d -> %d\n", d.RouterSerial, d.From, d.To)
+	if len(d.Changes) == 0 {
+		fmt.Println("no change")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "field\tfrom\tto")
+	for _, c := range d.Changes {
+		fmt.Fprintf(tw, "%s\t%q\t%q\n", c.Field, c.From, c.To)
+	}
+	return tw.Flush()
+}
+
+func readRouters(file string) ([]domain.Router, error) {
+	var routers []domain.Router
+
+	if file == "" {
+		return nil, fmt.Errorf("-f is required")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &routers)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(routers) == 0 {
+		return nil, fmt.Errorf("%s: no router found", file)
+	}
+	return routers, nil
+}
+
+func match(r domain.Router, f filters) bool {
+	for k, want := range f {
+		v, _ := fieldValue(r, k)
+		if v != want {
+			return false
+		}
+	}
+	return true
+}
+
+func sortRouters(routers []domain.Router, by string) error {
+	desc := strings.HasPrefix(by, "-")
+	by = strings.TrimPrefix(by, "-")
+	if _, ok := fieldValue(domain.Router{}, by); !ok {
+		return fmt.Errorf("unknown sort field %q", by)
+	}
+	sort.SliceStable(routers, func(i, j int) bool {
+		a, _ := fieldValue(routers[i], by)
+		b, _ := fieldValue(routers[j], by)
+		if desc {
+			return a > b
+		}
+		return a < b
+	})
+	return nil
+}
+
+func keysOf(f filters) []string {
+	var k []string
+	for key := range f {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fleet() []domain.Router {
+	return []domain.Router{
+		{RouterSerial: "S2", OperatorName: "orange", IsoCountryCode: "FR", Revision: 1},
+		{RouterSerial: "S1", OperatorName: "vodafone", IsoCountryCode: "DE", Revision: 3, Labels: map[string]string{"ring": "canary"}},
+		{RouterSerial: "S3", OperatorName: "orange", IsoCountryCode: "ES", Revision: 2, State: domain.StateSuspended},
+	}
+}
+
+func serials(routers []domain.Router) []string {
+	res := []string{}
+	for _, r := range routers {
+		res = append(res, r.RouterSerial)
+	}
+	return res
+}
+
+func TestFilters(t *testing.T) {
+	f := filters{}
+	for _, v := range []string{"operator-name=orange", "labels=a=b"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if !reflect.DeepEqual(f, filters{"operator-name": "orange", "labels": "a=b"}) {
+		t.Errorf("unexpected filters %v", f)
+	}
+	for _, v := range []string{"orange", "=orange"} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("Set(%q) accepted", v)
+		}
+	}
+	if got := keysOf(f); !reflect.DeepEqual(got, []string{"labels", "operator-name"}) {
+		t.Errorf("keysOf = %v", got)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		f       filters
+		serials []string
+	}{
+		{"no filter", filters{}, []string{"S2", "S1", "S3"}},
+		{"one field", filters{"operator-name": "orange"}, []string{"S2", "S3"}},
+		{"all fields", filters{"operator-name": "orange", "iso-country-code": "ES"}, []string{"S3"}},
+		{"default state", filters{"state": "active"}, []string{"S2", "S1"}},
+		{"labels", filters{"labels": "ring=canary"}, []string{"S1"}},
+		{"unknown field", filters{"colour": "red"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []domain.Router
+			for _, r := range fleet() {
+				if match(r, tt.f) {
+					got = append(got, r)
+				}
+			}
+			if s := serials(got); !reflect.DeepEqual(s, tt.serials) {
+				t.Errorf("got %v, want %v", s, tt.serials)
+			}
+		})
+	}
+}
+
+func TestSortRouters(t *testing.T) {
+	tests := []struct {
+		by      string
+		serials []string
+		err     bool
+	}{
+		{"router-serial", []string{"S1", "S2", "S3"}, false},
+		{"-router-serial", []string{"S3", "S2", "S1"}, false},
+		{"revision", []string{"S2", "S3", "S1"}, false},
+		// stable, the routers of the same operator keep their order
+		{"operator-name", []string{"S2", "S3", "S1"}, false},
+		{"colour", []string{"S2", "S1", "S3"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.by, func(t *testing.T) {
+			routers := fleet()
+			err := sortRouters(routers, tt.by)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s := serials(routers); !reflect.DeepEqual(s, tt.serials) {
+				t.Errorf("got %v, want %v", s, tt.serials)
+			}
+		})
+	}
+}
+
+func TestSetField(t *testing.T) {
+	var r domain.Router
+	for _, c := range []string{"router-id", "operator-name", "iso-country-code", "mac", "router-model", "account-id", "agent-last-connection", "agent-version", "group"} {
+		if err := setField(&r, c, "v-"+c); err != nil {
+			t.Fatalf("setField(%q): %v", c, err)
+		}
+		if v, _ := fieldValue(r, c); v != "v-"+c {
+			t.Errorf("%s is %q after setField", c, v)
+		}
+	}
+	for _, c := range []string{"router-serial", "revision", "state", "labels", "colour"} {
+		if err := setField(&r, c, "1"); err == nil {
+			t.Errorf("setField(%q) accepted", c)
+		}
+	}
+}
+
+func TestFieldValue(t *testing.T) {
+	since := time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+	r := domain.Router{Revision: 4, Labels: map[string]string{"ring": "canary", "az": "1"}, StateSince: &since}
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"revision", "4", true},
+		{"labels", "az=1,ring=canary", true},
+		{"state", domain.StateActive, true},
+		{"state-since", "2023-06-17T12:00:00Z", true},
+		{"state-reason", "", true},
+		{"colour", "", false},
+	}
+	for _, tt := range tests {
+		if v, ok := fieldValue(r, tt.name); v != tt.value || ok != tt.ok {
+			t.Errorf("fieldValue(%q) = %q %v, want %q %v", tt.name, v, ok, tt.value, tt.ok)
+		}
+	}
+	// every column is a known field
+	for _, c := range columns {
+		if _, ok := fieldValue(r, c); !ok {
+			t.Errorf("column %q is not a field", c)
+		}
+	}
+}
+
+func TestPrintRouters(t *testing.T) {
+	routers := fleet()[:1]
+
+	var b bytes.Buffer
+	if err := printRouters(&b, "json", nil); err != nil || strings.TrimSpace(b.String()) != "[]" {
+		t.Errorf("json without router: %q %v", b.String(), err)
+	}
+
+	b.Reset()
+	if err := printRouters(&b, "json", routers); err != nil {
+		t.Fatal(err)
+	}
+	var got []domain.Router
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil || !reflect.DeepEqual(got, routers) {
+		t.Errorf("json round trip: %+v %v", got, err)
+	}
+
+	b.Reset()
+	if err := printRouters(&b, "csv", routers); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || lines[0] != strings.Join(columns, ",") || !strings.HasPrefix(lines[1], ",S2,orange,FR,") {
+		t.Errorf("unexpected csv:\n%s", b.String())
+	}
+
+	b.Reset()
+	if err := printRouters(&b, "table", routers); err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "router-id") || !strings.Contains(lines[1], "orange") {
+		t.Errorf("unexpected table:\n%s", b.String())
+	}
+
+	if err := printRouters(&b, "xml", routers); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
+
+func TestReadRouters(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		serials []string
+		err     string
+	}{
+		{"routers", write("ok.json", `[{"router-serial":"S1"},{"router-serial":"S2"}]`), []string{"S1", "S2"}, ""},
+		{"no file", "", nil, "-f is required"},
+		{"missing file", filepath.Join(dir, "none.json"), nil, "none.json"},
+		{"invalid json", write("bad.json", `{"router-serial":"S1"}`), nil, "bad.json"},
+		{"empty list", write("empty.json", `[]`), nil, "no router found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routers, err := readRouters(tt.file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s := serials(routers); !reflect.DeepEqual(s, tt.serials) {
+				t.Errorf("got %v, want %v", s, tt.serials)
+			}
+		})
+	}
+}
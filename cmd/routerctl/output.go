@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// columns are the router fields printed by table and csv output, named after their json tags
+var columns = []string{
+	"router-id",
+	"router-serial",
+	"operator-name",
+	"iso-country-code",
+	"mac",
+	"router-model",
+	"account-id",
+	"agent-last-connection",
+	"agent-version",
+	"revision",
+	"labels",
+	"group",
+	"state",
+	"state-since",
+	"state-reason",
+}
+
+// fieldValue returns a router field by its json name
+func fieldValue(r domain.Router, name string) (string, bool) {
+	switch name {
+	case "router-id":
+		return r.RouterID, true
+	case "router-serial":
+		return r.RouterSerial, true
+	case "operator-name":
+		return r.OperatorName, true
+	case "iso-country-code":
+		return r.IsoCountryCode, true
+	case "mac":
+		return r.Mac, true
+	case "router-model":
+		return r.RouterModel, true
+	case "account-id":
+		return r.AccountID, true
+	case "agent-last-connection":
+		return r.AgentLastConnection, true
+	case "agent-version":
+		return r.AgentVersion, true
+	case "revision":
+		return strconv.Itoa(r.Revision), true
+	case "labels":
+		return formatLabels(r.Labels), true
+	case "group":
+		return r.Group, true
+	case "state":
+		return r.CurrentState(), true
+	case "state-since":
+		if r.StateSince == nil {
+			return "", true
+		}
+		return r.StateSince.Format(time.RFC3339), true
+	case "state-reason":
+		return r.StateReason, true
+	}
+	return "", false
+}
+
+// formatLabels returns the labels as a selector, sorted by key
+func formatLabels(labels map[string]string) string {
+	res := make([]string, 0, len(labels))
+	for k, v := range labels {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// setField changes a router field by its json name, the serial, the revision and the state cannot be set
+func setField(r *domain.Router, name string, value string) error {
+	switch name {
+	case "router-id":
+		r.RouterID = value
+	case "operator-name":
+		r.OperatorName = value
+	case "iso-country-code":
+		r.IsoCountryCode = value
+	case "mac":
+		r.Mac = value
+	case "router-model":
+		r.RouterModel = value
+	case "account-id":
+		r.AccountID = value
+	case "agent-last-connection":
+		r.AgentLastConnection = value
+	case "agent-version":
+		r.AgentVersion = value
+	case "group":
+		r.Group = value
+	default:
+		return fmt.Errorf("field %q cannot be set", name)
+	}
+	return nil
+}
+
+func printRouters(w io.Writer, format string, routers []domain.Router) error {
+	switch format {
+	case "json":
+		if routers == nil {
+			routers = []domain.Router{}
+		}
+		b, err := json.MarshalIndent(routers, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write(columns)
+		for _, r := range routers {
+			_ = cw.Write(row(r))
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for i, c := range columns {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, c)
+		}
+		fmt.Fprintln(tw)
+		for _, r := range routers {
+			for i, v := range row(r) {
+				if i > 0 {
+					fmt.Fprint(tw, "\t")
+				}
+				fmt.Fprint(tw, v)
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func row(r domain.Router) []string {
+	res := make([]string, len(columns))
+	for i, c := range columns {
+		res[i], _ = fieldValue(r, c)
+	}
+	return res
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/adapter/controllers"
+	"github.com/Go-routine-4995/routermgt/adapter/health"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/postgres"
+	"github.com/Go-routine-4995/routermgt/auth"
+	"github.com/Go-routine-4995/routermgt/config"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"github.com/Go-routine-4995/routermgt/lifecycle"
+	"github.com/Go-routine-4995/routermgt/logging"
+	"github.com/Go-routine-4995/routermgt/ratelimit"
+	"github.com/Go-routine-4995/routermgt/schema"
+	"github.com/Go-routine-4995/routermgt/service"
+	"github.com/nats-io/nats.go"
+	"os"
+	"time"
+)
+
+const (
+	// tenant of the API requests without Tenant header when authentication is disabled
+	defaultTenant = "test"
+	exportPage    = 500
+	checkTimeout  = 5 * time.Second
+	// cliConnectAttempts bounds the connection of the one-shot commands when the
+	// configuration retries forever, serve keeps waiting for the database
+	cliConnectAttempts = 3
+)
+
+func pgOptions(cfg config.Config) postgres.Options {
+	return postgres.Options{
+		Address:    cfg.Database.Address,
+		User:       cfg.Database.User,
+		Password:   cfg.Database.Password,
+		Database:   cfg.Database.Database,
+		ClientCert: cfg.Database.ClientCert,
+		ClientKey:  cfg.Database.ClientKey,
+		ServerCert: cfg.Database.ServerCert,
+		TLSMode:    cfg.Database.TLSMode,
+		ServerName: cfg.Database.ServerName,
+
+		PoolSize:        cfg.Database.Pool.Size,
+		MinIdleConns:    cfg.Database.Pool.MinIdle,
+		MaxConnAge:      cfg.Database.Pool.MaxConnAge,
+		IdleTimeout:     cfg.Database.Pool.IdleTimeout,
+		PoolTimeout:     cfg.Database.Pool.Timeout,
+		DialTimeout:     cfg.Database.DialTimeout,
+		ReadTimeout:     cfg.Database.ReadTimeout,
+		WriteTimeout:    cfg.Database.WriteTimeout,
+		ConnectAttempts: cfg.Database.Retry.ConnectAttempts,
+		RetryBackoff:    cfg.Database.Retry.Backoff,
+		MaxRetryBackoff: cfg.Database.Retry.MaxBackoff,
+		QueryRetries:    cfg.Database.Retry.QueryRetries,
+	}
+}
+
+// cliPgOptions are the options of the commands other than serve, they fail when the database is down
+func cliPgOptions(cfg config.Config) postgres.Options {
+	o := pgOptions(cfg)
+	if o.ConnectAttempts <= 0 {
+		o.ConnectAttempts = cliConnectAttempts
+	}
+	return o
+}
+
+// rateLimitOptions returns no limit when the rate limiting is disabled
+func rateLimitOptions(cfg config.Config) ratelimit.Options {
+	var o ratelimit.Options
+
+	if !cfg.RateLimit.Enabled {
+		return o
+	}
+	o.MaxBatch = cfg.RateLimit.MaxBatch
+	o.Default = ratelimit.Limit{Rate: cfg.RateLimit.Rate, Burst: cfg.RateLimit.Burst}
+	o.Operations = make(map[string]ratelimit.Limit)
+	for op, l := range cfg.RateLimit.Operations {
+		o.Operations[op] = ratelimit.Limit{Rate: l.Rate, Burst: l.Burst}
+	}
+	o.Tenants = make(map[string]map[string]ratelimit.Limit)
+	for tenant, ops := range cfg.RateLimit.Tenants {
+		o.Tenants[tenant] = make(map[string]ratelimit.Limit)
+		for op, l := range ops {
+			o.Tenants[tenant][op] = ratelimit.Limit{Rate: l.Rate, Burst: l.Burst}
+		}
+	}
+	return o
+}
+
+func natsOptions(cfg config.Config) controllers.NatsOptions {
+	return controllers.NatsOptions{
+		Name:                 "routermgt " + version,
+		ConnectTimeout:       cfg.Service.ConnectTimeout,
+		ReconnectWait:        cfg.Service.Reconnect.Wait,
+		ReconnectJitter:      cfg.Service.Reconnect.Jitter,
+		MaxReconnects:        cfg.Service.Reconnect.Max,
+		RetryOnFailedConnect: cfg.Service.RetryOnFailedConnect,
+		ReconnectBufSize:     cfg.Service.Reconnect.BufferSize,
+		CredsFile:            cfg.Service.CredsFile,
+		NKeySeedFile:         cfg.Service.NKeySeedFile,
+		Token:                cfg.Service.Token,
+		User:                 cfg.Service.User,
+		Password:             cfg.Service.Password,
+		TLSCert:              cfg.Service.TLS.ClientCert,
+		TLSKey:               cfg.Service.TLS.ClientKey,
+		TLSCA:                cfg.Service.TLS.CA,
+	}
+}
+
+func serve(file string, cfg config.Config) error {
+	fmt.Println("Starting OSS Routers/service", version)
+	fmt.Printf("configuration:\n%s", cfg)
+
+	err := logging.SetLevel(cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	lm := lifecycle.NewManager(cfg.Service.ShutdownTimeout)
+
+	// new repo
+	//r := simdb.NewSimDB()
+	r, err := postgres.NewPostgres(pgOptions(cfg))
+	if err != nil {
+		return err
+	}
+
+	// new service
+	core := service.NewService(r)
+
+	// new rate limiter, always in the chain so that it can be enabled by a reload
+	limiter := ratelimit.NewRateLimitService(core, rateLimitOptions(cfg))
+
+	// new logger
+	svc := logging.NewLoggingService(limiter)
+
+	// new Api
+	api, err := controllers.NewApiService(svc, cfg.Service.Nats, cfg.Service.Subject, natsOptions(cfg))
+	if err != nil {
+		r.Close()
+		return err
+	}
+	core.SetPublisher(api)
+	api.SetTimeout(cfg.Service.Timeout)
+	api.SetInfo("routermgt", version)
+	err = api.SetRouting(cfg.Service.Routing)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	api.SetIdempotency(r, cfg.Service.IdempotencyWindow)
+	api.AddStatus("version", func() interface{} { return version })
+	api.AddStatus("repository", func() interface{} { return r.Stats() })
+	if cfg.Auth.Enabled {
+		v, err := auth.NewVerifier(cfg.Auth.Secret, cfg.Auth.PublicKey, cfg.Auth.Issuer, cfg.Auth.Audience)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		api.SetVerifier(v)
+	}
+
+	// live settings, see reload:"live" in config.Config
+	rl := config.NewReloader(file, cfg)
+	rl.OnReload(func(c config.Config) error {
+		return logging.SetLevel(c.Log.Level)
+	})
+	rl.OnReload(func(c config.Config) error {
+		api.SetTimeout(c.Service.Timeout)
+		return nil
+	})
+	rl.OnReload(func(c config.Config) error {
+		limiter.SetOptions(rateLimitOptions(c))
+		return nil
+	})
+	rl.OnReload(func(c config.Config) error {
+		if c.Database.ClientCert == "" {
+			return nil
+		}
+		return r.ReloadTLS(c.Database.ClientCert, c.Database.ClientKey, c.Database.ServerCert)
+	})
+	rl.OnReload(func(c config.Config) error {
+		if c.Service.TLS.ClientCert != "" || c.Service.TLS.CA != "" {
+			// the NATS client reads service.tls again when it reconnects, the current connection keeps its certificates
+			fmt.Println("service.tls certificates are not reloaded, they are used from the next NATS reconnect")
+		}
+		return nil
+	})
+	var hs *health.Server
+	if cfg.Health.Listen != "" {
+		hs = health.NewServer(cfg.Health.Listen, cfg.Health.Timeout)
+		hs.AddCheck("broker", api.Ready)
+		hs.AddCheck("repository", r.Ping)
+		hs.Handle("/schemas", schema.Handler(controllers.Schemas()))
+		hs.Handle("/schemas/", schema.Handler(controllers.Schemas()))
+		err = hs.Start()
+		if err != nil {
+			api.Shutdown(context.Background())
+			r.Close()
+			return err
+		}
+	}
+
+	// stopped in this order: the probes fail first, the API drains its requests and the background
+	// tasks return before the repository is closed
+	if hs != nil {
+		lm.OnShutdown("health", hs.Shutdown)
+	}
+	lm.OnShutdown("api", api.Shutdown)
+	lm.OnShutdown("background tasks", lm.WaitTasks)
+	lm.OnShutdown("repository", func(ctx context.Context) error {
+		return r.Close()
+	})
+
+	err = api.Start()
+	if err != nil {
+		// stops the probes, the broker connection and the repository
+		lm.Shutdown(nil)
+		return err
+	}
+
+	// the background tasks stop with lm.Context()
+	lm.Go(rl.Run)
+	lm.Go(func(ctx context.Context) {
+		purge(ctx, "expired idempotency keys", time.Hour, r.PurgeIdempotencyKeys)
+	})
+	retention := cfg.Service.DeletedRetention
+	if retention == 0 {
+		retention = defaultDeletedRetention
+	}
+	lm.Go(func(ctx context.Context) {
+		purge(ctx, "deleted routers", time.Hour, func(ctx context.Context) (int, error) {
+			return r.PurgeDeleted(ctx, time.Now().Add(-retention))
+		})
+	})
+
+	if code := lm.Wait(); code != lifecycle.ExitClean {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// defaultDeletedRetention is how long the deleted routers are kept when service.deleted-retention is not set
+const defaultDeletedRetention = 30 * 24 * time.Hour
+
+// purge calls fn every interval until ctx is done, what names the purged rows in the logs
+func purge(ctx context.Context, what string, interval time.Duration, fn func(ctx context.Context) (int, error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := fn(ctx)
+			if err != nil {
+				fmt.Printf("purging %s: %v\n", what, err)
+				continue
+			}
+			if n > 0 {
+				fmt.Printf("%d %s purged\n", n, what)
+			}
+		}
+	}
+}
+
+func migrate(cfg config.Config, action string) error {
+	var ctx context.Context
+
+	if action != "up" && action != "down" && action != "status" {
+		return fmt.Errorf("usage: routermgt migrate up|down|status")
+	}
+
+	r, err := postgres.NewPostgres(cliPgOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ctx = context.Background()
+
+	switch action {
+	case "up":
+		done, err := r.MigrateUp(ctx)
+		for _, m := range done {
+			fmt.Printf("applied %d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		m, err := r.MigrateDown(ctx)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("no migration to revert")
+			return nil
+		}
+		fmt.Printf("reverted %d %s\n", m.Version, m.Name)
+	case "status":
+		st, err := r.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range st {
+			if m.Applied {
+				fmt.Printf("%4d %-30s applied %s\n", m.Version, m.Name, m.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%4d %-30s pending\n", m.Version, m.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkConfig validates the file and tries every backend it references, it reports all the problems at once
+func checkConfig(file string) error {
+	var failed bool
+
+	report := func(what string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL %s: %v\n", what, err)
+			return
+		}
+		fmt.Printf("OK   %s\n", what)
+	}
+
+	cfg, err := config.Load(file)
+	report("load "+file, err)
+	if err != nil {
+		return errors.New("invalid configuration")
+	}
+	report("validate", cfg.Validate())
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	report("database "+cfg.Database.Address, postgres.Check(ctx, pgOptions(cfg)))
+
+	opts, err := controllers.SecurityOptions(natsOptions(cfg))
+	if err == nil {
+		var nc *nats.Conn
+		nc, err = nats.Connect(cfg.Service.Nats, append(opts, nats.Timeout(checkTimeout))...)
+		if err == nil {
+			nc.Close()
+		}
+	}
+	report("broker "+cfg.Service.Nats, err)
+
+	if failed {
+		return errors.New("invalid configuration")
+	}
+	return nil
+}
+
+func importRouters(cfg config.Config, file string, tenant string) error {
+	var routers []domain.Router
+
+	if file == "" {
+		return errors.New("-f is required")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &routers)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	r, err := postgres.NewPostgres(cliPgOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	svc := service.NewService(r)
+
+	ctx := domain.WithActor(context.Background(), domain.Actor{Name: "routermgt import " + file})
+	dup, err := svc.ImportRouters(ctx, routers, tenant)
+	if err != nil {
+		return err
+	}
+	n := 0
+	if dup != nil {
+		n = len(*dup)
+	}
+	fmt.Printf("%d router(s) imported, %d already existing\n", len(routers)-n, n)
+	return nil
+}
+
+// quotas prints the usage of the tenant quotas after setting (limit >= 0) or removing one
+func quotas(cfg config.Config, tenant string, account string, limit int, del bool) error {
+	var err error
+
+	if del && limit >= 0 {
+		return errors.New("-limit and -delete are mutually exclusive")
+	}
+	r, err := postgres.NewPostgres(cliPgOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	switch {
+	case del:
+		err = r.DeleteQuota(ctx, tenant, account)
+	case limit >= 0:
+		err = r.SetQuota(ctx, domain.Quota{Tenant: tenant, AccountID: account, Limit: limit})
+	}
+	if err != nil {
+		return err
+	}
+
+	usage, err := r.QuotaUsage(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	for _, u := range usage {
+		name, max := "tenant "+tenant, "unlimited"
+		if u.AccountID != "" {
+			name = "account " + u.AccountID
+		}
+		if u.Limit > 0 {
+			max = fmt.Sprintf("%d (%d%%)", u.Limit, u.Used*100/u.Limit)
+		}
+		fmt.Printf("%-30s %6d / %s\n", name, u.Used, max)
+	}
+	return nil
+}
+
+func exportRouters(cfg config.Config, file string, tenant string) error {
+	var (
+		all []domain.Router
+		out *os.File
+	)
+
+	r, err := postgres.NewPostgres(cliPgOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	svc := service.NewService(r)
+
+	all = make([]domain.Router, 0)
+	for page := 0; ; page++ {
+		routers, last, err := svc.GetPagedRouters(context.Background(), domain.Pagination{Limit: exportPage, Page: page}, tenant)
+		if err != nil {
+			return err
+		}
+		if routers != nil {
+			all = append(all, *routers...)
+		}
+		if routers == nil || len(*routers) == 0 || page >= last {
+			break
+		}
+	}
+
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = os.Stdout
+	if file != "" {
+		out, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	if err == nil && file != "" {
+		fmt.Fprintf(os.Stderr, "%d router(s) exported to %s\n", len(all), file)
+	}
+	return err
+}
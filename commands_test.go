@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/Go-routine-4995/routermgt/config"
+	"testing"
+	"time"
+)
+
+func TestPgOptions(t *testing.T) {
+	var cfg config.Config
+	cfg.Database.Address = "db:5432"
+	cfg.Database.TLSMode = "verify-full"
+	cfg.Database.Pool.Size = 10
+	cfg.Database.Pool.MinIdle = 2
+	cfg.Database.Pool.Timeout = time.Second
+	cfg.Database.Retry.Backoff = time.Second
+	cfg.Database.Retry.MaxBackoff = time.Minute
+	cfg.Database.Retry.QueryRetries = 2
+
+	o := pgOptions(cfg)
+	if o.Address != "db:5432" || o.TLSMode != "verify-full" || o.PoolSize != 10 || o.MinIdleConns != 2 || o.PoolTimeout != time.Second {
+		t.Errorf("unexpected options %+v", o)
+	}
+	if o.RetryBackoff != time.Second || o.MaxRetryBackoff != time.Minute || o.QueryRetries != 2 {
+		t.Errorf("unexpected retries %+v", o)
+	}
+	// serve waits for the database, the other commands give up
+	if o.ConnectAttempts != 0 {
+		t.Errorf("serve gives up after %d attempts", o.ConnectAttempts)
+	}
+	if o = cliPgOptions(cfg); o.ConnectAttempts != cliConnectAttempts {
+		t.Errorf("commands give up after %d attempts, want %d", o.ConnectAttempts, cliConnectAttempts)
+	}
+	cfg.Database.Retry.ConnectAttempts = 10
+	if o = cliPgOptions(cfg); o.ConnectAttempts != 10 {
+		t.Errorf("configured attempts replaced by %d", o.ConnectAttempts)
+	}
+}
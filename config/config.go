@@ -0,0 +1,439 @@
+/**
+ * @file    config.go
+ * @brief   Service configuration.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * The configuration is read from a YAML file, then every field can be overridden by an
+ * environment variable named after its YAML path: database.client-cert -> ROUTERMGT_DATABASE_CLIENT_CERT.
+ * Appending _FILE to the variable name reads the value from a file (Docker/Kubernetes secrets).
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvPrefix  = "ROUTERMGT"
+	fileSuffix = "_FILE"
+	redacted   = "*****"
+)
+
+// Config fields tagged secret:"true" are never printed, fields tagged reload:"live" are
+// applied by a reload (SIGHUP), any other change requires a restart.
+type Config struct {
+	Service struct {
+		Nats    string        `yaml:"nats" required:"true"`
+		Subject string        `yaml:"subject" required:"true"`
+		Timeout time.Duration `yaml:"timeout" reload:"live"`
+		// Routing selects the API subjects: legacy (<subject>, Mtype envelope), subject
+		// (<subject>.<tenant>.<operation>, plain JSON) or both (default)
+		Routing string `yaml:"routing"`
+		// IdempotencyWindow is how long the replies of requests sent with an Idempotency-Key
+		// are replayed to retries, 24h when not set
+		IdempotencyWindow time.Duration `yaml:"idempotency-window"`
+		// DeletedRetention is how long the deleted routers can be restored before they are
+		// purged, 720h (30 days) when not set
+		DeletedRetention time.Duration `yaml:"deleted-retention"`
+		// ShutdownTimeout bounds the time given to in-flight requests on SIGINT/SIGTERM
+		ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+		ConnectTimeout  time.Duration `yaml:"connect-timeout"`
+		// RetryOnFailedConnect starts the service even when the broker is not reachable yet
+		RetryOnFailedConnect bool `yaml:"retry-on-failed-connect"`
+
+		Reconnect struct {
+			Wait   time.Duration `yaml:"wait"`
+			Jitter time.Duration `yaml:"jitter"`
+			// Max attempts, -1 retries forever, 0 keeps the client default (60)
+			Max int `yaml:"max"`
+			// BufferSize in bytes of the replies kept while disconnected, -1 disables buffering
+			BufferSize int `yaml:"buffer-size"`
+		} `yaml:"reconnect"`
+
+		// broker authentication, use only one of creds-file, nkey-seed-file, token or user/password
+		CredsFile    string `yaml:"creds-file"`
+		NKeySeedFile string `yaml:"nkey-seed-file"`
+		Token        string `yaml:"token" secret:"true"`
+		User         string `yaml:"user"`
+		Password     string `yaml:"password" secret:"true"`
+		TLS          struct {
+			ClientCert string `yaml:"client-cert"`
+			ClientKey  string `yaml:"client-key"`
+			CA         string `yaml:"ca"`
+		} `yaml:"tls"`
+	} `yaml:"service"`
+	Database struct {
+		PubKey     string `yaml:"pubKey"`
+		ClientCert string `yaml:"client-cert" reload:"live"`
+		ClientKey  string `yaml:"client-key" reload:"live"`
+		ServerCert string `yaml:"server-cert" reload:"live"`
+		// TLSMode mirrors libpq sslmode: disable, require, verify-ca or verify-full (default)
+		TLSMode string `yaml:"tls-mode"`
+		// ServerName checked by verify-full, the host of address when empty
+		ServerName string `yaml:"server-name"`
+		Address    string `yaml:"address" required:"true"`
+		User       string `yaml:"user" required:"true"`
+		Password   string `yaml:"password" secret:"true"`
+		Database   string `yaml:"database" required:"true"`
+
+		DialTimeout  time.Duration `yaml:"dial-timeout"`
+		ReadTimeout  time.Duration `yaml:"read-timeout"`
+		WriteTimeout time.Duration `yaml:"write-timeout"`
+
+		Pool struct {
+			Size        int           `yaml:"size"`
+			MinIdle     int           `yaml:"min-idle"`
+			MaxConnAge  time.Duration `yaml:"max-conn-age"`
+			IdleTimeout time.Duration `yaml:"idle-timeout"`
+			// Timeout waiting for a free connection when the pool is exhausted
+			Timeout time.Duration `yaml:"timeout"`
+		} `yaml:"pool"`
+		Retry struct {
+			// ConnectAttempts at startup, 0 retries until the database answers (serve only, the
+			// other commands give up after 3 attempts)
+			ConnectAttempts int           `yaml:"connect-attempts"`
+			Backoff         time.Duration `yaml:"backoff"`
+			MaxBackoff      time.Duration `yaml:"max-backoff"`
+			// QueryRetries on network errors
+			QueryRetries int `yaml:"query-retries"`
+		} `yaml:"retry"`
+	} `yaml:"database"`
+	Server struct {
+		Url string `yaml:"nats"`
+	} `yaml:"server"`
+	Auth struct {
+		// Enabled requires a JWT in the Authorization header of every request
+		Enabled   bool   `yaml:"enabled"`
+		Secret    string `yaml:"secret" secret:"true"`
+		PublicKey string `yaml:"public-key"`
+		Issuer    string `yaml:"issuer"`
+		Audience  string `yaml:"audience"`
+	} `yaml:"auth"`
+	RateLimit struct {
+		// Enabled limits the requests of each tenant, see Limit
+		Enabled bool `yaml:"enabled" reload:"live"`
+		// MaxBatch routers per create or delete request, 0 is unlimited
+		MaxBatch int `yaml:"max-batch" reload:"live"`
+		// Rate and Burst are the default limit of every tenant and operation
+		Rate  float64 `yaml:"rate" reload:"live"`
+		Burst int     `yaml:"burst" reload:"live"`
+		// Operations overrides the default per operation (get, list, create, delete, quota, audit, history, diff)
+		Operations map[string]Limit `yaml:"operations" reload:"live"`
+		// Tenants overrides the limits per tenant then operation, "*" matches every operation
+		Tenants map[string]map[string]Limit `yaml:"tenants" reload:"live"`
+	} `yaml:"ratelimit"`
+	Health struct {
+		// Listen address of the /healthz and /readyz probes, empty disables them
+		Listen string `yaml:"listen"`
+		// Timeout of each readiness check
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"health"`
+	Log struct {
+		Level string `yaml:"level" reload:"live"`
+	} `yaml:"log"`
+	Reload struct {
+		// Watch polls the configuration file and reloads it when it changes, SIGHUP always works
+		Watch    bool          `yaml:"watch"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"reload"`
+}
+
+// Limit is a token bucket: Rate requests per second with bursts of Burst requests, a rate of 0 is unlimited
+type Limit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+var limitedOperations = map[string]bool{"get": true, "list": true, "create": true, "delete": true, "update": true, "label": true, "assign": true, "transition": true, "groups": true, "quota": true, "audit": true, "history": true, "diff": true, "restore": true, "deleted": true, "*": true}
+
+var logLevels = map[string]bool{
+	"": true, "trace": true, "debug": true, "info": true, "warn": true,
+	"error": true, "fatal": true, "panic": true, "disabled": true,
+}
+
+// Load reads the YAML file and applies the environment overrides, the file is optional
+// when every required field is provided by the environment.
+func Load(file string) (Config, error) {
+	var cfg Config
+
+	f, err := os.Open(file)
+	switch {
+	case err == nil:
+		defer f.Close()
+		err = yaml.NewDecoder(f).Decode(&cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", file, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// environment only configuration
+	default:
+		return cfg, err
+	}
+
+	err = applyEnv(reflect.ValueOf(&cfg).Elem(), EnvPrefix, "")
+	return cfg, err
+}
+
+// Validate reports every missing or invalid field at once
+func (c Config) Validate() error {
+	var errs []error
+
+	walk(reflect.ValueOf(c), EnvPrefix, "", func(f reflect.StructField, v reflect.Value, env string, path string) {
+		if f.Tag.Get("required") == "true" && v.IsZero() {
+			errs = append(errs, fmt.Errorf("%s is required (set it in the configuration file or with %s)", path, env))
+		}
+	})
+	if !logLevels[c.Log.Level] {
+		errs = append(errs, fmt.Errorf("log.level: unknown level %q", c.Log.Level))
+	}
+	if c.Service.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("service.timeout must be positive"))
+	}
+	switch c.Service.Routing {
+	case "", "legacy", "subject", "both":
+	default:
+		errs = append(errs, fmt.Errorf("service.routing: unknown mode %q (legacy, subject or both)", c.Service.Routing))
+	}
+	auth := 0
+	for _, v := range []string{c.Service.CredsFile, c.Service.NKeySeedFile, c.Service.Token, c.Service.User} {
+		if v != "" {
+			auth++
+		}
+	}
+	if auth > 1 {
+		errs = append(errs, fmt.Errorf("service: creds-file, nkey-seed-file, token and user are mutually exclusive"))
+	}
+	if (c.Service.TLS.ClientCert == "") != (c.Service.TLS.ClientKey == "") {
+		errs = append(errs, fmt.Errorf("service.tls: client-cert and client-key must be set together"))
+	}
+	for _, f := range []struct {
+		path string
+		file string
+	}{
+		{"service.creds-file", c.Service.CredsFile},
+		{"service.nkey-seed-file", c.Service.NKeySeedFile},
+		{"service.tls.client-cert", c.Service.TLS.ClientCert},
+		{"service.tls.client-key", c.Service.TLS.ClientKey},
+		{"service.tls.ca", c.Service.TLS.CA},
+		{"auth.public-key", c.Auth.PublicKey},
+		{"database.client-cert", c.Database.ClientCert},
+		{"database.client-key", c.Database.ClientKey},
+		{"database.server-cert", c.Database.ServerCert},
+	} {
+		if f.file == "" {
+			continue
+		}
+		if _, err := os.Stat(f.file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.path, err))
+		}
+	}
+	switch c.Database.TLSMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		errs = append(errs, fmt.Errorf("database.tls-mode: unknown mode %q (disable, require, verify-ca, verify-full)", c.Database.TLSMode))
+	}
+	if (c.Database.TLSMode == "" || strings.HasPrefix(c.Database.TLSMode, "verify-")) && c.Database.ServerCert == "" {
+		errs = append(errs, fmt.Errorf("database.server-cert is required by tls-mode %s", c.Database.TLSMode))
+	}
+	if c.Database.Pool.Size < 0 || c.Database.Pool.MinIdle < 0 || c.Database.Retry.ConnectAttempts < 0 || c.Database.Retry.QueryRetries < 0 {
+		errs = append(errs, fmt.Errorf("database: pool sizes and retry counts must be positive"))
+	}
+	if c.Database.Pool.Size > 0 && c.Database.Pool.MinIdle > c.Database.Pool.Size {
+		errs = append(errs, fmt.Errorf("database.pool.min-idle (%d) exceeds database.pool.size (%d)", c.Database.Pool.MinIdle, c.Database.Pool.Size))
+	}
+	if c.Auth.Enabled && c.Auth.Secret == "" && c.Auth.PublicKey == "" {
+		errs = append(errs, fmt.Errorf("auth: secret or public-key is required when enabled (%s)", EnvName("auth.secret")))
+	}
+	if c.Service.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("service.shutdown-timeout must be positive"))
+	}
+	if c.Service.IdempotencyWindow < 0 {
+		errs = append(errs, fmt.Errorf("service.idempotency-window must be positive"))
+	}
+	if c.Service.DeletedRetention < 0 {
+		errs = append(errs, fmt.Errorf("service.deleted-retention must be positive"))
+	}
+	if c.RateLimit.MaxBatch < 0 || !validLimit(Limit{c.RateLimit.Rate, c.RateLimit.Burst}) {
+		errs = append(errs, fmt.Errorf("ratelimit: max-batch, rate and burst must be positive"))
+	}
+	for op, l := range c.RateLimit.Operations {
+		if !limitedOperations[op] || op == "*" {
+			errs = append(errs, fmt.Errorf("ratelimit.operations: unknown operation %q (get, list, create, delete, update, label, assign, transition, groups, quota, audit, history, diff, restore, deleted)", op))
+		}
+		if !validLimit(l) {
+			errs = append(errs, fmt.Errorf("ratelimit.operations.%s: rate and burst must be positive", op))
+		}
+	}
+	for tenant, ops := range c.RateLimit.Tenants {
+		for op, l := range ops {
+			if !limitedOperations[op] {
+				errs = append(errs, fmt.Errorf("ratelimit.tenants.%s: unknown operation %q (get, list, create, delete, update, label, assign, transition, groups, quota, audit, history, diff, restore, deleted or *)", tenant, op))
+			}
+			if !validLimit(l) {
+				errs = append(errs, fmt.Errorf("ratelimit.tenants.%s.%s: rate and burst must be positive", tenant, op))
+			}
+		}
+	}
+	if c.Health.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("health.timeout must be positive"))
+	}
+	if c.Reload.Interval < 0 {
+		errs = append(errs, fmt.Errorf("reload.interval must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validLimit(l Limit) bool {
+	return l.Rate >= 0 && l.Burst >= 0
+}
+
+// Redacted returns a copy of the configuration where secrets are masked
+func (c Config) Redacted() Config {
+	v := reflect.ValueOf(&c).Elem()
+	walk(v, EnvPrefix, "", func(f reflect.StructField, v reflect.Value, env string, path string) {
+		if f.Tag.Get("secret") == "true" && !v.IsZero() && v.Kind() == reflect.String {
+			v.SetString(redacted)
+		}
+	})
+	return c
+}
+
+// String makes sure secrets are redacted whenever the configuration is logged
+func (c Config) String() string {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// GoString covers the %#v verb
+func (c Config) GoString() string {
+	return c.String()
+}
+
+// EnvName returns the variable overriding the field at the given YAML path, e.g. database.password
+func EnvName(path string) string {
+	r := strings.NewReplacer(".", "_", "-", "_")
+	return EnvPrefix + "_" + strings.ToUpper(r.Replace(path))
+}
+
+// yamlName returns the key of the field in the YAML file
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "" || name == "-" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// walk calls fn for every leaf field with its environment variable name and YAML path
+func walk(v reflect.Value, env string, path string, fn func(f reflect.StructField, v reflect.Value, env string, path string)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := yamlName(f)
+		p := name
+		if path != "" {
+			p = path + "." + name
+		}
+		e := env + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Time{}) {
+			walk(v.Field(i), e, p, fn)
+			continue
+		}
+		fn(f, v.Field(i), e, p)
+	}
+}
+
+func applyEnv(v reflect.Value, env string, path string) error {
+	var errs []error
+
+	walk(v, env, path, func(f reflect.StructField, v reflect.Value, env string, path string) {
+		val, ok, err := lookup(env)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			return
+		}
+		if !ok {
+			return
+		}
+		err = set(v, val)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value from %s: %w", path, env, err))
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// lookup returns the value of env, or the content of the file named by env_FILE
+func lookup(env string) (string, bool, error) {
+	if val, ok := os.LookupEnv(env); ok {
+		return val, true, nil
+	}
+	file, ok := os.LookupEnv(env + fileSuffix)
+	if !ok {
+		return "", false, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("%s%s: %w", env, fileSuffix, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+func set(v reflect.Value, val string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(val)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var s []string
+		for _, p := range strings.Split(val, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				s = append(s, p)
+			}
+		}
+		v.Set(reflect.ValueOf(s))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `service:
+  nats: nats://127.0.0.1:4222
+  subject: routers
+  timeout: 2s
+database:
+  address: db:5432
+  user: routermgt
+  password: file-password
+  database: routers
+  tls-mode: disable
+ratelimit:
+  rate: 10
+  burst: 20
+log:
+  level: info
+`
+
+// writeFile writes content in a temporary directory and returns its path
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		path string
+		env  string
+	}{
+		{"database.password", "ROUTERMGT_DATABASE_PASSWORD"},
+		{"database.client-cert", "ROUTERMGT_DATABASE_CLIENT_CERT"},
+		{"service.tls.ca", "ROUTERMGT_SERVICE_TLS_CA"},
+	}
+	for _, tt := range tests {
+		if got := EnvName(tt.path); got != tt.env {
+			t.Errorf("EnvName(%q) = %q, want %q", tt.path, got, tt.env)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	file := writeFile(t, "config.yml", testConfig)
+	secret := writeFile(t, "password", "secret-password\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c Config) bool
+		err   string
+	}{
+		{"file only", nil, func(c Config) bool {
+			return c.Database.Password == "file-password" && c.Service.Timeout == 2*time.Second
+		}, ""},
+		{"string", map[string]string{"ROUTERMGT_DATABASE_USER": "admin"}, func(c Config) bool {
+			return c.Database.User == "admin"
+		}, ""},
+		{"duration", map[string]string{"ROUTERMGT_SERVICE_TIMEOUT": "5s"}, func(c Config) bool {
+			return c.Service.Timeout == 5*time.Second
+		}, ""},
+		{"bool int float", map[string]string{"ROUTERMGT_RATELIMIT_ENABLED": "true", "ROUTERMGT_RATELIMIT_BURST": "7", "ROUTERMGT_RATELIMIT_RATE": "0.5"}, func(c Config) bool {
+			return c.RateLimit.Enabled && c.RateLimit.Burst == 7 && c.RateLimit.Rate == 0.5
+		}, ""},
+		{"file variable", map[string]string{"ROUTERMGT_DATABASE_PASSWORD_FILE": secret}, func(c Config) bool {
+			return c.Database.Password == "secret-password"
+		}, ""},
+		{"variable before file variable", map[string]string{"ROUTERMGT_DATABASE_PASSWORD": "env-password", "ROUTERMGT_DATABASE_PASSWORD_FILE": secret}, func(c Config) bool {
+			return c.Database.Password == "env-password"
+		}, ""},
+		{"empty variable", map[string]string{"ROUTERMGT_DATABASE_PASSWORD": ""}, func(c Config) bool {
+			return c.Database.Password == ""
+		}, ""},
+		{"missing file", map[string]string{"ROUTERMGT_DATABASE_PASSWORD_FILE": filepath.Join(t.TempDir(), "none")}, nil, "ROUTERMGT_DATABASE_PASSWORD_FILE"},
+		{"invalid duration", map[string]string{"ROUTERMGT_SERVICE_TIMEOUT": "soon"}, nil, "service.timeout: invalid value from ROUTERMGT_SERVICE_TIMEOUT"},
+		{"invalid int", map[string]string{"ROUTERMGT_RATELIMIT_BURST": "many"}, nil, "ratelimit.burst"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := Load(file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.check(c) {
+				t.Errorf("unexpected configuration %#v", c.Redacted())
+			}
+		})
+	}
+}
+
+func TestLoadEnvOnly(t *testing.T) {
+	t.Setenv("ROUTERMGT_SERVICE_NATS", "nats://127.0.0.1:4222")
+	t.Setenv("ROUTERMGT_SERVICE_SUBJECT", "routers")
+	t.Setenv("ROUTERMGT_DATABASE_ADDRESS", "db:5432")
+	t.Setenv("ROUTERMGT_DATABASE_USER", "routermgt")
+	t.Setenv("ROUTERMGT_DATABASE_DATABASE", "routers")
+	t.Setenv("ROUTERMGT_DATABASE_TLS_MODE", "disable")
+
+	c, err := Load(filepath.Join(t.TempDir(), "none.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Service.Subject = ""
+	err = c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "service.subject is required (set it in the configuration file or with ROUTERMGT_SERVICE_SUBJECT)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c, err := Load(writeFile(t, "config.yml", testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.String(); strings.Contains(s, "file-password") || !strings.Contains(s, redacted) {
+		t.Errorf("password not redacted:\n%s", s)
+	}
+	if c.Database.Password != "file-password" {
+		t.Errorf("Redacted changed the configuration")
+	}
+}
+
+func TestValidatePool(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"pool", func(c *Config) {
+			c.Database.Pool.Size = 10
+			c.Database.Pool.MinIdle = 10
+		}, ""},
+		{"idle above size", func(c *Config) {
+			c.Database.Pool.Size = 5
+			c.Database.Pool.MinIdle = 6
+		}, "database.pool.min-idle (6) exceeds database.pool.size (5)"},
+		{"negative size", func(c *Config) { c.Database.Pool.Size = -1 }, "must be positive"},
+		{"negative attempts", func(c *Config) { c.Database.Retry.ConnectAttempts = -1 }, "must be positive"},
+		{"negative retries", func(c *Config) { c.Database.Retry.QueryRetries = -1 }, "must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Load(writeFile(t, "config.yml", testConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(&c)
+			err = c.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
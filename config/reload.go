@@ -0,0 +1,168 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultWatchInterval = 5 * time.Second
+
+// Reloader applies the live settings of the configuration file on SIGHUP, and optionally
+// when the file changes on disk.
+type Reloader struct {
+	file    string
+	mu      sync.Mutex
+	current Config
+	hooks   []func(Config) error
+}
+
+func NewReloader(file string, cfg Config) *Reloader {
+	return &Reloader{
+		file:    file,
+		current: cfg,
+	}
+}
+
+// OnReload registers fn, it is called with the effective configuration after each reload.
+// Hooks are always called, even when no field changed, so that certificates rotated under
+// the same file name are picked up.
+func (r *Reloader) OnReload(fn func(Config) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+// Current returns the configuration in effect
+func (r *Reloader) Current() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload reads the configuration again and applies its live settings. It returns the settings
+// applied and the ones that changed but need a restart, those keep their previous value.
+func (r *Reloader) Reload() (live []string, restart []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := Load(r.file)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	effective := r.current
+	live, restart = merge(reflect.ValueOf(&effective).Elem(), reflect.ValueOf(cfg), "")
+
+	var errs []string
+	for _, fn := range r.hooks {
+		if e := fn(effective); e != nil {
+			errs = append(errs, e.Error())
+		}
+	}
+	r.current = effective
+	if len(errs) > 0 {
+		err = fmt.Errorf("reload: %s", strings.Join(errs, "; "))
+	}
+	return live, restart, err
+}
+
+// Run waits for SIGHUP (and file changes when reload.watch is set) until ctx is done
+func (r *Reloader) Run(ctx context.Context) {
+	var (
+		tick    <-chan time.Time
+		modTime time.Time
+	)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	cfg := r.Current()
+	if cfg.Reload.Watch {
+		interval := cfg.Reload.Interval
+		if interval == 0 {
+			interval = defaultWatchInterval
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+		modTime = r.modTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			fmt.Println("SIGHUP received, reloading", r.file)
+		case <-tick:
+			m := r.modTime()
+			if m.Equal(modTime) {
+				continue
+			}
+			modTime = m
+			fmt.Println(r.file, "changed, reloading")
+		}
+		live, restart, err := r.Reload()
+		if err != nil {
+			fmt.Println("configuration reload failed:", err)
+		}
+		if len(live) > 0 {
+			fmt.Println("configuration applied:", strings.Join(live, ", "))
+		}
+		if len(restart) > 0 {
+			fmt.Println("configuration changed but requires a restart:", strings.Join(restart, ", "))
+		}
+	}
+}
+
+func (r *Reloader) modTime() time.Time {
+	st, err := os.Stat(r.file)
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
+
+// merge copies the live fields of next into cur and lists the fields that differ
+func merge(cur reflect.Value, next reflect.Value, path string) (live []string, restart []string) {
+	t := cur.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := yamlName(f)
+		p := name
+		if path != "" {
+			p = path + "." + name
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Time{}) {
+			l, r := merge(cur.Field(i), next.Field(i), p)
+			live = append(live, l...)
+			restart = append(restart, r...)
+			continue
+		}
+		if reflect.DeepEqual(cur.Field(i).Interface(), next.Field(i).Interface()) {
+			continue
+		}
+		if f.Tag.Get("reload") == "live" {
+			cur.Field(i).Set(next.Field(i))
+			live = append(live, p)
+			continue
+		}
+		restart = append(restart, p)
+	}
+	return live, restart
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s string) string
+		live    []string
+		restart []string
+		err     string
+	}{
+		{"unchanged", func(s string) string { return s }, nil, nil, ""},
+		{"live fields", func(s string) string {
+			s = strings.Replace(s, "timeout: 2s", "timeout: 3s", 1)
+			return strings.Replace(s, "level: info", "level: debug", 1)
+		}, []string{"service.timeout", "log.level"}, nil, ""},
+		{"restart fields", func(s string) string {
+			s = strings.Replace(s, "subject: routers", "subject: other", 1)
+			return strings.Replace(s, "burst: 20", "burst: 30", 1)
+		}, []string{"ratelimit.burst"}, []string{"service.subject"}, ""},
+		{"invalid file", func(s string) string { return s + "log: [" }, nil, nil, "config.yml"},
+		{"invalid configuration", func(s string) string {
+			return strings.Replace(s, "level: info", "level: loud", 1)
+		}, nil, nil, "unknown level"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, "config.yml", testConfig)
+			cfg, err := Load(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReloader(file, cfg)
+			var got Config
+			calls := 0
+			r.OnReload(func(c Config) error {
+				calls++
+				got = c
+				return nil
+			})
+
+			if err = os.WriteFile(file, []byte(tt.change(testConfig)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			live, restart, err := r.Reload()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				if calls != 0 {
+					t.Errorf("hooks called on a failed reload")
+				}
+				if !reflect.DeepEqual(r.Current(), cfg) {
+					t.Errorf("configuration changed by a failed reload")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(live, tt.live) || !reflect.DeepEqual(restart, tt.restart) {
+				t.Errorf("live %v restart %v, want %v and %v", live, restart, tt.live, tt.restart)
+			}
+			// the hooks run even when nothing changed, for the certificates rotated in place
+			if calls != 1 {
+				t.Fatalf("hook called %d times", calls)
+			}
+			if !reflect.DeepEqual(got, r.Current()) {
+				t.Errorf("hook received %#v, current is %#v", got, r.Current())
+			}
+			if got.Service.Subject != "routers" {
+				t.Errorf("restart field applied: subject %q", got.Service.Subject)
+			}
+		})
+	}
+}
+
+func TestReloadHookError(t *testing.T) {
+	file := writeFile(t, "config.yml", testConfig)
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReloader(file, cfg)
+	r.OnReload(func(c Config) error { return errors.New("first failed") })
+	second := false
+	r.OnReload(func(c Config) error {
+		second = true
+		return nil
+	})
+
+	err = os.WriteFile(file, []byte(strings.Replace(testConfig, "timeout: 2s", "timeout: 3s", 1)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = r.Reload()
+	if err == nil || !strings.Contains(err.Error(), "first failed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !second {
+		t.Errorf("a failed hook stopped the next ones")
+	}
+	if r.Current().Service.Timeout != 3*time.Second {
+		t.Errorf("live field not applied: %v", r.Current().Service.Timeout)
+	}
+}
@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrUnknownGroup is returned when a router or a group refers to a group that does not exist
+	ErrUnknownGroup = errors.New("unknown group")
+	// ErrGroupNotEmpty is returned when deleting a group that still has sub-groups or routers
+	ErrGroupNotEmpty = errors.New("group not empty")
+	// ErrGroupCycle is returned when a group would become its own ancestor
+	ErrGroupCycle = errors.New("group cycle")
+)
+
+// Group is a node of the site hierarchy, e.g. a region containing sites, Parent is empty for a root
+type Group struct {
+	ID     string `json:"id" jsonschema:"required,minLength=1,maxLength=63,pattern=^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$"`
+	Name   string `json:"name,omitempty"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// GroupCount is a group of a tree with the number of routers it contains directly and with its
+// sub-groups, Depth is 0 for the root of the tree
+type GroupCount struct {
+	Group
+	Depth   int `json:"depth"`
+	Routers int `json:"routers"`
+	Total   int `json:"total"`
+}
+
+// CheckGroup validates g against the existing groups of its tenant: the parent must exist and g
+// cannot be moved under one of its sub-groups
+func CheckGroup(groups []Group, g Group) error {
+	if g.Parent == "" {
+		return nil
+	}
+	parents := make(map[string]string, len(groups))
+	for _, v := range groups {
+		parents[v.ID] = v.Parent
+	}
+	if _, ok := parents[g.Parent]; !ok {
+		return fmt.Errorf("%w: parent %s of group %s", ErrUnknownGroup, g.Parent, g.ID)
+	}
+	for p := g.Parent; p != ""; p = parents[p] {
+		if p == g.ID {
+			return fmt.Errorf("%w: group %s cannot be moved under %s", ErrGroupCycle, g.ID, g.Parent)
+		}
+	}
+	return nil
+}
+
+// Subtree returns the id of root and of all its sub-groups, nil when root is unknown
+func Subtree(groups []Group, root string) []string {
+	var res []string
+
+	for _, n := range GroupTree(groups, nil, root) {
+		res = append(res, n.ID)
+	}
+	return res
+}
+
+// GroupTree returns the groups under root, every group when root is empty, in depth first order
+// with the children sorted by id. counts are the routers of each group, Total adds the sub-groups.
+// The result is empty when root is unknown.
+func GroupTree(groups []Group, counts map[string]int, root string) []GroupCount {
+	var (
+		res   []GroupCount
+		roots []Group
+		walk  func(g Group, depth int) int
+	)
+
+	children := make(map[string][]Group)
+	for _, g := range groups {
+		if g.ID == root {
+			roots = append(roots, g)
+		}
+		children[g.Parent] = append(children[g.Parent], g)
+	}
+	if root == "" {
+		roots = children[""]
+	}
+	for _, c := range children {
+		sort.Slice(c, func(i, j int) bool { return c[i].ID < c[j].ID })
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].ID < roots[j].ID })
+
+	walk = func(g Group, depth int) int {
+		i := len(res)
+		res = append(res, GroupCount{Group: g, Depth: depth, Routers: counts[g.ID]})
+		total := counts[g.ID]
+		for _, c := range children[g.ID] {
+			total += walk(c, depth+1)
+		}
+		res[i].Total = total
+		return total
+	}
+	for _, g := range roots {
+		walk(g, 0)
+	}
+	return res
+}
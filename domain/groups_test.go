@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testGroups is the hierarchy
+//
+//	eu
+//	├── fr
+//	│   └── paris
+//	└── de
+//	us
+var testGroups = []Group{
+	{ID: "paris", Parent: "fr"},
+	{ID: "us"},
+	{ID: "fr", Parent: "eu"},
+	{ID: "eu"},
+	{ID: "de", Parent: "eu"},
+}
+
+func TestCheckGroup(t *testing.T) {
+	tests := []struct {
+		name  string
+		group Group
+		err   error
+	}{
+		{"new root", Group{ID: "asia"}, nil},
+		{"new child", Group{ID: "lyon", Parent: "fr"}, nil},
+		{"move", Group{ID: "de", Parent: "us"}, nil},
+		{"unknown parent", Group{ID: "lyon", Parent: "france"}, ErrUnknownGroup},
+		{"own parent", Group{ID: "fr", Parent: "fr"}, ErrGroupCycle},
+		{"under a child", Group{ID: "eu", Parent: "fr"}, ErrGroupCycle},
+		{"under a grandchild", Group{ID: "eu", Parent: "paris"}, ErrGroupCycle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckGroup(testGroups, tt.group)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	tests := []struct {
+		root string
+		want []string
+	}{
+		{"eu", []string{"eu", "de", "fr", "paris"}},
+		{"fr", []string{"fr", "paris"}},
+		{"paris", []string{"paris"}},
+		{"us", []string{"us"}},
+		{"asia", nil},
+		{"", []string{"eu", "de", "fr", "paris", "us"}},
+	}
+	for _, tt := range tests {
+		if got := Subtree(testGroups, tt.root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Subtree(%q) = %v, want %v", tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestGroupTree(t *testing.T) {
+	counts := map[string]int{"eu": 1, "fr": 2, "paris": 3, "us": 4}
+	node := func(g Group, depth int, routers int, total int) GroupCount {
+		return GroupCount{Group: g, Depth: depth, Routers: routers, Total: total}
+	}
+	eu, fr, paris, de, us := testGroups[3], testGroups[2], testGroups[0], testGroups[4], testGroups[1]
+
+	tests := []struct {
+		root string
+		want []GroupCount
+	}{
+		{"", []GroupCount{node(eu, 0, 1, 6), node(de, 1, 0, 0), node(fr, 1, 2, 5), node(paris, 2, 3, 3), node(us, 0, 4, 4)}},
+		{"fr", []GroupCount{node(fr, 0, 2, 5), node(paris, 1, 3, 3)}},
+		{"de", []GroupCount{node(de, 0, 0, 0)}},
+		{"asia", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.root, func(t *testing.T) {
+			if got := GroupTree(testGroups, counts, tt.root); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+
+	// a cycle stored before the checks must not loop forever, its groups are unreachable
+	cycle := []Group{{ID: "a", Parent: "b"}, {ID: "b", Parent: "a"}, {ID: "c"}}
+	if got := Subtree(cycle, ""); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("Subtree of a cycle = %v", got)
+	}
+}
@@ -0,0 +1,251 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidLabel    = errors.New("invalid label")
+	ErrInvalidSelector = errors.New("invalid label selector")
+)
+
+// label keys are an optional DNS subdomain prefix and a name, e.g. example.com/ring, like Kubernetes
+var (
+	labelName   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	labelPrefix = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	setRequire  = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+const (
+	maxLabelName   = 63
+	maxLabelPrefix = 253
+)
+
+// ValidateLabelKey checks a label key, the error wraps ErrInvalidLabel
+func ValidateLabelKey(k string) error {
+	name := k
+	if i := strings.LastIndex(k, "/"); i >= 0 {
+		prefix := k[:i]
+		name = k[i+1:]
+		if len(prefix) > maxLabelPrefix || !labelPrefix.MatchString(prefix) {
+			return fmt.Errorf("%w: key %q: the prefix must be a DNS subdomain", ErrInvalidLabel, k)
+		}
+	}
+	if len(name) > maxLabelName || !labelName.MatchString(name) {
+		return fmt.Errorf("%w: key %q: the name must be 63 alphanumeric characters or -_. at most", ErrInvalidLabel, k)
+	}
+	return nil
+}
+
+// ValidateLabelValue checks a label value, it can be empty
+func ValidateLabelValue(v string) error {
+	if v == "" {
+		return nil
+	}
+	if len(v) > maxLabelName || !labelName.MatchString(v) {
+		return fmt.Errorf("%w: value %q: must be 63 alphanumeric characters or -_. at most", ErrInvalidLabel, v)
+	}
+	return nil
+}
+
+// ValidateLabels checks the keys and the values of labels
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if err := ValidateLabelKey(k); err != nil {
+			return err
+		}
+		if err := ValidateLabelValue(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LabelChange sets then removes labels, the other labels of the routers are kept
+type LabelChange struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+func (c LabelChange) Validate() error {
+	if len(c.Set) == 0 && len(c.Remove) == 0 {
+		return fmt.Errorf("%w: no label to set or remove", ErrInvalidLabel)
+	}
+	for _, k := range c.Remove {
+		if err := ValidateLabelKey(k); err != nil {
+			return err
+		}
+	}
+	return ValidateLabels(c.Set)
+}
+
+// Apply returns a copy of labels with the change and whether it differs, no label is nil
+func (c LabelChange) Apply(labels map[string]string) (map[string]string, bool) {
+	res := make(map[string]string, len(labels)+len(c.Set))
+	for k, v := range labels {
+		res[k] = v
+	}
+	changed := false
+	for k, v := range c.Set {
+		if old, ok := res[k]; !ok || old != v {
+			changed = true
+		}
+		res[k] = v
+	}
+	for _, k := range c.Remove {
+		if _, ok := res[k]; ok {
+			changed = true
+		}
+		delete(res, k)
+	}
+	if len(res) == 0 {
+		return nil, changed
+	}
+	return res, changed
+}
+
+// label selector operators
+const (
+	SelectorEquals    = "="
+	SelectorNotEquals = "!="
+	SelectorIn        = "in"
+	SelectorNotIn     = "notin"
+	SelectorExists    = "exists"
+	SelectorNotExists = "!"
+)
+
+// Requirement is one term of a label selector, Values has one value for = and !=, none for the
+// existence tests
+type Requirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// Matches tells whether labels satisfy the requirement, a missing label matches != and notin
+func (r Requirement) Matches(labels map[string]string) bool {
+	v, ok := labels[r.Key]
+	switch r.Operator {
+	case SelectorExists:
+		return ok
+	case SelectorNotExists:
+		return !ok
+	case SelectorEquals, SelectorIn:
+		return ok && contains(r.Values, v)
+	case SelectorNotEquals, SelectorNotIn:
+		return !ok || !contains(r.Values, v)
+	}
+	return false
+}
+
+// Selector is a list of requirements that must all match, the empty selector matches everything
+type Selector []Requirement
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector reads a Kubernetes style selector, e.g. "ring=canary,site!=lab,tier in (a,b),!legacy".
+// The errors wrap ErrInvalidSelector.
+func ParseSelector(s string) (Selector, error) {
+	var res Selector
+
+	terms, err := splitTerms(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range terms {
+		r, err := parseRequirement(t)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// splitTerms splits s on the commas outside of the parentheses
+func splitTerms(s string) ([]string, error) {
+	var (
+		res   []string
+		depth int
+		start int
+	)
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("%w %q: unbalanced parentheses", ErrInvalidSelector, s)
+			}
+		case ',':
+			if depth == 0 {
+				res = append(res, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("%w %q: unbalanced parentheses", ErrInvalidSelector, s)
+	}
+	return append(res, strings.TrimSpace(s[start:])), nil
+}
+
+func parseRequirement(t string) (Requirement, error) {
+	var r Requirement
+
+	switch {
+	case t == "":
+		return r, fmt.Errorf("%w: empty requirement", ErrInvalidSelector)
+	case setRequire.MatchString(t):
+		m := setRequire.FindStringSubmatch(t)
+		r = Requirement{Key: m[1], Operator: m[2]}
+		for _, v := range strings.Split(m[3], ",") {
+			r.Values = append(r.Values, strings.TrimSpace(v))
+		}
+		sort.Strings(r.Values)
+	case strings.HasPrefix(t, "!") && !strings.ContainsAny(t, "="):
+		r = Requirement{Key: strings.TrimSpace(t[1:]), Operator: SelectorNotExists}
+	case strings.Contains(t, "!="):
+		kv := strings.SplitN(t, "!=", 2)
+		r = Requirement{Key: strings.TrimSpace(kv[0]), Operator: SelectorNotEquals, Values: []string{strings.TrimSpace(kv[1])}}
+	case strings.Contains(t, "="):
+		kv := strings.SplitN(strings.Replace(t, "==", "=", 1), "=", 2)
+		r = Requirement{Key: strings.TrimSpace(kv[0]), Operator: SelectorEquals, Values: []string{strings.TrimSpace(kv[1])}}
+	default:
+		r = Requirement{Key: t, Operator: SelectorExists}
+	}
+
+	if err := ValidateLabelKey(r.Key); err != nil {
+		return r, fmt.Errorf("%w %q: %v", ErrInvalidSelector, t, err)
+	}
+	for _, v := range r.Values {
+		if err := ValidateLabelValue(v); err != nil {
+			return r, fmt.Errorf("%w %q: %v", ErrInvalidSelector, t, err)
+		}
+	}
+	return r, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
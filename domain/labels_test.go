@@ -0,0 +1,177 @@
+package domain
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		err    bool
+	}{
+		{"empty", nil, false},
+		{"simple", map[string]string{"ring": "canary", "site": "lab-1"}, false},
+		{"prefix", map[string]string{"example.com/ring": "a_b.c"}, false},
+		{"empty value", map[string]string{"legacy": ""}, false},
+		{"empty key", map[string]string{"": "a"}, true},
+		{"key with space", map[string]string{"my ring": "a"}, true},
+		{"key starting with a dash", map[string]string{"-ring": "a"}, true},
+		{"uppercase prefix", map[string]string{"Example.com/ring": "a"}, true},
+		{"empty name", map[string]string{"example.com/": "a"}, true},
+		{"name too long", map[string]string{strings.Repeat("a", 64): "a"}, true},
+		{"longest name", map[string]string{strings.Repeat("a", 63): "a"}, false},
+		{"value with comma", map[string]string{"ring": "a,b"}, true},
+		{"value too long", map[string]string{"ring": strings.Repeat("a", 64)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLabels(tt.labels)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidLabel) {
+				t.Errorf("error %v does not wrap ErrInvalidLabel", err)
+			}
+		})
+	}
+}
+
+func TestLabelChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		change  LabelChange
+		want    map[string]string
+		changed bool
+	}{
+		{"set", nil, LabelChange{Set: map[string]string{"ring": "canary"}}, map[string]string{"ring": "canary"}, true},
+		{"same value", map[string]string{"ring": "canary"}, LabelChange{Set: map[string]string{"ring": "canary"}}, map[string]string{"ring": "canary"}, false},
+		{"replace", map[string]string{"ring": "canary", "site": "a"}, LabelChange{Set: map[string]string{"ring": "stable"}}, map[string]string{"ring": "stable", "site": "a"}, true},
+		{"remove", map[string]string{"ring": "canary", "site": "a"}, LabelChange{Remove: []string{"ring"}}, map[string]string{"site": "a"}, true},
+		{"remove missing", map[string]string{"site": "a"}, LabelChange{Remove: []string{"ring"}}, map[string]string{"site": "a"}, false},
+		{"remove last", map[string]string{"ring": "canary"}, LabelChange{Remove: []string{"ring"}}, nil, true},
+		{"set then remove", nil, LabelChange{Set: map[string]string{"ring": "canary"}, Remove: []string{"ring"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := make(map[string]string)
+			for k, v := range tt.labels {
+				before[k] = v
+			}
+			got, changed := tt.change.Apply(tt.labels)
+			if !reflect.DeepEqual(got, tt.want) || changed != tt.changed {
+				t.Errorf("got %v %v, want %v %v", got, changed, tt.want, tt.changed)
+			}
+			if len(tt.labels) != len(before) || (len(before) > 0 && !reflect.DeepEqual(tt.labels, before)) {
+				t.Errorf("Apply changed its argument: %v", tt.labels)
+			}
+		})
+	}
+
+	if err := (LabelChange{}).Validate(); !errors.Is(err, ErrInvalidLabel) {
+		t.Errorf("empty change: %v", err)
+	}
+	if err := (LabelChange{Remove: []string{"bad key"}}).Validate(); !errors.Is(err, ErrInvalidLabel) {
+		t.Errorf("invalid removed key: %v", err)
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+		err      string
+	}{
+		{"", nil, ""},
+		{"  ", nil, ""},
+		{"ring=canary", Selector{{"ring", SelectorEquals, []string{"canary"}}}, ""},
+		{"ring==canary", Selector{{"ring", SelectorEquals, []string{"canary"}}}, ""},
+		{"ring = canary", Selector{{"ring", SelectorEquals, []string{"canary"}}}, ""},
+		{"ring=", Selector{{"ring", SelectorEquals, []string{""}}}, ""},
+		{"site!=lab", Selector{{"site", SelectorNotEquals, []string{"lab"}}}, ""},
+		{"tier in (b, a)", Selector{{"tier", SelectorIn, []string{"a", "b"}}}, ""},
+		{"tier notin (a)", Selector{{"tier", SelectorNotIn, []string{"a"}}}, ""},
+		{"legacy", Selector{{"legacy", SelectorExists, nil}}, ""},
+		{"!legacy", Selector{{"legacy", SelectorNotExists, nil}}, ""},
+		{"example.com/ring=canary", Selector{{"example.com/ring", SelectorEquals, []string{"canary"}}}, ""},
+		{"ring=canary,site!=lab,tier in (a,b),!legacy", Selector{
+			{"ring", SelectorEquals, []string{"canary"}},
+			{"site", SelectorNotEquals, []string{"lab"}},
+			{"tier", SelectorIn, []string{"a", "b"}},
+			{"legacy", SelectorNotExists, nil},
+		}, ""},
+		{"ring=canary,", nil, "empty requirement"},
+		{",ring=canary", nil, "empty requirement"},
+		{"tier in (a,b", nil, "unbalanced parentheses"},
+		{"tier in a,b)", nil, "unbalanced parentheses"},
+		{"my ring=canary", nil, "key"},
+		{"ring=can ary", nil, "value"},
+		{"tier in (a,b c)", nil, "value"},
+		{"=canary", nil, "key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := ParseSelector(tt.selector)
+			if tt.err != "" {
+				if !errors.Is(err, ErrInvalidSelector) || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q wrapping ErrInvalidSelector, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"ring": "canary", "site": "lab", "empty": ""}
+	tests := []struct {
+		selector string
+		match    bool
+	}{
+		{"", true},
+		{"ring=canary", true},
+		{"ring=stable", false},
+		{"missing=canary", false},
+		{"empty=", true},
+		{"ring!=stable", true},
+		{"ring!=canary", false},
+		{"missing!=canary", true},
+		{"ring in (canary,stable)", true},
+		{"ring in (stable)", false},
+		{"missing in (canary)", false},
+		{"ring notin (stable)", true},
+		{"ring notin (canary)", false},
+		{"missing notin (canary)", true},
+		{"ring", true},
+		{"missing", false},
+		{"!missing", true},
+		{"!ring", false},
+		{"ring=canary,site=lab", true},
+		{"ring=canary,site!=lab", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.Matches(labels); got != tt.match {
+				t.Errorf("Matches = %v, want %v", got, tt.match)
+			}
+		})
+	}
+
+	if (Requirement{Key: "ring", Operator: "~"}).Matches(labels) {
+		t.Errorf("unknown operator matched")
+	}
+}
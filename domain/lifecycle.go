@@ -0,0 +1,113 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidState = errors.New("invalid state")
+	// ErrInvalidTransition is returned when a router cannot go from its state to the requested one
+	ErrInvalidTransition = errors.New("invalid state transition")
+)
+
+// lifecycle states of a router
+const (
+	StateOrdered        = "ordered"
+	StateProvisioned    = "provisioned"
+	StateActive         = "active"
+	StateSuspended      = "suspended"
+	StateRMA            = "rma"
+	StateDecommissioned = "decommissioned"
+)
+
+// transitions lists the states reachable from each state, decommissioned is final
+var transitions = map[string][]string{
+	StateOrdered:        {StateProvisioned, StateDecommissioned},
+	StateProvisioned:    {StateActive, StateRMA, StateDecommissioned},
+	StateActive:         {StateSuspended, StateRMA, StateDecommissioned},
+	StateSuspended:      {StateActive, StateRMA, StateDecommissioned},
+	StateRMA:            {StateProvisioned, StateDecommissioned},
+	StateDecommissioned: nil,
+}
+
+// entryStates are the states a router can be created in, the routers imported in service are
+// provisioned or active, the other states are reached by a Transition
+var entryStates = []string{StateOrdered, StateProvisioned, StateActive}
+
+// Transition moves a router to State, the router must not have changed since Revision when it is set
+type Transition struct {
+	RouterSerial string `json:"router-serial" jsonschema:"required,minLength=1"`
+	State        string `json:"state" jsonschema:"required,enum=ordered|provisioned|active|suspended|rma|decommissioned"`
+	Reason       string `json:"reason,omitempty"`
+	Revision     int    `json:"revision,omitempty" jsonschema:"minimum=0"`
+}
+
+// States returns the lifecycle states in transition order
+func States() []string {
+	return []string{StateOrdered, StateProvisioned, StateActive, StateSuspended, StateRMA, StateDecommissioned}
+}
+
+func ValidateState(state string) error {
+	if _, ok := transitions[state]; !ok {
+		return fmt.Errorf("%w %q: must be one of %s", ErrInvalidState, state, strings.Join(States(), ", "))
+	}
+	return nil
+}
+
+// ValidateEntryState tells whether a router can be created in state
+func ValidateEntryState(state string) error {
+	if !contains(entryStates, state) {
+		return fmt.Errorf("%w %q: a router is created in one of %s", ErrInvalidState, state, strings.Join(entryStates, ", "))
+	}
+	return nil
+}
+
+// CurrentState returns the state of r, the routers created before the lifecycle are active
+func (r Router) CurrentState() string {
+	if r.State == "" {
+		return StateActive
+	}
+	return r.State
+}
+
+// CheckTransition tells whether a router can go from one state to the other
+func CheckTransition(from string, to string) error {
+	if err := ValidateState(to); err != nil {
+		return err
+	}
+	if !contains(transitions[from], to) {
+		next := NextStates(from)
+		if len(next) == 0 {
+			return fmt.Errorf("%w: %s to %s, %s is final", ErrInvalidTransition, from, to, from)
+		}
+		return fmt.Errorf("%w: %s to %s, allowed: %s", ErrInvalidTransition, from, to, strings.Join(next, ", "))
+	}
+	return nil
+}
+
+// NextStates returns the states reachable from state, sorted
+func NextStates(state string) []string {
+	res := append([]string(nil), transitions[state]...)
+	sort.Strings(res)
+	return res
+}
+
+// ParseStates reads a comma separated list of states, e.g. "active,suspended"
+func ParseStates(s string) ([]string, error) {
+	var res []string
+
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if err := ValidateState(v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
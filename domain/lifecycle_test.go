@@ -0,0 +1,108 @@
+package domain
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	allowed := map[string][]string{
+		StateOrdered:        {StateProvisioned, StateDecommissioned},
+		StateProvisioned:    {StateActive, StateRMA, StateDecommissioned},
+		StateActive:         {StateSuspended, StateRMA, StateDecommissioned},
+		StateSuspended:      {StateActive, StateRMA, StateDecommissioned},
+		StateRMA:            {StateProvisioned, StateDecommissioned},
+		StateDecommissioned: nil,
+	}
+	// every pair of states, the graph is checked both ways
+	for _, from := range States() {
+		for _, to := range States() {
+			err := CheckTransition(from, to)
+			if want := contains(allowed[from], to); want != (err == nil) {
+				t.Errorf("%s to %s: got %v, allowed %v", from, to, err, want)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("%s to %s: %v does not wrap ErrInvalidTransition", from, to, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		err  error
+		msg  string
+	}{
+		{"lists the next states", StateOrdered, StateActive, ErrInvalidTransition, "allowed: decommissioned, provisioned"},
+		{"final state", StateDecommissioned, StateActive, ErrInvalidTransition, "decommissioned is final"},
+		{"unknown target", StateActive, "broken", ErrInvalidState, `"broken"`},
+		{"empty target", StateActive, "", ErrInvalidState, "must be one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTransition(tt.from, tt.to)
+			if !errors.Is(err, tt.err) || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("got %v, want %v containing %q", err, tt.err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestValidateEntryState(t *testing.T) {
+	for _, state := range States() {
+		err := ValidateEntryState(state)
+		entry := state == StateOrdered || state == StateProvisioned || state == StateActive
+		if entry != (err == nil) {
+			t.Errorf("%s: got %v", state, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidState) {
+			t.Errorf("%s: %v does not wrap ErrInvalidState", state, err)
+		}
+	}
+	if err := ValidateEntryState("broken"); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("unknown state: %v", err)
+	}
+}
+
+func TestParseStates(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{" ", nil, false},
+		{"active", []string{"active"}, false},
+		{"active, suspended", []string{"active", "suspended"}, false},
+		{"active,", nil, true},
+		{"active,broken", nil, true},
+		{"Active", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStates(tt.s)
+		if (err != nil) != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseStates(%q) = %v, %v", tt.s, got, err)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidState) {
+			t.Errorf("ParseStates(%q): %v does not wrap ErrInvalidState", tt.s, err)
+		}
+	}
+}
+
+func TestCurrentState(t *testing.T) {
+	if s := (Router{}).CurrentState(); s != StateActive {
+		t.Errorf("router without state is %q, want active", s)
+	}
+	if s := (Router{State: StateRMA}).CurrentState(); s != StateRMA {
+		t.Errorf("got %q, want rma", s)
+	}
+	if got := NextStates(StateActive); !reflect.DeepEqual(got, []string{StateDecommissioned, StateRMA, StateSuspended}) {
+		t.Errorf("NextStates(active) = %v", got)
+	}
+	if got := NextStates(StateDecommissioned); len(got) != 0 {
+		t.Errorf("NextStates(decommissioned) = %v", got)
+	}
+}
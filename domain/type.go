@@ -1,20 +1,339 @@
 package domain
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
 type Router struct {
 	// in: query
-	RouterID            string `json:"router-id" form:"router-id" pg:"type:uuid" pg:",unique"`
-	RouterSerial        string `json:"router-serial" form:"router-serial" pg:",unique"`
+	RouterID            string `json:"router-id" form:"router-id" pg:"type:uuid" pg:",unique" jsonschema:"pattern=^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})?$"`
+	RouterSerial        string `json:"router-serial" form:"router-serial" pg:",unique" jsonschema:"required,minLength=1"`
 	OperatorName        string `json:"operator-name" form:"operator-name"`
-	IsoCountryCode      string `json:"iso-country-code" form:"iso-country-code"`
-	Mac                 string `json:"mac" form:"mac"`
+	IsoCountryCode      string `json:"iso-country-code" form:"iso-country-code" jsonschema:"pattern=^([A-Za-z]{2})?$"`
+	Mac                 string `json:"mac" form:"mac" jsonschema:"pattern=^(([0-9A-Fa-f]{2}[:-]){5}[0-9A-Fa-f]{2})?$"`
 	RouterModel         string `json:"router-model" form:"router-model"`
 	AccountID           string `json:"account-id" form:"account-id"`
 	AgentLastConnection string `json:"agent-last-connection"`
 	AgentVersion        string `json:"agent-version"`
+	// Labels group the routers by metadata, e.g. site, project or rollout ring
+	Labels map[string]string `json:"labels,omitempty" form:"labels"`
+	// Group is the id of the site the router belongs to, see Group
+	Group string `json:"group,omitempty" form:"group" pg:"group_id" jsonschema:"pattern=^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$"`
+	// State is the lifecycle state, changed by a Transition only. StateSince and StateReason
+	// describe the last transition.
+	State       string     `json:"state,omitempty" form:"state" jsonschema:"pattern=^(ordered|provisioned|active|suspended|rma|decommissioned)?$"`
+	StateSince  *time.Time `json:"state-since,omitempty"`
+	StateReason string     `json:"state-reason,omitempty"`
+	// Revision is set by the repository and increased by every change, an update or a delete
+	// carrying a revision fails with a ConflictError when the router has changed since
+	Revision int `json:"revision,omitempty" form:"revision" jsonschema:"minimum=0"`
 }
 
 type Pagination struct {
-	Limit int    `json:"limit"`
-	Page  int    `json:"page"`
+	Limit int    `json:"limit" jsonschema:"required,minimum=1,maximum=1000"`
+	Page  int    `json:"page" jsonschema:"minimum=0"`
 	Sort  string `json:"sort"`
+	// Selector filters the routers by label, see ParseSelector
+	Selector string `json:"selector,omitempty"`
+	// Group keeps the routers of the group and of its sub-groups
+	Group string `json:"group,omitempty"`
+	// State keeps the routers in one of the comma separated states, e.g. "active,suspended"
+	State string `json:"state,omitempty"`
+}
+
+const (
+	EventCreated  = "created"
+	EventDeleted  = "deleted"
+	EventRestored = "restored"
+	EventUpdated  = "updated"
+)
+
+// RouterEvent is published by the API every time routers are created, updated, deleted or restored.
+type RouterEvent struct {
+	Type    string   `json:"type"`
+	Tenant  string   `json:"tenant"`
+	Time    string   `json:"time" jsonschema:"format=date-time"`
+	Routers []Router `json:"routers"`
+}
+
+// IdempotencyRecord keeps the reply of a create or delete so that a retry with the same
+// Idempotency-Key gets the original reply instead of running the command again.
+type IdempotencyRecord struct {
+	Tenant    string
+	Key       string
+	Operation string
+	// RequestHash detects a key reused with another payload
+	RequestHash string
+	// Done is false while the first request is still running
+	Done      bool
+	Version   int
+	Response  []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Quota caps the number of routers of a tenant, or of one account of the tenant when AccountID is set
+type Quota struct {
+	Tenant    string `json:"tenant" jsonschema:"required"`
+	AccountID string `json:"account-id,omitempty"`
+	// Limit 0 is unlimited
+	Limit int `json:"limit" jsonschema:"minimum=0"`
+}
+
+// Counts tells whether r is counted by the quota, a tenant quota counts every router of the tenant
+func (q Quota) Counts(r Router) bool {
+	return q.AccountID == "" || q.AccountID == r.AccountID
+}
+
+// QuotaUsage is the number of routers counted by a quota
+type QuotaUsage struct {
+	Tenant    string `json:"tenant"`
+	AccountID string `json:"account-id,omitempty"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+}
+
+// quota thresholds, in percent of the limit
+const (
+	QuotaWarning = 80
+	QuotaReached = 100
+
+	EventQuotaWarning = "quota-warning"
+	EventQuotaReached = "quota-reached"
+)
+
+// QuotaEvent is published when an Add makes the usage of a quota cross one of its thresholds.
+type QuotaEvent struct {
+	Type      string `json:"type"`
+	Tenant    string `json:"tenant"`
+	AccountID string `json:"account-id,omitempty"`
+	Threshold int    `json:"threshold"`
+	Used      int    `json:"used"`
+	Limit     int    `json:"limit"`
+	Time      string `json:"time" jsonschema:"format=date-time"`
+}
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrNotFound is returned by the queries of a single record, e.g. a router version
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned by the changes of a router sent with an outdated revision
+	ErrConflict = errors.New("revision conflict")
+)
+
+// QuotaExceededError is returned by the repositories when an Add is rejected, no router is added
+type QuotaExceededError struct {
+	Usage QuotaUsage
+	// Adding is the number of new routers counted by the quota
+	Adding int
+}
+
+func (e *QuotaExceededError) Error() string {
+	owner := "tenant " + e.Usage.Tenant
+	if e.Usage.AccountID != "" {
+		owner = "account " + e.Usage.AccountID + " of " + owner
+	}
+	return fmt.Sprintf("%s: %s has %d router(s), adding %d exceeds the limit of %d", ErrQuotaExceeded, owner, e.Usage.Used, e.Adding, e.Usage.Limit)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// ConflictError is returned when the revision of a change is not the current one, nothing is changed
+type ConflictError struct {
+	RouterSerial string
+	// Revision is the current revision of the router, Expected the one sent with the change
+	Revision int
+	Expected int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: router %s is at revision %d, not %d", ErrConflict, e.RouterSerial, e.Revision, e.Expected)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// CheckRevision returns a ConflictError when the expected revision is set and differs from the one of r
+func CheckRevision(r Router, expected int) error {
+	if expected == 0 || expected == r.Revision {
+		return nil
+	}
+	return &ConflictError{RouterSerial: r.RouterSerial, Revision: r.Revision, Expected: expected}
+}
+
+// audit actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// AuditEntry records one change of a router, entries are never updated nor deleted. Before is
+// nil for a creation and After is nil for a deletion.
+type AuditEntry struct {
+	ID           int64     `json:"id"`
+	Time         time.Time `json:"time"`
+	Tenant       string    `json:"tenant"`
+	Actor        string    `json:"actor"`
+	RequestID    string    `json:"request-id,omitempty"`
+	Action       string    `json:"action"`
+	RouterSerial string    `json:"router-serial"`
+	Before       *Router   `json:"before,omitempty"`
+	After        *Router   `json:"after,omitempty"`
+}
+
+// AuditQuery selects the entries of a tenant, empty fields match everything. From is inclusive,
+// To is exclusive. Entries are returned newest first.
+type AuditQuery struct {
+	RouterSerial string    `json:"router-serial"`
+	Actor        string    `json:"actor"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Limit        int       `json:"limit" jsonschema:"required,minimum=1,maximum=1000"`
+	Page         int       `json:"page" jsonschema:"minimum=0"`
+}
+
+// Match tells whether e is selected by the query filters, the paging is ignored
+func (q AuditQuery) Match(e AuditEntry) bool {
+	return (q.RouterSerial == "" || q.RouterSerial == e.RouterSerial) &&
+		(q.Actor == "" || q.Actor == e.Actor) &&
+		(q.From.IsZero() || !e.Time.Before(q.From)) &&
+		(q.To.IsZero() || e.Time.Before(q.To))
+}
+
+// Actor is who changes the inventory, the repositories record it in the audit trail
+type Actor struct {
+	Name      string
+	RequestID string
+}
+
+// SystemActor is recorded when the context carries no actor
+var SystemActor = Actor{Name: "system"}
+
+type actorKey struct{}
+
+// WithActor returns a context carrying the actor of the changes
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// ActorFrom returns the actor of the changes, SystemActor when there is none
+func ActorFrom(ctx context.Context) Actor {
+	a, ok := ctx.Value(actorKey{}).(Actor)
+	if !ok {
+		return SystemActor
+	}
+	return a
+}
+
+// Audit returns the entry recording a change made by the actor of ctx
+func Audit(ctx context.Context, tenant string, action string, before *Router, after *Router) AuditEntry {
+	a := ActorFrom(ctx)
+	e := AuditEntry{
+		Time:      time.Now().UTC(),
+		Tenant:    tenant,
+		Actor:     a.Name,
+		RequestID: a.RequestID,
+		Action:    action,
+		Before:    before,
+		After:     after,
+	}
+	if after != nil {
+		e.RouterSerial = after.RouterSerial
+	} else if before != nil {
+		e.RouterSerial = before.RouterSerial
+	}
+	return e
+}
+
+// RouterVersion is the state of a router between ValidFrom and ValidTo. ValidTo is nil for the
+// current version, otherwise the router was changed or deleted at ValidTo.
+type RouterVersion struct {
+	Version   int        `json:"version"`
+	ValidFrom time.Time  `json:"valid-from"`
+	ValidTo   *time.Time `json:"valid-to,omitempty"`
+	Router    Router     `json:"router"`
+}
+
+// Current tells whether v is the live version of the router
+func (v RouterVersion) Current() bool {
+	return v.ValidTo == nil
+}
+
+// At tells whether v was the version of the router at t
+func (v RouterVersion) At(t time.Time) bool {
+	return !t.Before(v.ValidFrom) && (v.ValidTo == nil || t.Before(*v.ValidTo))
+}
+
+// HistoryQuery returns every version of a router, or the version valid at At when it is set
+type HistoryQuery struct {
+	RouterSerial string    `json:"router-serial" jsonschema:"required,minLength=1"`
+	At           time.Time `json:"at"`
+}
+
+// DiffQuery compares two versions of a router, To 0 is the latest version
+type DiffQuery struct {
+	RouterSerial string `json:"router-serial" jsonschema:"required,minLength=1"`
+	From         int    `json:"from" jsonschema:"required,minimum=1"`
+	To           int    `json:"to" jsonschema:"minimum=0"`
+}
+
+// FieldChange is a router field, named after its json tag, that differs between two versions
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type RouterDiff struct {
+	RouterSerial string        `json:"router-serial"`
+	From         int           `json:"from"`
+	To           int           `json:"to"`
+	Changes      []FieldChange `json:"changes"`
+}
+
+// Diff lists the fields of b that differ from a
+func Diff(a Router, b Router) []FieldChange {
+	res := []FieldChange{}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		from, to := fieldString(va.Field(i)), fieldString(vb.Field(i))
+		if from == to {
+			continue
+		}
+		name := strings.Split(va.Type().Field(i).Tag.Get("json"), ",")[0]
+		res = append(res, FieldChange{Field: name, From: from, To: to})
+	}
+	return res
+}
+
+// fieldString formats the times as RFC 3339, like their JSON encoding
+func fieldString(v reflect.Value) string {
+	switch t := v.Interface().(type) {
+	case *time.Time:
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	case time.Time:
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// DeletedRouter is the tombstone of a deleted router, it can be restored until it is purged
+type DeletedRouter struct {
+	Router    Router    `json:"router"`
+	DeletedAt time.Time `json:"deleted-at"`
+	DeletedBy string    `json:"deleted-by"`
 }
@@ -0,0 +1,154 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	base := Router{RouterSerial: "S1", OperatorName: "op", Revision: 1, Labels: map[string]string{"ring": "canary"}}
+
+	tests := []struct {
+		name   string
+		change func(r Router) Router
+		want   []FieldChange
+	}{
+		{"identical", func(r Router) Router { return r }, []FieldChange{}},
+		{"one field", func(r Router) Router {
+			r.OperatorName = "other"
+			return r
+		}, []FieldChange{{Field: "operator-name", From: "op", To: "other"}}},
+		{"fields in declaration order", func(r Router) Router {
+			r.Mac = "00:11:22:33:44:55"
+			r.RouterID = "id"
+			r.Revision = 2
+			return r
+		}, []FieldChange{
+			{Field: "router-id", From: "", To: "id"},
+			{Field: "mac", From: "", To: "00:11:22:33:44:55"},
+			{Field: "revision", From: "1", To: "2"},
+		}},
+		{"labels", func(r Router) Router {
+			r.Labels = map[string]string{"ring": "stable"}
+			return r
+		}, []FieldChange{{Field: "labels", From: "map[ring:canary]", To: "map[ring:stable]"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diff(base, tt.change(base))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffStateSince(t *testing.T) {
+	since := time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+	same, later := since, since.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		a, b *time.Time
+		want []FieldChange
+	}{
+		{"unset", nil, nil, []FieldChange{}},
+		{"set", nil, &since, []FieldChange{{Field: "state-since", From: "", To: "2023-06-17T12:00:00Z"}}},
+		// the times are compared by value, not by pointer
+		{"same time", &since, &same, []FieldChange{}},
+		{"changed", &since, &later, []FieldChange{{Field: "state-since", From: "2023-06-17T12:00:00Z", To: "2023-06-17T13:00:00Z"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diff(Router{StateSince: tt.a}, Router{StateSince: tt.b})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRevision(t *testing.T) {
+	r := Router{RouterSerial: "S1", Revision: 3}
+	tests := []struct {
+		name     string
+		expected int
+		conflict bool
+	}{
+		{"no revision", 0, false},
+		{"current revision", 3, false},
+		{"older revision", 2, true},
+		{"newer revision", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRevision(r, tt.expected)
+			if !tt.conflict {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var c *ConflictError
+			if !errors.As(err, &c) || !errors.Is(err, ErrConflict) {
+				t.Fatalf("expected a ConflictError, got %v", err)
+			}
+			if c.RouterSerial != "S1" || c.Revision != 3 || c.Expected != tt.expected {
+				t.Errorf("unexpected conflict %+v", c)
+			}
+		})
+	}
+}
+
+func TestAuditQueryMatch(t *testing.T) {
+	at := time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+	e := AuditEntry{Time: at, Actor: "alice", RouterSerial: "S1"}
+
+	tests := []struct {
+		name  string
+		q     AuditQuery
+		match bool
+	}{
+		{"no filter", AuditQuery{}, true},
+		{"router", AuditQuery{RouterSerial: "S1"}, true},
+		{"other router", AuditQuery{RouterSerial: "S2"}, false},
+		{"actor", AuditQuery{Actor: "alice"}, true},
+		{"other actor", AuditQuery{Actor: "bob"}, false},
+		// From is inclusive, To is exclusive
+		{"from the time", AuditQuery{From: at}, true},
+		{"from later", AuditQuery{From: at.Add(time.Second)}, false},
+		{"to the time", AuditQuery{To: at}, false},
+		{"to later", AuditQuery{To: at.Add(time.Second)}, true},
+		{"all filters", AuditQuery{RouterSerial: "S1", Actor: "alice", From: at.Add(-time.Hour), To: at.Add(time.Hour)}, true},
+		{"one filter fails", AuditQuery{RouterSerial: "S1", Actor: "bob", From: at.Add(-time.Hour), To: at.Add(time.Hour)}, false},
+		// the paging does not filter
+		{"paging", AuditQuery{Limit: 1, Page: 5}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.Match(e); got != tt.match {
+				t.Errorf("got %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	before, after := &Router{RouterSerial: "S1"}, &Router{RouterSerial: "S1", OperatorName: "op"}
+
+	e := Audit(context.Background(), "acme", AuditUpdate, before, after)
+	if e.Actor != SystemActor.Name || e.Tenant != "acme" || e.RouterSerial != "S1" || e.Time.IsZero() {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	ctx := WithActor(context.Background(), Actor{Name: "alice", RequestID: "r1"})
+	// the serial is taken from the router that exists
+	if e = Audit(ctx, "acme", AuditDelete, before, nil); e.Actor != "alice" || e.RequestID != "r1" || e.RouterSerial != "S1" {
+		t.Errorf("unexpected deletion entry %+v", e)
+	}
+	if e = Audit(ctx, "acme", AuditCreate, nil, after); e.RouterSerial != "S1" || e.Before != nil {
+		t.Errorf("unexpected creation entry %+v", e)
+	}
+}
@@ -0,0 +1,138 @@
+/**
+ * @file    lifecycle.go
+ * @brief   Coordinated shutdown of the service components.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * Only this package traps SIGINT/SIGTERM. Components register a stop function and are stopped
+ * one after the other in registration order: the API first so that in-flight requests can
+ * still use the repository, the repository last.
+ */
+
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// exit codes of the process
+const (
+	ExitClean  = 0
+	ExitForced = 1
+
+	defaultTimeout = 30 * time.Second
+)
+
+type stopper struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+type Manager struct {
+	timeout  time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stoppers []stopper
+	tasks    sync.WaitGroup
+}
+
+func NewManager(timeout time.Duration) *Manager {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Context is canceled as soon as the shutdown starts, background tasks should stop on it
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// OnShutdown registers a component, fn must return once the component is stopped or ctx is done
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) {
+	m.stoppers = append(m.stoppers, stopper{name: name, fn: fn})
+}
+
+// Go runs a background task until Context is canceled, WaitTasks waits for the tasks to return
+func (m *Manager) Go(fn func(ctx context.Context)) {
+	m.tasks.Add(1)
+	go func() {
+		defer m.tasks.Done()
+		fn(m.ctx)
+	}()
+}
+
+// WaitTasks returns once the tasks started by Go have returned, it is registered with OnShutdown
+// before the components the tasks use
+func (m *Manager) WaitTasks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until SIGINT or SIGTERM then stops every component. It returns ExitClean when all
+// components stopped in time without error, ExitForced on timeout, error or a second signal.
+func (m *Manager) Wait() int {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	s := <-sig
+	fmt.Printf("%s received, shutting down (timeout %s)...\n", s, m.timeout)
+	return m.Shutdown(sig)
+}
+
+// Shutdown stops the components, a signal received on force aborts the shutdown
+func (m *Manager) Shutdown(force <-chan os.Signal) int {
+	m.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	done := make(chan int, 1)
+	go func() {
+		code := ExitClean
+		for _, s := range m.stoppers {
+			fmt.Printf("stopping %s...\n", s.name)
+			err := s.fn(ctx)
+			if err != nil {
+				fmt.Printf("stopping %s: %v\n", s.name, err)
+				code = ExitForced
+				continue
+			}
+			fmt.Printf("%s stopped\n", s.name)
+		}
+		done <- code
+	}()
+
+	select {
+	case code := <-done:
+		if code == ExitClean {
+			fmt.Println("clean shutdown -> exiting now!")
+		}
+		return code
+	case <-ctx.Done():
+		fmt.Println("shutdown timeout exceeded -> forcing exit")
+	case s := <-force:
+		fmt.Printf("%s received again -> forcing exit\n", s)
+	}
+	return ExitForced
+}
@@ -0,0 +1,114 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	m := NewManager(time.Second)
+	var order []string
+	for _, name := range []string{"health", "api", "repository"} {
+		name := name
+		m.OnShutdown(name, func(ctx context.Context) error {
+			// background tasks are canceled before the first component stops
+			if m.Context().Err() == nil {
+				t.Errorf("%s stopped before the context was canceled", name)
+			}
+			order = append(order, name)
+			return nil
+		})
+	}
+	if code := m.Shutdown(nil); code != ExitClean {
+		t.Errorf("exit code %d", code)
+	}
+	if !reflect.DeepEqual(order, []string{"health", "api", "repository"}) {
+		t.Errorf("stopped in order %v", order)
+	}
+}
+
+func TestShutdownError(t *testing.T) {
+	m := NewManager(time.Second)
+	stopped := false
+	m.OnShutdown("api", func(ctx context.Context) error { return errors.New("drain failed") })
+	m.OnShutdown("repository", func(ctx context.Context) error {
+		stopped = true
+		return nil
+	})
+	if code := m.Shutdown(nil); code != ExitForced {
+		t.Errorf("exit code %d, want %d", code, ExitForced)
+	}
+	if !stopped {
+		t.Errorf("a failed component stopped the next ones")
+	}
+}
+
+func TestShutdownForced(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	stuck := func(ctx context.Context) error {
+		<-block
+		return nil
+	}
+
+	m := NewManager(50 * time.Millisecond)
+	m.OnShutdown("api", stuck)
+	if code := m.Shutdown(nil); code != ExitForced {
+		t.Errorf("timeout: exit code %d, want %d", code, ExitForced)
+	}
+
+	m = NewManager(time.Minute)
+	m.OnShutdown("api", stuck)
+	force := make(chan os.Signal, 1)
+	force <- syscall.SIGTERM
+	if code := m.Shutdown(force); code != ExitForced {
+		t.Errorf("second signal: exit code %d, want %d", code, ExitForced)
+	}
+}
+
+func TestWaitTasks(t *testing.T) {
+	m := NewManager(time.Second)
+	var order []string
+	returned := make(chan string, 1)
+	m.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		// still working after the cancellation
+		time.Sleep(20 * time.Millisecond)
+		returned <- "task"
+	})
+	m.OnShutdown("api", func(ctx context.Context) error {
+		order = append(order, "api")
+		return nil
+	})
+	m.OnShutdown("background tasks", m.WaitTasks)
+	m.OnShutdown("repository", func(ctx context.Context) error {
+		select {
+		case name := <-returned:
+			order = append(order, name)
+		default:
+		}
+		order = append(order, "repository")
+		return nil
+	})
+	if code := m.Shutdown(nil); code != ExitClean {
+		t.Errorf("exit code %d", code)
+	}
+	if !reflect.DeepEqual(order, []string{"api", "task", "repository"}) {
+		t.Errorf("stopped in order %v", order)
+	}
+
+	// a task that does not return stops the shutdown at its timeout
+	m = NewManager(50 * time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	m.Go(func(ctx context.Context) { <-block })
+	m.OnShutdown("background tasks", m.WaitTasks)
+	if code := m.Shutdown(nil); code != ExitForced {
+		t.Errorf("exit code %d, want %d", code, ExitForced)
+	}
+}
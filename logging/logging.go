@@ -22,10 +22,23 @@ import (
 )
 
 type IService interface {
-	AddRouters(ctx context.Context, routers []domain.Router, tenant string) *[]domain.Router
-	GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int)
-	GetRouter(ctx context.Context, router domain.Router, tenant string) *domain.Router
-	DeleteRouters(ctx context.Context, routers []domain.Router, tenant string)
+	AddRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error)
+	GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error)
+	GetRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) error
+	UpdateRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error)
+	TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (*domain.Router, error)
+	GetGroups(ctx context.Context, root string, tenant string) ([]domain.GroupCount, error)
+	SaveGroup(ctx context.Context, g domain.Group, tenant string) error
+	DeleteGroup(ctx context.Context, id string, tenant string) error
+	AssignRouters(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error)
+	GetQuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error)
+	GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error)
+	GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) ([]domain.RouterVersion, error)
+	DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (*domain.RouterDiff, error)
+	RestoreRouters(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error)
+	GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error)
 }
 
 type LoggingService struct {
@@ -37,11 +50,24 @@ func NewLoggingService(n interface{}) IService {
 
 	return &LoggingService{
 		next: n.(IService),
-		log:  zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).Level(zerolog.InfoLevel).With().Timestamp().Logger(),
+		log:  zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).With().Timestamp().Logger(),
 	}
 }
 
-func (s *LoggingService) AddRouters(ctx context.Context, r []domain.Router, tenant string) (rep *[]domain.Router) {
+// SetLevel changes the level of every logger, it is safe to call while serving (config reload)
+func SetLevel(level string) error {
+	if level == "" {
+		level = zerolog.InfoLevel.String()
+	}
+	l, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(l)
+	return nil
+}
+
+func (s *LoggingService) AddRouters(ctx context.Context, r []domain.Router, tenant string) (rep *[]domain.Router, err error) {
 
 	defer func(start time.Time) {
 		var str string
@@ -59,13 +85,14 @@ func (s *LoggingService) AddRouters(ctx context.Context, r []domain.Router, tena
 			Str("request", sreq).
 			Str("response", str).
 			Str("tenant", tenant).
+			Err(err).
 			Dur("took", time.Since(start)).Send()
 	}(time.Now())
 
 	return s.next.AddRouters(ctx, r, tenant)
 }
 
-func (s *LoggingService) DeleteRouters(ctx context.Context, r []domain.Router, tenant string) {
+func (s *LoggingService) DeleteRouters(ctx context.Context, r []domain.Router, tenant string) (err error) {
 
 	defer func(start time.Time) {
 		var sreq string
@@ -78,13 +105,137 @@ func (s *LoggingService) DeleteRouters(ctx context.Context, r []domain.Router, t
 			Str("method", "DeleteRouters").
 			Str("request", sreq).
 			Str("tenant", tenant).
+			Err(err).
 			Dur("took", time.Since(start)).Send()
 	}(time.Now())
 
-	s.next.DeleteRouters(ctx, r, tenant)
+	return s.next.DeleteRouters(ctx, r, tenant)
 }
 
-func (s *LoggingService) GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (rep *[]domain.Router, last int) {
+func (s *LoggingService) UpdateRouter(ctx context.Context, r domain.Router, tenant string) (rep *domain.Router, err error) {
+
+	defer func(start time.Time) {
+		var str string
+		if rep != nil {
+			str = fmt.Sprintf("%+v", *rep)
+		}
+		s.log.Info().
+			Str("method", "UpdateRouter").
+			Str("request", fmt.Sprintf("%+v", r)).
+			Str("response", str).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.UpdateRouter(ctx, r, tenant)
+}
+
+func (s *LoggingService) LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) (rep []domain.Router, err error) {
+
+	defer func(start time.Time) {
+		var sreq string
+		if len(serials) < 21 {
+			sreq = fmt.Sprintf("%v %+v", serials, change)
+		} else {
+			sreq = fmt.Sprintf("request too large: %d routers being labelled %+v", len(serials), change)
+		}
+		s.log.Info().
+			Str("method", "LabelRouters").
+			Str("request", sreq).
+			Int("labelled", len(rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.LabelRouters(ctx, serials, change, tenant)
+}
+
+func (s *LoggingService) TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (rep *domain.Router, err error) {
+
+	defer func(start time.Time) {
+		var str string
+		if rep != nil {
+			str = fmt.Sprintf("%+v", *rep)
+		}
+		s.log.Info().
+			Str("method", "TransitionRouter").
+			Str("request", fmt.Sprintf("%+v", t)).
+			Str("response", str).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.TransitionRouter(ctx, t, tenant)
+}
+
+func (s *LoggingService) GetGroups(ctx context.Context, root string, tenant string) (rep []domain.GroupCount, err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "GetGroups").
+			Str("request", root).
+			Int("groups", len(rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.GetGroups(ctx, root, tenant)
+}
+
+func (s *LoggingService) SaveGroup(ctx context.Context, g domain.Group, tenant string) (err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "SaveGroup").
+			Str("request", fmt.Sprintf("%+v", g)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.SaveGroup(ctx, g, tenant)
+}
+
+func (s *LoggingService) DeleteGroup(ctx context.Context, id string, tenant string) (err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "DeleteGroup").
+			Str("request", id).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.DeleteGroup(ctx, id, tenant)
+}
+
+func (s *LoggingService) AssignRouters(ctx context.Context, serials []string, group string, tenant string) (rep []domain.Router, err error) {
+
+	defer func(start time.Time) {
+		var sreq string
+		if len(serials) < 21 {
+			sreq = fmt.Sprintf("%v to %q", serials, group)
+		} else {
+			sreq = fmt.Sprintf("request too large: %d routers being moved to %q", len(serials), group)
+		}
+		s.log.Info().
+			Str("method", "AssignRouters").
+			Str("request", sreq).
+			Int("assigned", len(rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.AssignRouters(ctx, serials, group, tenant)
+}
+
+func (s *LoggingService) GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (rep *[]domain.Router, last int, err error) {
 
 	defer func(start time.Time) {
 		var str string
@@ -105,13 +256,14 @@ func (s *LoggingService) GetPagedRouters(ctx context.Context, page domain.Pagina
 			Str("response", str).
 			Int("last", last).
 			Str("tenant", tenant).
+			Err(err).
 			Dur("took", time.Since(start)).Send()
 	}(time.Now())
 
 	return s.next.GetPagedRouters(ctx, page, tenant)
 }
 
-func (s *LoggingService) GetRouter(ctx context.Context, r domain.Router, tenant string) (rep *domain.Router) {
+func (s *LoggingService) GetRouter(ctx context.Context, r domain.Router, tenant string) (rep *domain.Router, err error) {
 
 	defer func(start time.Time) {
 		var str string
@@ -126,8 +278,106 @@ func (s *LoggingService) GetRouter(ctx context.Context, r domain.Router, tenant
 			Str("request", sreq).
 			Str("response", str).
 			Str("tenant", tenant).
+			Err(err).
 			Dur("took", time.Since(start)).Send()
 	}(time.Now())
 
 	return s.next.GetRouter(ctx, r, tenant)
 }
+
+func (s *LoggingService) GetQuotaUsage(ctx context.Context, tenant string) (rep []domain.QuotaUsage, err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "GetQuotaUsage").
+			Str("response", fmt.Sprintf("%+v", rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.GetQuotaUsage(ctx, tenant)
+}
+
+func (s *LoggingService) GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) (rep []domain.AuditEntry, last int, err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "GetAuditTrail").
+			Str("request", fmt.Sprintf("%+v", q)).
+			Int("entries", len(rep)).
+			Int("last", last).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.GetAuditTrail(ctx, q, tenant)
+}
+
+func (s *LoggingService) GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) (rep []domain.RouterVersion, err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "GetRouterHistory").
+			Str("request", fmt.Sprintf("%+v", q)).
+			Int("versions", len(rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.GetRouterHistory(ctx, q, tenant)
+}
+
+func (s *LoggingService) DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (rep *domain.RouterDiff, err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "DiffRouter").
+			Str("request", fmt.Sprintf("%+v", q)).
+			Str("response", fmt.Sprintf("%+v", rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.DiffRouter(ctx, q, tenant)
+}
+
+func (s *LoggingService) RestoreRouters(ctx context.Context, r []domain.Router, tenant string) (rep []domain.Router, err error) {
+
+	defer func(start time.Time) {
+		var sreq string
+		if len(r) < 21 {
+			sreq = fmt.Sprintf("%+v", r)
+		} else {
+			sreq = fmt.Sprintf("request too large: %d routers being restored", len(r))
+		}
+		s.log.Info().
+			Str("method", "RestoreRouters").
+			Str("request", sreq).
+			Int("restored", len(rep)).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.RestoreRouters(ctx, r, tenant)
+}
+
+func (s *LoggingService) GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) (rep []domain.DeletedRouter, last int, err error) {
+
+	defer func(start time.Time) {
+		s.log.Info().
+			Str("method", "GetDeletedRouters").
+			Str("request", fmt.Sprintf("%+v", page)).
+			Int("routers", len(rep)).
+			Int("last", last).
+			Str("tenant", tenant).
+			Err(err).
+			Dur("took", time.Since(start)).Send()
+	}(time.Now())
+
+	return s.next.GetDeletedRouters(ctx, page, tenant)
+}
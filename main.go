@@ -1,94 +1,120 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"github.com/Go-routine-4995/routermgt/adapter/controllers"
-	"github.com/Go-routine-4995/routermgt/adapter/repository/postgres"
-	"github.com/Go-routine-4995/routermgt/logging"
-	"github.com/Go-routine-4995/routermgt/service"
-	"gopkg.in/yaml.v2"
+	"github.com/Go-routine-4995/routermgt/config"
 	"os"
-	"sync"
+	"strings"
 )
 
 const (
-	config  = "conf.yml"
-	version = 0.01
+	configFile = "conf.yml"
 )
 
-type Config struct {
-	Service struct {
-		Nats    string `yaml:"nats"`
-		Subject string `yaml:"subject"`
-	} `yaml:"service"`
-	Database struct {
-		PubKey     string `yaml:"pubKey"`
-		ClientCert string `yaml:"client-cert"`
-		ClientKey  string `yaml:"client-key"`
-		ServerCert string `yaml:"server-cert"`
-		Address    string `yaml:"address"`
-		User       string `yaml:"user"`
-		Password   string `yaml:"password"`
-		Database   string `yaml:"database"`
-	} `yaml:"database"`
-	Server struct {
-		Url string `yaml:"nats"`
-	} `yaml:"server"`
+// build information, injected at link time:
+// go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: routermgt <command> [flags]
+
+Commands:
+  serve                       start the service (default command)
+  migrate up|down|status      manage the database schema
+  check-config                validate the configuration and test DB/NATS connectivity
+  import -f <file.json>       load routers from a JSON array into the inventory
+  export [-f <file.json>]     dump the inventory as a JSON array (stdout by default)
+  quota [-account a] [-limit n|-delete]
+                              show the router quotas of a tenant, or set/remove one
+  version                     print build information
+
+Every command but version accepts -config <file> (default %s).
+
+Every configuration field can be overridden by an environment variable named after
+its path, e.g. %s, or read from a file with %s_FILE.
+`, configFile, config.EnvName("database.password"), config.EnvName("database.password"))
 }
 
 func main() {
 	var (
-		conf string
-		wg   *sync.WaitGroup
+		cmd  string
+		args []string
+		err  error
 	)
-	fmt.Println("Starting OSS Routers/service v", version)
-	args := os.Args
-	if len(args) < 2 {
-		conf = config
-	} else {
-		conf = args[1]
-	}
-
-	wg = new(sync.WaitGroup)
-	cfg := openFile(conf)
-
-	// new repo
-	//r := simdb.NewSimDB()
-	wg.Add(1)
-	r := postgres.NewPostgres(cfg.Database.Address,
-		cfg.Database.User,
-		cfg.Database.Password,
-		cfg.Database.Database,
-		cfg.Database.ClientCert,
-		cfg.Database.ClientKey,
-		cfg.Database.ServerCert,
-		wg)
 
-	// new service
-	svc := service.NewService(r)
-
-	// new logger
-	svc = logging.NewLoggingService(svc)
+	args = os.Args[1:]
+	cmd = "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = args[0]
+		args = args[1:]
+	}
 
-	// new Api
-	api := controllers.NewApiService(svc, cfg.Service.Nats, cfg.Service.Subject, wg)
-	api.Start()
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = usage
+	conf := fs.String("config", configFile, "configuration file")
 
-}
+	switch cmd {
+	case "serve":
+		_ = fs.Parse(args)
+		err = serve(*conf, openFile(*conf))
+	case "migrate":
+		_ = fs.Parse(args)
+		err = migrate(openFile(*conf), fs.Arg(0))
+	case "check-config":
+		_ = fs.Parse(args)
+		err = checkConfig(*conf)
+	case "import":
+		file := fs.String("f", "", "JSON file containing an array of routers")
+		tenant := fs.String("tenant", defaultTenant, "tenant owning the routers")
+		_ = fs.Parse(args)
+		err = importRouters(openFile(*conf), *file, *tenant)
+	case "export":
+		file := fs.String("f", "", "output file, stdout when empty")
+		tenant := fs.String("tenant", defaultTenant, "tenant owning the routers")
+		_ = fs.Parse(args)
+		err = exportRouters(openFile(*conf), *file, *tenant)
+	case "quota":
+		tenant := fs.String("tenant", defaultTenant, "tenant of the quota")
+		account := fs.String("account", "", "account of the quota, the whole tenant when empty")
+		limit := fs.Int("limit", -1, "maximum number of routers, 0 is unlimited")
+		del := fs.Bool("delete", false, "remove the quota")
+		_ = fs.Parse(args)
+		err = quotas(openFile(*conf), *tenant, *account, *limit, *del)
+	case "version":
+		fmt.Printf("routermgt %s (commit %s, built %s)\n", version, commit, date)
+	case "help", "-h", "--help":
+		usage()
+	default:
+		// backward compatibility: routermgt <config file>
+		if strings.HasSuffix(cmd, ".yml") || strings.HasSuffix(cmd, ".yaml") {
+			err = serve(cmd, openFile(cmd))
+			break
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
 
-func openFile(s string) Config {
-	f, err := os.Open(s)
 	if err != nil {
 		processError(err)
 	}
-	defer f.Close()
+}
 
-	var cfg Config
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(&cfg)
+// openFile loads and validates the configuration, the service does not start on an invalid configuration
+func openFile(s string) config.Config {
+	cfg, err := config.Load(s)
 	if err != nil {
 		processError(err)
 	}
+	err = cfg.Validate()
+	if err != nil {
+		processError(fmt.Errorf("invalid configuration:\n%w", err))
+	}
 
 	return cfg
 }
@@ -0,0 +1,352 @@
+/**
+ * @file    ratelimit.go
+ * @brief   Per tenant and per operation rate limiting of the service.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * Each tenant gets a token bucket per operation. Reads cost one token, create, delete and restore
+ * cost one token per router so that a bulk import is throttled like as many single requests: a
+ * request larger than the burst waits for a full bucket then leaves it in debt.
+ */
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"math"
+	"sync"
+	"time"
+)
+
+// operations limited separately, "*" in Options.Tenants applies to every operation of a tenant
+const (
+	OpGet        = "get"
+	OpList       = "list"
+	OpCreate     = "create"
+	OpUpdate     = "update"
+	OpLabel      = "label"
+	OpAssign     = "assign"
+	OpTransition = "transition"
+	// the group operations share the groups bucket
+	OpGroups  = "groups"
+	OpDelete  = "delete"
+	OpQuota   = "quota"
+	OpAudit   = "audit"
+	OpHistory = "history"
+	OpDiff    = "diff"
+	OpRestore = "restore"
+	OpDeleted = "deleted"
+
+	AnyOperation = "*"
+
+	// sweepInterval is how often the buckets back to full, as good as new, are dropped
+	sweepInterval = time.Minute
+)
+
+var (
+	ErrRateLimited   = errors.New("rate limited")
+	ErrBatchTooLarge = errors.New("batch too large")
+)
+
+// Error is returned when a bucket is empty, the request may be retried after RetryAfter
+type Error struct {
+	Tenant     string
+	Operation  string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rate limit of tenant %s exceeded for %s, retry in %s", e.Tenant, e.Operation, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *Error) Unwrap() error {
+	return ErrRateLimited
+}
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst, Rate <= 0 is unlimited
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type Options struct {
+	// MaxBatch routers per create or delete request, 0 is unlimited
+	MaxBatch int
+	// Default limit of each tenant and operation
+	Default Limit
+	// Operations overrides Default per operation
+	Operations map[string]Limit
+	// Tenants overrides the limits per tenant then operation
+	Tenants map[string]map[string]Limit
+}
+
+type IService interface {
+	AddRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error)
+	GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error)
+	GetRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) error
+	UpdateRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error)
+	TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (*domain.Router, error)
+	GetGroups(ctx context.Context, root string, tenant string) ([]domain.GroupCount, error)
+	SaveGroup(ctx context.Context, g domain.Group, tenant string) error
+	DeleteGroup(ctx context.Context, id string, tenant string) error
+	AssignRouters(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error)
+	GetQuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error)
+	GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error)
+	GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) ([]domain.RouterVersion, error)
+	DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (*domain.RouterDiff, error)
+	RestoreRouters(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error)
+	GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error)
+}
+
+type bucket struct {
+	limit  Limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last request
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+type RateLimitService struct {
+	next    IService
+	mu      sync.Mutex
+	opts    Options
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+func NewRateLimitService(n interface{}, o Options) *RateLimitService {
+	return &RateLimitService{
+		next:    n.(IService),
+		opts:    o,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// SetOptions changes the limits, it is safe to call while serving (config reload)
+func (s *RateLimitService) SetOptions(o Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = o
+}
+
+func (s *RateLimitService) limit(tenant string, op string) Limit {
+	if t, ok := s.opts.Tenants[tenant]; ok {
+		if l, ok := t[op]; ok {
+			return l
+		}
+		if l, ok := t[AnyOperation]; ok {
+			return l
+		}
+	}
+	if l, ok := s.opts.Operations[op]; ok {
+		return l
+	}
+	return s.opts.Default
+}
+
+// allow takes cost tokens from the bucket of tenant and op
+func (s *RateLimitService) allow(tenant string, op string, cost int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	l := s.limit(tenant, op)
+	if l.Rate <= 0 {
+		return nil
+	}
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(l.Rate))
+	}
+	c := math.Max(float64(cost), 1)
+
+	key := tenant + "\x00" + op
+	b, ok := s.buckets[key]
+	if !ok || b.limit != l {
+		b = &bucket{limit: l, burst: burst, tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+
+	// a request larger than the bucket passes with a full bucket instead of never passing, the
+	// whole cost is charged and the next requests wait until the debt is paid back
+	need := math.Min(c, burst)
+	if b.tokens >= need {
+		b.tokens -= c
+		return nil
+	}
+	wait := time.Duration((need - b.tokens) / l.Rate * float64(time.Second))
+	return &Error{Tenant: tenant, Operation: op, RetryAfter: wait}
+}
+
+// sweep drops the full buckets so that the map does not grow with every tenant ever seen,
+// a new bucket starts full
+func (s *RateLimitService) sweep(now time.Time) {
+	if now.Sub(s.swept) < sweepInterval {
+		return
+	}
+	s.swept = now
+	for k, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(s.buckets, k)
+		}
+	}
+}
+
+func (s *RateLimitService) batch(n int) error {
+	s.mu.Lock()
+	max := s.opts.MaxBatch
+	s.mu.Unlock()
+	if max > 0 && n > max {
+		return fmt.Errorf("%w: %d routers, at most %d per request", ErrBatchTooLarge, n, max)
+	}
+	return nil
+}
+
+func (s *RateLimitService) AddRouters(ctx context.Context, r []domain.Router, tenant string) (*[]domain.Router, error) {
+	if err := s.batch(len(r)); err != nil {
+		return nil, err
+	}
+	if err := s.allow(tenant, OpCreate, len(r)); err != nil {
+		return nil, err
+	}
+	return s.next.AddRouters(ctx, r, tenant)
+}
+
+func (s *RateLimitService) DeleteRouters(ctx context.Context, r []domain.Router, tenant string) error {
+	if err := s.batch(len(r)); err != nil {
+		return err
+	}
+	if err := s.allow(tenant, OpDelete, len(r)); err != nil {
+		return err
+	}
+	return s.next.DeleteRouters(ctx, r, tenant)
+}
+
+func (s *RateLimitService) UpdateRouter(ctx context.Context, r domain.Router, tenant string) (*domain.Router, error) {
+	if err := s.allow(tenant, OpUpdate, 1); err != nil {
+		return nil, err
+	}
+	return s.next.UpdateRouter(ctx, r, tenant)
+}
+
+func (s *RateLimitService) LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error) {
+	if err := s.batch(len(serials)); err != nil {
+		return nil, err
+	}
+	if err := s.allow(tenant, OpLabel, len(serials)); err != nil {
+		return nil, err
+	}
+	return s.next.LabelRouters(ctx, serials, change, tenant)
+}
+
+func (s *RateLimitService) TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (*domain.Router, error) {
+	if err := s.allow(tenant, OpTransition, 1); err != nil {
+		return nil, err
+	}
+	return s.next.TransitionRouter(ctx, t, tenant)
+}
+
+func (s *RateLimitService) GetGroups(ctx context.Context, root string, tenant string) ([]domain.GroupCount, error) {
+	if err := s.allow(tenant, OpGroups, 1); err != nil {
+		return nil, err
+	}
+	return s.next.GetGroups(ctx, root, tenant)
+}
+
+func (s *RateLimitService) SaveGroup(ctx context.Context, g domain.Group, tenant string) error {
+	if err := s.allow(tenant, OpGroups, 1); err != nil {
+		return err
+	}
+	return s.next.SaveGroup(ctx, g, tenant)
+}
+
+func (s *RateLimitService) DeleteGroup(ctx context.Context, id string, tenant string) error {
+	if err := s.allow(tenant, OpGroups, 1); err != nil {
+		return err
+	}
+	return s.next.DeleteGroup(ctx, id, tenant)
+}
+
+func (s *RateLimitService) AssignRouters(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error) {
+	if err := s.batch(len(serials)); err != nil {
+		return nil, err
+	}
+	if err := s.allow(tenant, OpAssign, len(serials)); err != nil {
+		return nil, err
+	}
+	return s.next.AssignRouters(ctx, serials, group, tenant)
+}
+
+func (s *RateLimitService) GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error) {
+	if err := s.allow(tenant, OpList, 1); err != nil {
+		return nil, 0, err
+	}
+	return s.next.GetPagedRouters(ctx, page, tenant)
+}
+
+func (s *RateLimitService) GetRouter(ctx context.Context, r domain.Router, tenant string) (*domain.Router, error) {
+	if err := s.allow(tenant, OpGet, 1); err != nil {
+		return nil, err
+	}
+	return s.next.GetRouter(ctx, r, tenant)
+}
+
+func (s *RateLimitService) GetQuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error) {
+	if err := s.allow(tenant, OpQuota, 1); err != nil {
+		return nil, err
+	}
+	return s.next.GetQuotaUsage(ctx, tenant)
+}
+
+func (s *RateLimitService) GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error) {
+	if err := s.allow(tenant, OpAudit, 1); err != nil {
+		return nil, 0, err
+	}
+	return s.next.GetAuditTrail(ctx, q, tenant)
+}
+
+func (s *RateLimitService) GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) ([]domain.RouterVersion, error) {
+	if err := s.allow(tenant, OpHistory, 1); err != nil {
+		return nil, err
+	}
+	return s.next.GetRouterHistory(ctx, q, tenant)
+}
+
+func (s *RateLimitService) DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (*domain.RouterDiff, error) {
+	if err := s.allow(tenant, OpDiff, 1); err != nil {
+		return nil, err
+	}
+	return s.next.DiffRouter(ctx, q, tenant)
+}
+
+func (s *RateLimitService) RestoreRouters(ctx context.Context, r []domain.Router, tenant string) ([]domain.Router, error) {
+	if err := s.batch(len(r)); err != nil {
+		return nil, err
+	}
+	if err := s.allow(tenant, OpRestore, len(r)); err != nil {
+		return nil, err
+	}
+	return s.next.RestoreRouters(ctx, r, tenant)
+}
+
+func (s *RateLimitService) GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error) {
+	if err := s.allow(tenant, OpDeleted, 1); err != nil {
+		return nil, 0, err
+	}
+	return s.next.GetDeletedRouters(ctx, page, tenant)
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2023, 6, 17, 12, 0, 0, 0, time.UTC)
+
+// clock is the time seen by the service, tests move it forward
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newService(o Options) (*RateLimitService, *clock) {
+	c := &clock{now: testNow}
+	s := &RateLimitService{
+		opts:    o,
+		buckets: make(map[string]*bucket),
+		now:     func() time.Time { return c.now },
+		swept:   testNow,
+	}
+	return s, c
+}
+
+func TestAllow(t *testing.T) {
+	type step struct {
+		after time.Duration
+		op    string
+		cost  int
+		retry time.Duration // 0 when the request is allowed
+	}
+	tests := []struct {
+		name  string
+		opts  Options
+		steps []step
+	}{
+		{"unlimited", Options{}, []step{
+			{0, OpGet, 1, 0}, {0, OpGet, 1000, 0},
+		}},
+		{"burst then rate", Options{Default: Limit{Rate: 2, Burst: 3}}, []step{
+			{0, OpGet, 1, 0}, {0, OpGet, 1, 0}, {0, OpGet, 1, 0},
+			{0, OpGet, 1, 500 * time.Millisecond},
+			{500 * time.Millisecond, OpGet, 1, 0},
+			{0, OpGet, 1, 500 * time.Millisecond},
+		}},
+		{"refill up to burst", Options{Default: Limit{Rate: 1, Burst: 2}}, []step{
+			{0, OpGet, 2, 0},
+			{time.Hour, OpGet, 2, 0},
+			{0, OpGet, 1, time.Second},
+		}},
+		{"zero cost charged one", Options{Default: Limit{Rate: 1, Burst: 1}}, []step{
+			{0, OpGet, 0, 0}, {0, OpGet, 0, time.Second},
+		}},
+		{"cost per router", Options{Default: Limit{Rate: 10, Burst: 10}}, []step{
+			{0, OpCreate, 8, 0},
+			{0, OpCreate, 5, 300 * time.Millisecond},
+			{300 * time.Millisecond, OpCreate, 5, 0},
+		}},
+		// the whole cost of a request larger than the burst is charged, the debt is paid back
+		// before the next request
+		{"larger than burst", Options{Default: Limit{Rate: 10, Burst: 10}}, []step{
+			{0, OpCreate, 1, 0},
+			{0, OpCreate, 30, 100 * time.Millisecond},
+			{100 * time.Millisecond, OpCreate, 30, 0},
+			{0, OpCreate, 1, 2100 * time.Millisecond},
+			{2 * time.Second, OpCreate, 1, 100 * time.Millisecond},
+			{100 * time.Millisecond, OpCreate, 1, 0},
+		}},
+		{"burst defaults to rate", Options{Default: Limit{Rate: 2.5}}, []step{
+			{0, OpGet, 3, 0}, {0, OpGet, 1, 400 * time.Millisecond},
+		}},
+		{"operations have their own bucket", Options{Default: Limit{Rate: 1, Burst: 1}}, []step{
+			{0, OpGet, 1, 0}, {0, OpList, 1, 0}, {0, OpGet, 1, time.Second},
+		}},
+		{"operation override", Options{Default: Limit{Rate: 1, Burst: 1}, Operations: map[string]Limit{OpList: {Rate: 0}}}, []step{
+			{0, OpList, 1, 0}, {0, OpList, 1, 0}, {0, OpGet, 1, 0}, {0, OpGet, 1, time.Second},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c := newService(tt.opts)
+			for i, st := range tt.steps {
+				c.advance(st.after)
+				err := s.allow("acme", st.op, st.cost)
+				if st.retry == 0 {
+					if err != nil {
+						t.Fatalf("step %d: unexpected error: %v", i, err)
+					}
+					continue
+				}
+				var e *Error
+				if !errors.As(err, &e) {
+					t.Fatalf("step %d: expected a rate limit error, got %v", i, err)
+				}
+				if !errors.Is(err, ErrRateLimited) || e.Tenant != "acme" || e.Operation != st.op {
+					t.Errorf("step %d: unexpected error %+v", i, e)
+				}
+				if d := e.RetryAfter - st.retry; d < -time.Millisecond || d > time.Millisecond {
+					t.Errorf("step %d: retry after %s, want %s", i, e.RetryAfter, st.retry)
+				}
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	s, _ := newService(Options{
+		Default:    Limit{Rate: 1},
+		Operations: map[string]Limit{OpList: {Rate: 2}},
+		Tenants: map[string]map[string]Limit{
+			"big":   {AnyOperation: {Rate: 10}, OpGet: {Rate: 20}},
+			"small": {OpGet: {Rate: 0.5}},
+		},
+	})
+	tests := []struct {
+		tenant string
+		op     string
+		rate   float64
+	}{
+		{"acme", OpGet, 1},
+		{"acme", OpList, 2},
+		{"big", OpGet, 20},
+		{"big", OpList, 10},
+		{"big", OpCreate, 10},
+		{"small", OpGet, 0.5},
+		{"small", OpList, 2},
+		{"small", OpCreate, 1},
+	}
+	for _, tt := range tests {
+		if l := s.limit(tt.tenant, tt.op); l.Rate != tt.rate {
+			t.Errorf("limit(%s, %s) = %v, want rate %v", tt.tenant, tt.op, l, tt.rate)
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	s, _ := newService(Options{Default: Limit{Rate: 1, Burst: 1}})
+	if err := s.allow("acme", OpGet, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.allow("acme", OpGet, 1); err == nil {
+		t.Fatal("empty bucket allowed a request")
+	}
+	// a changed limit starts a new full bucket
+	s.SetOptions(Options{Default: Limit{Rate: 1, Burst: 2}})
+	if err := s.allow("acme", OpGet, 2); err != nil {
+		t.Fatalf("new limit not applied: %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s, c := newService(Options{Default: Limit{Rate: 1, Burst: 10}})
+	for _, tenant := range []string{"a", "b", "c"} {
+		if err := s.allow(tenant, OpGet, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// full again after 100 seconds
+	if err := s.allow("c", OpCreate, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// before the interval nothing is dropped
+	c.advance(sweepInterval / 2)
+	if err := s.allow("a", OpGet, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.buckets) != 4 {
+		t.Fatalf("%d buckets, want 4", len(s.buckets))
+	}
+
+	// the get buckets are full again and dropped, a is created again by the request, the
+	// create bucket of c is still in debt
+	c.advance(sweepInterval/2 + 5*time.Second)
+	if err := s.allow("a", OpGet, 9); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a\x00get", "c\x00create"}
+	if len(s.buckets) != len(want) {
+		t.Fatalf("%d buckets, want %v", len(s.buckets), want)
+	}
+	for _, k := range want {
+		if _, ok := s.buckets[k]; !ok {
+			t.Errorf("bucket %q dropped", k)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s, _ := newService(Options{MaxBatch: 2})
+	if err := s.batch(2); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := s.batch(3); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("expected ErrBatchTooLarge, got %v", err)
+	}
+	s.SetOptions(Options{})
+	if err := s.batch(1000); err != nil {
+		t.Errorf("unlimited batch: %v", err)
+	}
+}
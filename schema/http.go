@@ -0,0 +1,45 @@
+package schema
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Handler serves the index of the schemas on /schemas and each schema on /schemas/<name>.json
+func Handler(schemas map[string]*Schema) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/schemas"), "/"), ".json")
+		if name == "" {
+			index := make([]string, 0, len(schemas))
+			for n := range schemas {
+				index = append(index, "/schemas/"+n+".json")
+			}
+			sort.Strings(index)
+			write(w, index)
+			return
+		}
+		s, ok := schemas[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		write(w, s)
+	})
+}
+
+func write(w http.ResponseWriter, v interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,172 @@
+/**
+ * @file    schema.go
+ * @brief   JSON Schema generation and validation of the API payloads.
+ *
+ * License under GNU GENERAL PUBLIC LICENSE Version 3, 29 June 2007
+ * Schemas are generated from the Go types: property names come from the json tags and the
+ * constraints from the jsonschema tags, e.g. `jsonschema:"required,minLength=1,format=uuid"`.
+ * Supported constraints: required, minLength, maxLength, minimum, maximum, pattern (without
+ * comma), format and enum (values separated by |).
+ */
+
+package schema
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Draft of the generated schemas
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema used by the API
+type Schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	ID          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	MinItems    *int               `json:"minItems,omitempty"`
+	MaxItems    *int               `json:"maxItems,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Maximum     *float64           `json:"maximum,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+}
+
+// Generate returns the schema of the type of v
+func Generate(v interface{}) *Schema {
+	return generate(reflect.TypeOf(v))
+}
+
+// ArrayOf returns the schema of a non empty array of items
+func ArrayOf(items *Schema) *Schema {
+	one := 1
+	return &Schema{Type: "array", Items: items, MinItems: &one}
+}
+
+// Root sets the draft, the id and the title of a top level schema
+func (s *Schema) Root(id string, title string) *Schema {
+	c := *s
+	c.Schema = Draft
+	c.ID = id
+	c.Title = title
+	return &c
+}
+
+func generate(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded in base64
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: generate(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		addFields(s, t)
+		return s
+	}
+	return &Schema{}
+}
+
+// addFields adds the properties of the struct t, embedded structs are flattened like encoding/json does
+func addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFields(s, f.Type)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		p := generate(f.Type)
+		if constrain(p, f.Tag.Get("jsonschema")) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = p
+	}
+}
+
+// constrain applies the jsonschema tag and returns whether the property is required
+func constrain(s *Schema, tag string) bool {
+	required := false
+	if tag == "" {
+		return false
+	}
+	for _, c := range strings.Split(tag, ",") {
+		kv := strings.SplitN(c, "=", 2)
+		val := ""
+		if len(kv) == 2 {
+			val = kv[1]
+		}
+		switch kv[0] {
+		case "required":
+			required = true
+		case "minLength":
+			s.MinLength = intPtr(val)
+		case "maxLength":
+			s.MaxLength = intPtr(val)
+		case "minimum":
+			s.Minimum = floatPtr(val)
+		case "maximum":
+			s.Maximum = floatPtr(val)
+		case "pattern":
+			s.Pattern = val
+		case "format":
+			s.Format = val
+		case "enum":
+			s.Enum = strings.Split(val, "|")
+		case "description":
+			s.Description = val
+		}
+	}
+	return required
+}
+
+func intPtr(v string) *int {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+func floatPtr(v string) *float64 {
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
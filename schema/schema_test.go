@@ -0,0 +1,93 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type embedded struct {
+	Kind string `json:"kind" jsonschema:"required"`
+}
+
+type sample struct {
+	embedded
+	ID       string            `json:"id" jsonschema:"required,minLength=1,maxLength=8,pattern=^[a-z]+$"`
+	Format   string            `json:"format,omitempty" jsonschema:"format=uuid"`
+	Enum     string            `json:"enum,omitempty" jsonschema:"enum=a|b|c"`
+	Count    int               `json:"count" jsonschema:"minimum=0,maximum=10"`
+	Ratio    float64           `json:"ratio"`
+	Enabled  bool              `json:"enabled"`
+	Tags     []string          `json:"tags"`
+	Raw      []byte            `json:"raw"`
+	Labels   map[string]string `json:"labels"`
+	When     time.Time         `json:"when"`
+	Since    *time.Time        `json:"since,omitempty"`
+	Child    *embedded         `json:"child"`
+	NoTag    string
+	Ignored  string `json:"-"`
+	internal string
+}
+
+func TestGenerate(t *testing.T) {
+	s := Generate(sample{})
+	if s.Type != "object" {
+		t.Fatalf("type %q", s.Type)
+	}
+	if want := []string{"kind", "id"}; !reflect.DeepEqual(s.Required, want) {
+		t.Errorf("required %v, want %v", s.Required, want)
+	}
+
+	tests := []struct {
+		name string
+		want Schema
+	}{
+		{"kind", Schema{Type: "string"}},
+		{"id", Schema{Type: "string", MinLength: intPtr("1"), MaxLength: intPtr("8"), Pattern: "^[a-z]+$"}},
+		{"format", Schema{Type: "string", Format: "uuid"}},
+		{"enum", Schema{Type: "string", Enum: []string{"a", "b", "c"}}},
+		{"count", Schema{Type: "integer", Minimum: floatPtr("0"), Maximum: floatPtr("10")}},
+		{"ratio", Schema{Type: "number"}},
+		{"enabled", Schema{Type: "boolean"}},
+		{"tags", Schema{Type: "array", Items: &Schema{Type: "string"}}},
+		{"raw", Schema{Type: "string", Format: "byte"}},
+		{"labels", Schema{Type: "object"}},
+		{"when", Schema{Type: "string", Format: "date-time"}},
+		{"since", Schema{Type: "string", Format: "date-time"}},
+		{"child", Schema{Type: "object", Properties: map[string]*Schema{"kind": {Type: "string"}}, Required: []string{"kind"}}},
+		{"NoTag", Schema{Type: "string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := s.Properties[tt.name]
+			if !ok {
+				t.Fatalf("missing property")
+			}
+			if !reflect.DeepEqual(*p, tt.want) {
+				t.Errorf("got %+v, want %+v", *p, tt.want)
+			}
+		})
+	}
+	for _, name := range []string{"-", "Ignored", "internal", "embedded"} {
+		if _, ok := s.Properties[name]; ok {
+			t.Errorf("unexpected property %q", name)
+		}
+	}
+	if len(s.Properties) != len(tests) {
+		t.Errorf("%d properties, want %d", len(s.Properties), len(tests))
+	}
+}
+
+func TestRoot(t *testing.T) {
+	items := Generate(embedded{})
+	s := ArrayOf(items).Root("create.request", "Create")
+	if s.Schema != Draft || s.ID != "create.request" || s.Title != "Create" {
+		t.Errorf("unexpected root %+v", s)
+	}
+	if s.Type != "array" || s.Items != items || s.MinItems == nil || *s.MinItems != 1 {
+		t.Errorf("unexpected array %+v", s)
+	}
+	if items.Schema != "" {
+		t.Errorf("Root changed the items")
+	}
+}
@@ -0,0 +1,227 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError locates a violation, Path is a JSONPath such as $[0].router-serial
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Errors are returned by Validate, every violation is reported
+type Errors []ValidationError
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, v := range e {
+		s[i] = v.Path + ": " + v.Message
+	}
+	return strings.Join(s, "; ")
+}
+
+var (
+	patterns sync.Map
+	uuid     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// Validate checks the JSON document against s. Property names are matched case-insensitively
+// and null is accepted for optional properties, as encoding/json decodes them.
+func Validate(s *Schema, data []byte) error {
+	var (
+		v    interface{}
+		errs Errors
+	)
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&v)
+	if err != nil {
+		return Errors{{Path: "$", Message: "invalid JSON: " + err.Error()}}
+	}
+	if d.More() {
+		return Errors{{Path: "$", Message: "invalid JSON: data after the document"}}
+	}
+	if v == nil && s.Type != "" {
+		return Errors{{Path: "$", Message: "expected " + s.Type + ", got null"}}
+	}
+	validate(s, v, "$", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validate(s *Schema, v interface{}, path string, errs *Errors) {
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, a...)})
+	}
+	if v == nil {
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected object, got %s", kind(v))
+			return
+		}
+		validateObject(s, o, path, errs)
+	case "array":
+		l, ok := v.([]interface{})
+		if !ok {
+			fail("expected array, got %s", kind(v))
+			return
+		}
+		if s.MinItems != nil && len(l) < *s.MinItems {
+			fail("expected at least %d item(s), got %d", *s.MinItems, len(l))
+		}
+		if s.MaxItems != nil && len(l) > *s.MaxItems {
+			fail("expected at most %d item(s), got %d", *s.MaxItems, len(l))
+		}
+		if s.Items != nil {
+			for i, item := range l {
+				validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("expected string, got %s", kind(v))
+			return
+		}
+		validateString(s, str, fail)
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("expected %s, got %s", s.Type, kind(v))
+			return
+		}
+		if s.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				fail("expected integer, got %s", n)
+				return
+			}
+		}
+		f, _ := n.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be >= %v, got %s", *s.Minimum, n)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("must be <= %v, got %s", *s.Maximum, n)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("expected boolean, got %s", kind(v))
+		}
+	}
+}
+
+func validateObject(s *Schema, o map[string]interface{}, path string, errs *Errors) {
+	for _, r := range s.Required {
+		if _, v, ok := lookup(o, r); !ok || v == nil {
+			*errs = append(*errs, ValidationError{Path: path + "." + r, Message: "is required"})
+		}
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if key, v, ok := lookup(o, name); ok {
+			validate(s.Properties[name], v, path+"."+key, errs)
+		}
+	}
+}
+
+// lookup finds the property like encoding/json: exact name first then case-insensitive
+func lookup(o map[string]interface{}, name string) (string, interface{}, bool) {
+	if v, ok := o[name]; ok {
+		return name, v, true
+	}
+	for k, v := range o {
+		if strings.EqualFold(k, name) {
+			return k, v, true
+		}
+	}
+	return "", nil, false
+}
+
+func validateString(s *Schema, str string, fail func(string, ...interface{})) {
+	l := utf8.RuneCountInString(str)
+	if s.MinLength != nil && l < *s.MinLength {
+		if *s.MinLength == 1 {
+			fail("must not be empty")
+		} else {
+			fail("expected at least %d characters, got %d", *s.MinLength, l)
+		}
+	}
+	if s.MaxLength != nil && l > *s.MaxLength {
+		fail("expected at most %d characters, got %d", *s.MaxLength, l)
+	}
+	if s.Pattern != "" {
+		re, err := compile(s.Pattern)
+		if err != nil {
+			fail("invalid pattern %q in schema: %v", s.Pattern, err)
+		} else if !re.MatchString(str) {
+			fail("%q does not match %s", str, s.Pattern)
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || e == str
+		}
+		if !found {
+			fail("%q is not one of %s", str, strings.Join(s.Enum, ", "))
+		}
+	}
+	switch s.Format {
+	case "uuid":
+		if !uuid.MatchString(str) {
+			fail("%q is not a UUID", str)
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, str); err != nil {
+			fail("%q is not a RFC 3339 date-time", str)
+		}
+	}
+}
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
+
+func kind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
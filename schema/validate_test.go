@@ -0,0 +1,77 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	s := Generate(sample{})
+	list := ArrayOf(Generate(embedded{}))
+
+	tests := []struct {
+		name   string
+		schema *Schema
+		data   string
+		errs   Errors
+	}{
+		{"valid", s, `{"kind":"k","id":"abc","count":3,"ratio":0.5,"enabled":true,"tags":["x"],"labels":{"a":"b"},"when":"2023-06-17T12:00:00Z"}`, nil},
+		{"case-insensitive names", s, `{"KIND":"k","Id":"abc"}`, nil},
+		{"null optional", s, `{"kind":"k","id":"abc","format":null}`, nil},
+		{"missing required", s, `{"id":"abc"}`, Errors{{"$.kind", "is required"}}},
+		{"null required", s, `{"kind":null,"id":"abc"}`, Errors{{"$.kind", "is required"}}},
+		{"empty", s, `{"kind":"k","id":""}`, Errors{{"$.id", "must not be empty"}, {"$.id", `"" does not match ^[a-z]+$`}}},
+		{"too long", s, `{"kind":"k","id":"abcdefghi"}`, Errors{{"$.id", "expected at most 8 characters, got 9"}}},
+		{"pattern", s, `{"kind":"k","id":"ABC"}`, Errors{{"$.id", `"ABC" does not match ^[a-z]+$`}}},
+		{"enum", s, `{"kind":"k","id":"abc","enum":"d"}`, Errors{{"$.enum", `"d" is not one of a, b, c`}}},
+		{"uuid", s, `{"kind":"k","id":"abc","format":"123"}`, Errors{{"$.format", `"123" is not a UUID`}}},
+		{"date-time", s, `{"kind":"k","id":"abc","when":"yesterday"}`, Errors{{"$.when", `"yesterday" is not a RFC 3339 date-time`}}},
+		{"minimum", s, `{"kind":"k","id":"abc","count":-1}`, Errors{{"$.count", "must be >= 0, got -1"}}},
+		{"maximum", s, `{"kind":"k","id":"abc","count":11}`, Errors{{"$.count", "must be <= 10, got 11"}}},
+		{"not an integer", s, `{"kind":"k","id":"abc","count":1.5}`, Errors{{"$.count", "expected integer, got 1.5"}}},
+		{"wrong types", s, `{"kind":1,"id":"abc","enabled":"yes","tags":"x","labels":[]}`, Errors{
+			{"$.enabled", "expected boolean, got string"},
+			{"$.kind", "expected string, got number"},
+			{"$.labels", "expected object, got array"},
+			{"$.tags", "expected array, got string"},
+		}},
+		{"every error", s, `{"count":20,"enum":"z"}`, Errors{
+			{"$.kind", "is required"},
+			{"$.id", "is required"},
+			{"$.count", "must be <= 10, got 20"},
+			{"$.enum", `"z" is not one of a, b, c`},
+		}},
+		{"array item", list, `[{"kind":"a"},{}]`, Errors{{"$[1].kind", "is required"}}},
+		{"empty array", list, `[]`, Errors{{"$", "expected at least 1 item(s), got 0"}}},
+		{"not an array", list, `{"kind":"a"}`, Errors{{"$", "expected array, got object"}}},
+		{"null document", s, `null`, Errors{{"$", "expected object, got null"}}},
+		{"invalid JSON", s, `{"kind":`, Errors{{"$", "invalid JSON: unexpected EOF"}}},
+		{"trailing data", s, `{"kind":"k","id":"abc"} {}`, Errors{{"$", "invalid JSON: data after the document"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.schema, []byte(tt.data))
+			if tt.errs == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var errs Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("expected Errors, got %v", err)
+			}
+			if !reflect.DeepEqual(errs, tt.errs) {
+				t.Errorf("got %v\nwant %v", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	err := Errors{{"$.a", "is required"}, {"$.b", "must not be empty"}}
+	if got, want := err.Error(), "$.a: is required; $.b: must not be empty"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -2,53 +2,493 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Go-routine-4995/routermgt/domain"
+	"time"
 )
 
 type IRepository interface {
-	// Add a list of router and return a list of routers that are already in the DB
-	Add(routes []domain.Router, tenant string) *[]domain.Router
+	// Add a list of router and return a list of routers that are already in the DB, it fails
+	// with domain.ErrQuotaExceeded without adding anything when a quota would be exceeded
+	Add(ctx context.Context, routes []domain.Router, tenant string) (*[]domain.Router, error)
 	// GetPaged return a pointer of a slice of routers, and the total number of page with the given limit.
-	GetPaged(page domain.Pagination, tenant string) (*[]domain.Router, int)
-	GetRouter(router domain.Router, tenant string) (domain.Router, bool)
-	Delete(routers []domain.Router, tenant string)
+	// It fails with ErrInvalidSelector or ErrInvalidState on a malformed filter.
+	GetPaged(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error)
+	GetRouter(ctx context.Context, router domain.Router, tenant string) (domain.Router, bool)
+	// Delete fails with a domain.ConflictError without deleting anything when the revision of a
+	// router is set and is not the current one
+	Delete(ctx context.Context, routers []domain.Router, tenant string) error
+	// Update replaces a router and returns it with its new revision, it fails with
+	// domain.ErrNotFound or a domain.ConflictError
+	Update(ctx context.Context, router domain.Router, tenant string) (domain.Router, error)
 }
 
+// IQuotaRepository is implemented by the repositories storing router quotas
+type IQuotaRepository interface {
+	Quotas(ctx context.Context, tenant string) ([]domain.Quota, error)
+	QuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error)
+}
+
+// IAuditRepository is implemented by the repositories recording the audit trail
+type IAuditRepository interface {
+	AuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error)
+}
+
+// IHistoryRepository is implemented by the repositories keeping the versions of the routers
+type IHistoryRepository interface {
+	RouterHistory(ctx context.Context, serial string, tenant string) ([]domain.RouterVersion, error)
+	RouterAt(ctx context.Context, serial string, tenant string, t time.Time) (*domain.RouterVersion, error)
+}
+
+// IDeletedRepository is implemented by the repositories keeping the deleted routers as tombstones
+type IDeletedRepository interface {
+	Restore(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error)
+	Deleted(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error)
+}
+
+// ILabelRepository is implemented by the repositories storing the router labels
+type ILabelRepository interface {
+	Label(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error)
+}
+
+// IGroupRepository is implemented by the repositories storing the site hierarchy
+type IGroupRepository interface {
+	Groups(ctx context.Context, tenant string) ([]domain.Group, error)
+	GroupCounts(ctx context.Context, tenant string) (map[string]int, error)
+	SaveGroup(ctx context.Context, g domain.Group, tenant string) error
+	DeleteGroup(ctx context.Context, id string, tenant string) error
+	Assign(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error)
+}
+
+// IPublisher receives the quota events, see Service.SetPublisher
+type IPublisher interface {
+	PublishQuotaEvent(ev domain.QuotaEvent)
+}
+
+// IService methods return an error when the request is rejected (e.g. rate limited), a
+// router not found is not an error
 type IService interface {
+	AddRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error)
+	GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error)
+	GetRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) error
+	// UpdateRouter replaces a router, router.Revision 0 skips the concurrency check
+	UpdateRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error)
+	// LabelRouters sets and removes labels of routers and returns the labelled routers, unknown
+	// serials are ignored
+	LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error)
+	// TransitionRouter moves a router to another lifecycle state, it fails with
+	// domain.ErrInvalidTransition when the state cannot be reached from the current one
+	TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (*domain.Router, error)
+	// GetGroups returns the groups under root, every group when root is empty, with their router counts
+	GetGroups(ctx context.Context, root string, tenant string) ([]domain.GroupCount, error)
+	// SaveGroup creates or replaces a group
+	SaveGroup(ctx context.Context, g domain.Group, tenant string) error
+	// DeleteGroup removes a group, it fails with domain.ErrGroupNotEmpty when it has sub-groups or routers
+	DeleteGroup(ctx context.Context, id string, tenant string) error
+	// AssignRouters moves routers to a group, an empty group removes them from their group
+	AssignRouters(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error)
+	GetQuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error)
+	// GetAuditTrail returns a page of the audit entries of the tenant and the index of the last page
+	GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error)
+	// GetRouterHistory returns the versions of a router, oldest first, or the version valid at q.At
+	GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) ([]domain.RouterVersion, error)
+	DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (*domain.RouterDiff, error)
+	// RestoreRouters brings back deleted routers and returns them, unknown routers are ignored
+	RestoreRouters(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error)
+	// GetDeletedRouters returns a page of deleted routers, most recent first, and the index of the last page
+	GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error)
 }
 
+var (
+	errNoQuotas  = errors.New("quotas are not supported by the repository")
+	errNoAudit   = errors.New("audit trail is not supported by the repository")
+	errNoHistory = errors.New("router history is not supported by the repository")
+	errNoDeleted = errors.New("restore is not supported by the repository")
+	errNoLabels  = errors.New("labels are not supported by the repository")
+	errNoGroups  = errors.New("groups are not supported by the repository")
+)
+
 type Service struct {
-	rep IRepository
+	rep     IRepository
+	quotas  IQuotaRepository
+	audit   IAuditRepository
+	history IHistoryRepository
+	deleted IDeletedRepository
+	labels  ILabelRepository
+	groups  IGroupRepository
+	pub     IPublisher
 }
 
-func NewService(r interface{}) IService {
-	return &Service{
+func NewService(r interface{}) *Service {
+	s := &Service{
 		rep: r.(IRepository),
 	}
+	s.quotas, _ = r.(IQuotaRepository)
+	s.audit, _ = r.(IAuditRepository)
+	s.history, _ = r.(IHistoryRepository)
+	s.deleted, _ = r.(IDeletedRepository)
+	s.labels, _ = r.(ILabelRepository)
+	s.groups, _ = r.(IGroupRepository)
+	return s
+}
+
+// SetPublisher enables the quota events, they are published when an Add crosses a threshold
+func (s *Service) SetPublisher(p interface{}) {
+	s.pub = p.(IPublisher)
+}
+
+func (s *Service) AddRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error) {
+	// the caller's routers are left untouched
+	add := make([]domain.Router, len(routers))
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, r := range routers {
+		if err := domain.ValidateLabels(r.Labels); err != nil {
+			return nil, fmt.Errorf("router %s: %w", r.RouterSerial, err)
+		}
+		// the routers are ordered unless imported in service
+		if r.State == "" {
+			r.State = domain.StateOrdered
+		} else if err := domain.ValidateEntryState(r.State); err != nil {
+			return nil, fmt.Errorf("router %s: %w", r.RouterSerial, err)
+		}
+		r.StateSince = &now
+		add[i] = r
+	}
+	return s.add(ctx, add, tenant)
+}
+
+// ImportRouters adds routers exported from an inventory, unlike AddRouters their state is kept
+// with its time and reason. A router without state is active like the routers created before
+// the lifecycle.
+func (s *Service) ImportRouters(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error) {
+	add := make([]domain.Router, len(routers))
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, r := range routers {
+		if err := domain.ValidateLabels(r.Labels); err != nil {
+			return nil, fmt.Errorf("router %s: %w", r.RouterSerial, err)
+		}
+		if r.State != "" {
+			if err := domain.ValidateState(r.State); err != nil {
+				return nil, fmt.Errorf("router %s: %w", r.RouterSerial, err)
+			}
+			if r.StateSince == nil {
+				r.StateSince = &now
+			}
+		}
+		add[i] = r
+	}
+	return s.add(ctx, add, tenant)
+}
+
+func (s *Service) add(ctx context.Context, routers []domain.Router, tenant string) (*[]domain.Router, error) {
+	var dup *[]domain.Router
+
+	err := s.watchQuotas(ctx, tenant, func() error {
+		var err error
+		dup, err = s.rep.Add(ctx, routers, tenant)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dup, nil
+}
+
+func (s *Service) UpdateRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error) {
+	var updated domain.Router
+
+	// the state, the labels and the group are kept, an update without revision is made against
+	// the router read here
+	if cur, ok := s.rep.GetRouter(ctx, router, tenant); ok {
+		if router.State != "" && router.State != cur.CurrentState() {
+			return nil, fmt.Errorf("%w: the state of router %s is changed by a transition", domain.ErrInvalidTransition, router.RouterSerial)
+		}
+		router.State, router.StateSince, router.StateReason = cur.State, cur.StateSince, cur.StateReason
+		router.Labels, router.Group = cur.Labels, cur.Group
+		if router.Revision == 0 {
+			router.Revision = cur.Revision
+		}
+	}
+	// moving a router to another account changes the usage of the account quotas
+	err := s.watchQuotas(ctx, tenant, func() error {
+		var err error
+		updated, err = s.rep.Update(ctx, router, tenant)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (s *Service) LabelRouters(ctx context.Context, serials []string, change domain.LabelChange, tenant string) ([]domain.Router, error) {
+	if s.labels == nil {
+		return nil, errNoLabels
+	}
+	if err := change.Validate(); err != nil {
+		return nil, err
+	}
+	return s.labels.Label(ctx, serials, change, tenant)
+}
+
+func (s *Service) TransitionRouter(ctx context.Context, t domain.Transition, tenant string) (*domain.Router, error) {
+	r, ok := s.rep.GetRouter(ctx, domain.Router{RouterSerial: t.RouterSerial}, tenant)
+	if !ok {
+		return nil, fmt.Errorf("%w: router %s", domain.ErrNotFound, t.RouterSerial)
+	}
+	if err := domain.CheckRevision(r, t.Revision); err != nil {
+		return nil, err
+	}
+	if err := domain.CheckTransition(r.CurrentState(), t.State); err != nil {
+		return nil, fmt.Errorf("router %s: %w", r.RouterSerial, err)
+	}
+	// the revision read makes the update fail if the state changed meanwhile
+	r.State = t.State
+	now := time.Now().UTC().Truncate(time.Second)
+	r.StateSince = &now
+	r.StateReason = t.Reason
+	updated, err := s.rep.Update(ctx, r, tenant)
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (s *Service) GetGroups(ctx context.Context, root string, tenant string) ([]domain.GroupCount, error) {
+	if s.groups == nil {
+		return nil, errNoGroups
+	}
+	groups, err := s.groups.Groups(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := s.groups.GroupCounts(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	tree := domain.GroupTree(groups, counts, root)
+	if root != "" && len(tree) == 0 {
+		return nil, fmt.Errorf("%w: group %s", domain.ErrNotFound, root)
+	}
+	return tree, nil
+}
+
+func (s *Service) SaveGroup(ctx context.Context, g domain.Group, tenant string) error {
+	if s.groups == nil {
+		return errNoGroups
+	}
+	return s.groups.SaveGroup(ctx, g, tenant)
+}
+
+func (s *Service) DeleteGroup(ctx context.Context, id string, tenant string) error {
+	if s.groups == nil {
+		return errNoGroups
+	}
+	return s.groups.DeleteGroup(ctx, id, tenant)
+}
+
+func (s *Service) AssignRouters(ctx context.Context, serials []string, group string, tenant string) ([]domain.Router, error) {
+	if s.groups == nil {
+		return nil, errNoGroups
+	}
+	return s.groups.Assign(ctx, serials, group, tenant)
+}
+
+// GetQuotaUsage returns the number of routers and the limit of the tenant and of its accounts with a quota
+func (s *Service) GetQuotaUsage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error) {
+	if s.quotas == nil {
+		return nil, errNoQuotas
+	}
+	return s.quotas.QuotaUsage(ctx, tenant)
+}
+
+func (s *Service) GetAuditTrail(ctx context.Context, q domain.AuditQuery, tenant string) ([]domain.AuditEntry, int, error) {
+	if s.audit == nil {
+		return nil, 0, errNoAudit
+	}
+	if q.Limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid page limit %d", q.Limit)
+	}
+	return s.audit.AuditTrail(ctx, q, tenant)
+}
+
+func (s *Service) GetRouterHistory(ctx context.Context, q domain.HistoryQuery, tenant string) ([]domain.RouterVersion, error) {
+	if s.history == nil {
+		return nil, errNoHistory
+	}
+	if !q.At.IsZero() {
+		v, err := s.history.RouterAt(ctx, q.RouterSerial, tenant, q.At)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, fmt.Errorf("%w: router %s did not exist at %s", domain.ErrNotFound, q.RouterSerial, q.At.Format(time.RFC3339))
+		}
+		return []domain.RouterVersion{*v}, nil
+	}
+	versions, err := s.history.RouterHistory(ctx, q.RouterSerial, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: router %s has no history", domain.ErrNotFound, q.RouterSerial)
+	}
+	return versions, nil
+}
+
+// DiffRouter compares two versions of a router, q.To 0 is the latest version
+func (s *Service) DiffRouter(ctx context.Context, q domain.DiffQuery, tenant string) (*domain.RouterDiff, error) {
+	if s.history == nil {
+		return nil, errNoHistory
+	}
+	versions, err := s.history.RouterHistory(ctx, q.RouterSerial, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if q.To == 0 {
+		q.To = len(versions)
+	}
+	// versions are numbered from 1 without gap
+	for _, n := range []int{q.From, q.To} {
+		if n < 1 || n > len(versions) {
+			return nil, fmt.Errorf("%w: router %s has no version %d", domain.ErrNotFound, q.RouterSerial, n)
+		}
+	}
+	return &domain.RouterDiff{
+		RouterSerial: q.RouterSerial,
+		From:         q.From,
+		To:           q.To,
+		Changes:      domain.Diff(versions[q.From-1].Router, versions[q.To-1].Router),
+	}, nil
 }
 
-func (s *Service) AddRouters(ctx context.Context, routers []domain.Router, tenant string) *[]domain.Router {
-	return s.rep.Add(routers, tenant)
+func (s *Service) RestoreRouters(ctx context.Context, routers []domain.Router, tenant string) ([]domain.Router, error) {
+	var restored []domain.Router
+
+	if s.deleted == nil {
+		return nil, errNoDeleted
+	}
+	err := s.watchQuotas(ctx, tenant, func() error {
+		var err error
+		restored, err = s.deleted.Restore(ctx, routers, tenant)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+func (s *Service) GetDeletedRouters(ctx context.Context, page domain.Pagination, tenant string) ([]domain.DeletedRouter, int, error) {
+	if s.deleted == nil {
+		return nil, 0, errNoDeleted
+	}
+	if page.Limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid page limit %d", page.Limit)
+	}
+	return s.deleted.Deleted(ctx, page, tenant)
+}
+
+// watchQuotas runs change and publishes the quota events of the thresholds it crossed
+func (s *Service) watchQuotas(ctx context.Context, tenant string, change func() error) error {
+	var before []domain.QuotaUsage
+
+	limited := s.limited(ctx, tenant)
+	if limited {
+		before, _ = s.usage(ctx, tenant)
+	}
+	err := change()
+	if err != nil {
+		return err
+	}
+	if limited && before != nil {
+		after, err := s.usage(ctx, tenant)
+		if err == nil {
+			s.notify(before, after)
+		}
+	}
+	return nil
+}
+
+// limited tells whether the tenant has a quota worth watching for the events
+func (s *Service) limited(ctx context.Context, tenant string) bool {
+	if s.quotas == nil || s.pub == nil {
+		return false
+	}
+	quotas, err := s.quotas.Quotas(ctx, tenant)
+	if err != nil {
+		fmt.Println("reading quotas: ", err)
+		return false
+	}
+	for _, q := range quotas {
+		if q.Limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) usage(ctx context.Context, tenant string) ([]domain.QuotaUsage, error) {
+	u, err := s.quotas.QuotaUsage(ctx, tenant)
+	if err != nil {
+		fmt.Println("reading quota usage: ", err)
+	}
+	return u, err
+}
+
+// notify publishes an event for every threshold crossed between before and after. Concurrent Add
+// of a tenant may both see the crossing, an event is never missed but can be sent twice.
+func (s *Service) notify(before []domain.QuotaUsage, after []domain.QuotaUsage) {
+	prev := make(map[string]int)
+	for _, u := range before {
+		prev[u.AccountID] = u.Used
+	}
+	for _, u := range after {
+		if u.Limit <= 0 {
+			continue
+		}
+		for _, t := range []struct {
+			threshold int
+			event     string
+		}{
+			{domain.QuotaWarning, domain.EventQuotaWarning},
+			{domain.QuotaReached, domain.EventQuotaReached},
+		} {
+			if prev[u.AccountID]*100 < t.threshold*u.Limit && u.Used*100 >= t.threshold*u.Limit {
+				s.pub.PublishQuotaEvent(domain.QuotaEvent{
+					Type:      t.event,
+					Tenant:    u.Tenant,
+					AccountID: u.AccountID,
+					Threshold: t.threshold,
+					Used:      u.Used,
+					Limit:     u.Limit,
+					Time:      time.Now().UTC().Format(time.RFC3339),
+				})
+			}
+		}
+	}
 }
 
-func (s *Service) GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int) {
-	return s.rep.GetPaged(page, tenant)
+func (s *Service) GetPagedRouters(ctx context.Context, page domain.Pagination, tenant string) (*[]domain.Router, int, error) {
+	return s.rep.GetPaged(ctx, page, tenant)
 }
 
-func (s *Service) DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) {
-	s.rep.Delete(routers, tenant)
+func (s *Service) DeleteRouters(ctx context.Context, routers []domain.Router, tenant string) error {
+	return s.rep.Delete(ctx, routers, tenant)
 }
 
-func (s *Service) GetRouter(ctx context.Context, router domain.Router, tenant string) *domain.Router {
+func (s *Service) GetRouter(ctx context.Context, router domain.Router, tenant string) (*domain.Router, error) {
 	var (
 		re     domain.Router
 		status bool
 	)
-	re, status = s.rep.GetRouter(router, tenant)
+	re, status = s.rep.GetRouter(ctx, router, tenant)
 	if status {
-		return &re
+		return &re, nil
 	} else {
-		return nil
+		return nil, nil
 	}
 
 }
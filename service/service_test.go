@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Go-routine-4995/routermgt/adapter/repository/simdb"
+	"github.com/Go-routine-4995/routermgt/domain"
+	"reflect"
+	"testing"
+)
+
+// publisher records the quota events
+type publisher struct {
+	events []domain.QuotaEvent
+}
+
+func (p *publisher) PublishQuotaEvent(ev domain.QuotaEvent) {
+	ev.Time = ""
+	p.events = append(p.events, ev)
+}
+
+func routers(prefix string, n int, account string) []domain.Router {
+	res := make([]domain.Router, n)
+	for i := range res {
+		res[i] = domain.Router{RouterSerial: fmt.Sprintf("%s%02d", prefix, i), AccountID: account}
+	}
+	return res
+}
+
+func TestNotify(t *testing.T) {
+	usage := func(account string, used int, limit int) domain.QuotaUsage {
+		return domain.QuotaUsage{Tenant: "acme", AccountID: account, Used: used, Limit: limit}
+	}
+	event := func(typ string, threshold int, account string, used int, limit int) domain.QuotaEvent {
+		return domain.QuotaEvent{Type: typ, Tenant: "acme", AccountID: account, Threshold: threshold, Used: used, Limit: limit}
+	}
+
+	tests := []struct {
+		name   string
+		before []domain.QuotaUsage
+		after  []domain.QuotaUsage
+		events []domain.QuotaEvent
+	}{
+		{"below warning", []domain.QuotaUsage{usage("", 1, 10)}, []domain.QuotaUsage{usage("", 7, 10)}, nil},
+		{"warning", []domain.QuotaUsage{usage("", 7, 10)}, []domain.QuotaUsage{usage("", 8, 10)}, []domain.QuotaEvent{
+			event(domain.EventQuotaWarning, domain.QuotaWarning, "", 8, 10),
+		}},
+		{"already warned", []domain.QuotaUsage{usage("", 8, 10)}, []domain.QuotaUsage{usage("", 9, 10)}, nil},
+		{"reached", []domain.QuotaUsage{usage("", 9, 10)}, []domain.QuotaUsage{usage("", 10, 10)}, []domain.QuotaEvent{
+			event(domain.EventQuotaReached, domain.QuotaReached, "", 10, 10),
+		}},
+		{"both at once", []domain.QuotaUsage{usage("", 0, 10)}, []domain.QuotaUsage{usage("", 10, 10)}, []domain.QuotaEvent{
+			event(domain.EventQuotaWarning, domain.QuotaWarning, "", 10, 10),
+			event(domain.EventQuotaReached, domain.QuotaReached, "", 10, 10),
+		}},
+		// 80% of 3 is 2.4, the warning is sent at 3
+		{"rounded up", []domain.QuotaUsage{usage("", 1, 3)}, []domain.QuotaUsage{usage("", 2, 3)}, nil},
+		{"unlimited", []domain.QuotaUsage{usage("", 0, 0)}, []domain.QuotaUsage{usage("", 100, 0)}, nil},
+		{"decrease", []domain.QuotaUsage{usage("", 10, 10)}, []domain.QuotaUsage{usage("", 5, 10)}, nil},
+		{"per account", []domain.QuotaUsage{usage("", 2, 100), usage("a", 2, 5), usage("b", 0, 5)}, []domain.QuotaUsage{usage("", 6, 100), usage("a", 4, 5), usage("b", 2, 5)}, []domain.QuotaEvent{
+			event(domain.EventQuotaWarning, domain.QuotaWarning, "a", 4, 5),
+		}},
+		{"new account quota", nil, []domain.QuotaUsage{usage("a", 5, 5)}, []domain.QuotaEvent{
+			event(domain.EventQuotaWarning, domain.QuotaWarning, "a", 5, 5),
+			event(domain.EventQuotaReached, domain.QuotaReached, "a", 5, 5),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &publisher{}
+			s := &Service{pub: p}
+			s.notify(tt.before, tt.after)
+			if !reflect.DeepEqual(p.events, tt.events) {
+				t.Errorf("got %+v\nwant %+v", p.events, tt.events)
+			}
+		})
+	}
+}
+
+func TestQuotaEvents(t *testing.T) {
+	ctx := context.Background()
+	db := simdb.NewSimDB()
+	if err := db.SetQuota(ctx, domain.Quota{Tenant: "acme", Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(db)
+	p := &publisher{}
+	s.SetPublisher(p)
+
+	steps := []struct {
+		routers []domain.Router
+		err     error
+		events  []string
+	}{
+		{routers("a", 7, ""), nil, nil},
+		{routers("b", 1, ""), nil, []string{domain.EventQuotaWarning}},
+		// duplicates are not counted
+		{routers("b", 1, ""), nil, nil},
+		{routers("c", 3, ""), domain.ErrQuotaExceeded, nil},
+		{routers("c", 2, ""), nil, []string{domain.EventQuotaReached}},
+	}
+	for i, st := range steps {
+		p.events = nil
+		_, err := s.AddRouters(ctx, st.routers, "acme")
+		if !errors.Is(err, st.err) {
+			t.Fatalf("step %d: error %v, want %v", i, err, st.err)
+		}
+		var got []string
+		for _, ev := range p.events {
+			got = append(got, ev.Type)
+		}
+		if !reflect.DeepEqual(got, st.events) {
+			t.Errorf("step %d: events %v, want %v", i, got, st.events)
+		}
+	}
+
+	// the tenants without quota are not watched
+	p.events = nil
+	if _, err := s.AddRouters(ctx, routers("a", 20, ""), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.events) != 0 {
+		t.Errorf("events for a tenant without quota: %+v", p.events)
+	}
+}
+
+func TestAddRoutersState(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		state string
+		want  string
+		err   error
+	}{
+		{"ordered by default", "", domain.StateOrdered, nil},
+		{"imported provisioned", domain.StateProvisioned, domain.StateProvisioned, nil},
+		{"imported active", domain.StateActive, domain.StateActive, nil},
+		{"suspended", domain.StateSuspended, "", domain.ErrInvalidState},
+		{"rma", domain.StateRMA, "", domain.ErrInvalidState},
+		{"decommissioned", domain.StateDecommissioned, "", domain.ErrInvalidState},
+		{"unknown", "broken", "", domain.ErrInvalidState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(simdb.NewSimDB())
+			in := []domain.Router{{RouterSerial: "S1", State: tt.state}}
+			_, err := s.AddRouters(ctx, in, "acme")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			// the caller's routers are not changed
+			if in[0].State != tt.state || in[0].StateSince != nil {
+				t.Errorf("AddRouters changed its argument: %+v", in[0])
+			}
+			if tt.err != nil {
+				return
+			}
+			r, err := s.GetRouter(ctx, domain.Router{RouterSerial: "S1"}, "acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.State != tt.want || r.StateSince == nil {
+				t.Errorf("created in state %q since %v, want %q", r.State, r.StateSince, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransitionRouter(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(simdb.NewSimDB())
+	if _, err := s.AddRouters(ctx, routers("S", 1, ""), "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		transition domain.Transition
+		state      string
+		err        error
+	}{
+		{"provision", domain.Transition{RouterSerial: "S00", State: domain.StateProvisioned, Reason: "shipped"}, domain.StateProvisioned, nil},
+		{"skip a state", domain.Transition{RouterSerial: "S00", State: domain.StateSuspended}, domain.StateProvisioned, domain.ErrInvalidTransition},
+		{"stale revision", domain.Transition{RouterSerial: "S00", State: domain.StateActive, Revision: 1}, domain.StateProvisioned, domain.ErrConflict},
+		{"activate", domain.Transition{RouterSerial: "S00", State: domain.StateActive, Revision: 2}, domain.StateActive, nil},
+		{"unknown router", domain.Transition{RouterSerial: "S99", State: domain.StateActive}, domain.StateActive, domain.ErrNotFound},
+		{"decommission", domain.Transition{RouterSerial: "S00", State: domain.StateDecommissioned, Reason: "end of life"}, domain.StateDecommissioned, nil},
+		{"final", domain.Transition{RouterSerial: "S00", State: domain.StateActive}, domain.StateDecommissioned, domain.ErrInvalidTransition},
+	}
+	for _, st := range steps {
+		_, err := s.TransitionRouter(ctx, st.transition, "acme")
+		if !errors.Is(err, st.err) {
+			t.Fatalf("%s: error %v, want %v", st.name, err, st.err)
+		}
+		r, err := s.GetRouter(ctx, domain.Router{RouterSerial: "S00"}, "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.State != st.state {
+			t.Errorf("%s: state %q, want %q", st.name, r.State, st.state)
+		}
+		if st.err == nil && r.StateReason != st.transition.Reason {
+			t.Errorf("%s: reason %q, want %q", st.name, r.StateReason, st.transition.Reason)
+		}
+	}
+}
+
+func TestUpdateRouterKeepsState(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(simdb.NewSimDB())
+	if _, err := s.AddRouters(ctx, []domain.Router{{RouterSerial: "S1", State: domain.StateProvisioned}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.GetRouter(ctx, domain.Router{RouterSerial: "S1"}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an update without state keeps it
+	r, err := s.UpdateRouter(ctx, domain.Router{RouterSerial: "S1", OperatorName: "op"}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != domain.StateProvisioned || !r.StateSince.Equal(*before.StateSince) || r.OperatorName != "op" {
+		t.Errorf("unexpected router %+v", r)
+	}
+
+	// the state is changed by a transition only
+	_, err = s.UpdateRouter(ctx, domain.Router{RouterSerial: "S1", State: domain.StateActive}, "acme")
+	if !errors.Is(err, domain.ErrInvalidTransition) {
+		t.Errorf("state changed by an update: %v", err)
+	}
+}
+
+func TestUpdateRouterKeepsLabels(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(simdb.NewSimDB())
+	if _, err := s.AddRouters(ctx, []domain.Router{{RouterSerial: "S1"}}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveGroup(ctx, domain.Group{ID: "eu", Name: "Europe"}, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AssignRouters(ctx, []string{"S1"}, "eu", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	labelled, err := s.LabelRouters(ctx, []string{"S1"}, domain.LabelChange{Set: map[string]string{"ring": "canary"}}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		router domain.Router
+	}{
+		{"plain update", domain.Router{RouterSerial: "S1", OperatorName: "op"}},
+		{"with revision", domain.Router{RouterSerial: "S1", OperatorName: "op2", Revision: labelled[0].Revision + 1}},
+		// the labels and the group are changed by the label and assign operations only
+		{"other labels and group", domain.Router{RouterSerial: "S1", OperatorName: "op3", Labels: map[string]string{"ring": "stable"}, Group: "us"}},
+	}
+	for _, tt := range tests {
+		r, err := s.UpdateRouter(ctx, tt.router, "acme")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		stored, err := s.GetRouter(ctx, domain.Router{RouterSerial: "S1"}, "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range []*domain.Router{r, stored} {
+			if !reflect.DeepEqual(got.Labels, map[string]string{"ring": "canary"}) || got.Group != "eu" || got.OperatorName != tt.router.OperatorName {
+				t.Errorf("%s: unexpected router %+v", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestImportRouters(t *testing.T) {
+	ctx := context.Background()
+	src := NewService(simdb.NewSimDB())
+	if _, err := src.AddRouters(ctx, routers("S", 4, ""), "acme"); err != nil {
+		t.Fatal(err)
+	}
+	// S00 stays ordered, S01 is suspended, S02 sent back and S03 decommissioned
+	for _, tr := range []domain.Transition{
+		{RouterSerial: "S01", State: domain.StateProvisioned},
+		{RouterSerial: "S01", State: domain.StateActive},
+		{RouterSerial: "S01", State: domain.StateSuspended, Reason: "unpaid"},
+		{RouterSerial: "S02", State: domain.StateProvisioned},
+		{RouterSerial: "S02", State: domain.StateRMA, Reason: "broken fan"},
+		{RouterSerial: "S03", State: domain.StateDecommissioned, Reason: "cancelled"},
+	} {
+		if _, err := src.TransitionRouter(ctx, tr, "acme"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported, _, err := src.GetPagedRouters(ctx, domain.Pagination{Limit: 10}, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file []domain.Router
+	if err = json.Unmarshal(b, &file); err != nil {
+		t.Fatal(err)
+	}
+
+	// the routers are imported as exported, in states a router cannot be created in
+	dst := NewService(simdb.NewSimDB())
+	if _, err = dst.ImportRouters(ctx, file, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range *exported {
+		got, err := dst.GetRouter(ctx, domain.Router{RouterSerial: want.RouterSerial}, "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.State != want.State || !got.StateSince.Equal(*want.StateSince) || got.StateReason != want.StateReason {
+			t.Errorf("%s imported in state %q since %v (%q), exported in %q since %v (%q)", want.RouterSerial, got.State, got.StateSince, got.StateReason, want.State, want.StateSince, want.StateReason)
+		}
+	}
+	// the API create accepts the entry states only
+	if _, err = NewService(simdb.NewSimDB()).AddRouters(ctx, file, "acme"); !errors.Is(err, domain.ErrInvalidState) {
+		t.Errorf("exported routers created: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		router domain.Router
+		state  string
+		since  bool
+		err    error
+	}{
+		// like the routers created before the lifecycle
+		{"without state", domain.Router{RouterSerial: "S1"}, "", false, nil},
+		{"without time", domain.Router{RouterSerial: "S1", State: domain.StateSuspended}, domain.StateSuspended, true, nil},
+		{"unknown state", domain.Router{RouterSerial: "S1", State: "broken"}, "", false, domain.ErrInvalidState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(simdb.NewSimDB())
+			_, err := s.ImportRouters(ctx, []domain.Router{tt.router}, "acme")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			r, err := s.GetRouter(ctx, domain.Router{RouterSerial: "S1"}, "acme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.State != tt.state || (r.StateSince != nil) != tt.since || r.CurrentState() == domain.StateOrdered {
+				t.Errorf("imported in state %q since %v", r.State, r.StateSince)
+			}
+		})
+	}
+}